@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+)
+
+// UserChange is what an admin may change about a user. Fields left out
+// stay as they are.
+type UserChange struct {
+	Role     *string
+	Disabled *bool
+}
+
+var userChangePostMax = flag.Int64("userchangepostmax", 1024, "largest body for changing a user")
+
+func (c *UserChange) Validate() (*UserChange, *Error) {
+	if c.Role != nil && roleRank(*c.Role) < 0 {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.Errorf("unknown role %q", *c.Role)}
+		return nil, e
+	}
+	return c, nil
+}
+
+func UserChangeFromForm(r *http.Request) (*UserChange, *Error) {
+	var err error
+	change := &UserChange{}
+
+	if err = r.ParseForm(); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "ParseForm failed"),
+		}
+		return nil, e
+	}
+
+	err = env.Form.Decode(change, r.PostForm)
+	if err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "Decode failed"),
+		}
+		return nil, e
+	}
+
+	return change.Validate()
+}
+
+func UserChangeFromJSON(r io.Reader) (*UserChange, *Error) {
+	change := &UserChange{}
+	if err := json.NewDecoder(r).Decode(change); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "json decoding failed"),
+		}
+		return nil, e
+	}
+	return change.Validate()
+}
+
+// Apply makes the change to userName's account on behalf of admin. When it
+// takes something away, every token the user has is revoked, so the change
+// holds right away rather than when their token runs out. A new role shows
+// up in the next token they get.
+func (c *UserChange) Apply(admin, userName string) (*User, *Error) {
+	if userName == admin {
+		// or the last admin could lock everyone out
+		e := &Error{Code: http.StatusForbidden, Message: errors.New("admins can't change their own account")}
+		return nil, e
+	}
+	user, e := UserByUsername(userName)
+	if e != nil {
+		return nil, e
+	}
+
+	demoted := false
+	if c.Role != nil {
+		demoted = !HasRole(*c.Role, user.Role)
+		user.Role = *c.Role
+	}
+	if c.Disabled != nil {
+		demoted = demoted || (*c.Disabled && !user.Disabled)
+		user.Disabled = *c.Disabled
+	}
+	if err := env.Store.UpdateUser(user); err != nil {
+		return nil, StoreError(err)
+	}
+	if demoted {
+		if e = EndAllSessions(userName); e != nil {
+			return nil, e
+		}
+	}
+	user.Pass = ""
+	return user, nil
+}
+
+// Users returns everyone, by name, without their password hashes.
+func Users() ([]*User, *Error) {
+	users, err := env.Store.AllUsers()
+	if err != nil {
+		return nil, StoreError(err)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	for _, user := range users {
+		user.Pass = ""
+	}
+	if users == nil {
+		users = []*User{}
+	}
+	return users, nil
+}
+
+type AdminModel struct {
+	Username    string
+	Roles       []string
+	Users       []*User
+	Query       *PollQuery
+	Polls       []Poll
+	Next        string
+	Invitations []*Invitation
+	// Issued and Reset are an invitation and a password reset that were
+	// just made, whose codes can only be shown now.
+	Issued *IssuedInvitation
+	Reset  *IssuedPasswordReset
+}
+
+var adminTemplate *template.Template
+
+func init() {
+	adminTemplate = parseTemplate("templates/admin.html")
+}
+
+// renderAdmin shows the admin console, with whatever was just issued in
+// model.
+func renderAdmin(w http.ResponseWriter, r *http.Request, model *AdminModel) {
+	model.Username, model.Roles = JWTUser(r), roles
+	var e *Error
+	if model.Users, e = Users(); e != nil {
+		e.Write(w, r)
+		return
+	}
+	q, page, e := ListPage(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	model.Query, model.Polls = q, page.Polls
+	if page.Next != "" {
+		model.Next = q.URL(page.Next)
+	}
+	invitations, err := env.Store.Invitations()
+	if err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	sort.Slice(invitations, func(i, j int) bool {
+		return invitations[i].CreatedAt.Before(invitations[j].CreatedAt)
+	})
+	model.Invitations = invitations
+
+	if ResponseType(r) == JSON {
+		WriteJSON(w, r, http.StatusOK, model)
+		return
+	}
+	if err = renderTemplate(w, r, adminTemplate, model); err != nil {
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "executing admin template"),
+		}
+		e.Write(w, r)
+		return
+	}
+}
+
+// AdminGet shows users, a page of polls, and open invitations.
+func AdminGet(w http.ResponseWriter, r *http.Request) {
+	renderAdmin(w, r, &AdminModel{})
+}
+
+// AdminUserPost changes a user's role, or disables or enables them.
+func AdminUserPost(w http.ResponseWriter, r *http.Request) {
+	inType := r.Context().Value("content-type").(string)
+
+	r.Body = http.MaxBytesReader(w, r.Body, *userChangePostMax)
+	defer r.Body.Close()
+
+	var change *UserChange
+	var e *Error
+	switch {
+	case inType == FormURL:
+		change, e = UserChangeFromForm(r)
+	case inType == JSON:
+		change, e = UserChangeFromJSON(r.Body)
+	default:
+		e = &Error{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: errors.New("supported types are form, json"),
+		}
+	}
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+
+	user, e := change.Apply(JWTUser(r), chi.URLParam(r, "username"))
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	Respond(w, r, http.StatusOK, user, "/admin")
+}
+
+// AdminPollDeletePost is DELETE /polls/:pollname for forms.
+func AdminPollDeletePost(w http.ResponseWriter, r *http.Request) {
+	pollName := chi.URLParam(r, "pollname")
+	if err := env.Store.DeletePoll(pollName); err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	env.Events.PollChanged(pollName)
+	Respond(w, r, http.StatusNoContent, nil, "/admin")
+}
+
+// AdminInvitationsPost invites someone, and shows the code.
+func AdminInvitationsPost(w http.ResponseWriter, r *http.Request) {
+	inType := r.Context().Value("content-type").(string)
+
+	r.Body = http.MaxBytesReader(w, r.Body, *invitationPostMax)
+	defer r.Body.Close()
+
+	var invite *Invite
+	var e *Error
+	switch {
+	case inType == FormURL:
+		invite, e = InviteFromForm(r)
+	case inType == JSON:
+		invite, e = InviteFromJSON(r.Body)
+	default:
+		e = &Error{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: errors.New("supported types are form, json"),
+		}
+	}
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+
+	issued, e := invite.Issue(JWTUser(r))
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if ResponseType(r) == JSON {
+		WriteJSON(w, r, http.StatusCreated, issued)
+		return
+	}
+	// the code is gone after this, so no redirect
+	renderAdmin(w, r, &AdminModel{Issued: issued})
+}
+
+// AdminPasswordResetPost issues a password reset, and shows the code.
+func AdminPasswordResetPost(w http.ResponseWriter, r *http.Request) {
+	reset, e := IssuePasswordReset(JWTUser(r), chi.URLParam(r, "username"))
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if ResponseType(r) == JSON {
+		WriteJSON(w, r, http.StatusCreated, reset)
+		return
+	}
+	renderAdmin(w, r, &AdminModel{Reset: reset})
+}
+
+// AdminInvitationDeletePost withdraws an invitation.
+func AdminInvitationDeletePost(w http.ResponseWriter, r *http.Request) {
+	if err := env.Store.DeleteInvitation(chi.URLParam(r, "id")); err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	Respond(w, r, http.StatusNoContent, nil, "/admin")
+}
+
+func APIUsersGet(w http.ResponseWriter, r *http.Request) {
+	users, e := Users()
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, users)
+}
+
+func APIUserPatch(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *userChangePostMax)
+	defer r.Body.Close()
+
+	change, e := UserChangeFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	user, e := change.Apply(JWTUser(r), chi.URLParam(r, "username"))
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, user)
+}
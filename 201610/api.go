@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/goware/jwtauth"
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+)
+
+// The JSON API lives under apiPrefix. Its handlers share models with the
+// HTML ones, but only ever speak JSON, and only take tokens from the
+// Authorization header. openapi.go describes it, and must be kept in step.
+const apiPrefix = "/api/v1"
+
+var ErrNoVote = errors.New("no vote")
+
+func APIRouter() *chi.Mux {
+	r := chi.NewRouter()
+
+	r.Use(RequireClientCert)
+	r.Use(APIChecks)
+	r.Use(BearerVerifier)
+	r.NotFound(APINotFound)
+
+	r.Get("/openapi.json", OpenAPIGet)
+
+	r.With(RateLimit("signups", signupRate)).Post("/users", APIUsersPost)
+	r.Post("/sessions", APISessionsPost)
+	r.Post("/sessions/refresh", APISessionsRefreshPost)
+	r.Post("/sessions/mfa", APISessionsMFAPost)
+	// needs a valid token, unless there's a reset code instead
+	r.Put("/users/:username/password", APIPasswordPut)
+
+	r.Get("/polls", APIPollsGet)
+	r.Get("/polls/:pollname", APIPollGet)
+	r.Get("/polls/:pollname/options", APIOptionsGet)
+	r.Get("/polls/:pollname/results", APIResultsGet)
+
+	// The handlers in this group require a valid token.
+	r.Group(func(r chi.Router) {
+		r.Use(BearerAuthenticator)
+
+		r.Delete("/sessions", APISessionsDelete)
+		r.Delete("/users/:username/sessions", APIUserSessionsDelete)
+		// Two-factor authentication: set up, confirm with a code, turn off
+		r.Post("/users/:username/mfa", APIMFAPost)
+		r.Put("/users/:username/mfa", APIMFAPut)
+		r.Delete("/users/:username/mfa", APIMFADelete)
+
+		// Managing users and invitations is for admins.
+		r.Group(func(r chi.Router) {
+			r.Use(RequireRole(RoleAdmin))
+
+			r.Get("/users", APIUsersGet)
+			r.Patch("/users/:username", APIUserPatch)
+			r.Post("/users/:username/password-resets", APIPasswordResetsPost)
+
+			r.Post("/invitations", APIInvitationsPost)
+			r.Get("/invitations", APIInvitationsGet)
+			r.Delete("/invitations/:id", APIInvitationDelete)
+		})
+
+		r.With(RateLimit("new polls", pollRate)).Post("/polls", APIPollsPost)
+		r.Put("/polls/:pollname", APIPollPut)
+		r.Patch("/polls/:pollname", APIPollPatch)
+		r.Delete("/polls/:pollname", PollDelete)
+
+		r.Post("/polls/:pollname/options", APIOptionsPost)
+
+		r.Get("/polls/:pollname/votes", APIVotesGet)
+		r.Get("/polls/:pollname/votes/:username", APIVoteGet)
+		r.With(RateLimit("votes", voteRate)).Put("/polls/:pollname/votes/:username", APIVotePut)
+	})
+
+	return r
+}
+
+// APIChecks is a middleware that makes every response JSON, errors included,
+// whatever the Accept header says, and insists on JSON request bodies.
+func APIChecks(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), "responseType", JSON))
+
+		switch r.Method {
+		case "POST", "PUT", "PATCH":
+			inType, err := RequestType(r)
+			if err != nil {
+				e := &Error{Code: http.StatusBadRequest, Message: err}
+				e.Write(w, r)
+				return
+			}
+			if inType != JSON {
+				e := &Error{
+					Code:    http.StatusUnsupportedMediaType,
+					Message: errors.Errorf("%s requests require a content-type of %s", r.Method, JSON),
+				}
+				e.Write(w, r)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), "content-type", inType))
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// BearerVerifier is a middleware like tokenAuth.Verifier, except the token
+// has to be in an "Authorization: Bearer" header. Query parameters and
+// cookies are ignored.
+func BearerVerifier(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		var token *jwt.Token
+		err := jwtauth.ErrUnauthorized
+		auth := r.Header.Get("Authorization")
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			token, err = VerifyToken(auth[7:])
+		}
+		ctx := tokenAuth.SetContext(r.Context(), token, err)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// BearerAuthenticator is a middleware that turns away requests without a
+// valid token.
+func BearerAuthenticator(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if err, ok := r.Context().Value("jwt.err").(error); ok && err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dengo"`)
+			e := &Error{Code: http.StatusUnauthorized, Message: err}
+			e.Write(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func APINotFound(w http.ResponseWriter, r *http.Request) {
+	e := &Error{
+		Code:    http.StatusNotFound,
+		Message: errors.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path),
+	}
+	e.Write(w, r)
+}
+
+func APIUsersPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *signupPostMax)
+	defer r.Body.Close()
+
+	signup, e := SignupFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if e = signup.Save(); e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusCreated, &User{Name: signup.Name})
+}
+
+func APISessionsPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *loginPostMax)
+	defer r.Body.Close()
+
+	user, e := UserFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if e = user.Authenticate(r); e != nil {
+		e.Write(w, r)
+		return
+	}
+	challenge, e := MFAChallengeFor(user.Name)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if challenge != nil {
+		// POST /sessions/mfa with a code gets the session
+		WriteJSON(w, r, http.StatusAccepted, challenge)
+		return
+	}
+	session, e := NewSession(user.Name)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusCreated, session)
+}
+
+// APISessionsRefreshPost swaps a refresh token for a new session. The old
+// refresh token stops working.
+func APISessionsRefreshPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *loginPostMax)
+	defer r.Body.Close()
+
+	refresh, e := RefreshFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	session, e := RefreshSession(refresh.RefreshToken)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, session)
+}
+
+// APISessionsDelete revokes the token the request was made with, along
+// with the refresh token that came with it.
+func APISessionsDelete(w http.ResponseWriter, r *http.Request) {
+	if e := EndSession(r); e != nil {
+		e.Write(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIUserSessionsDelete logs a user out everywhere. Admins may do it to
+// anyone.
+func APIUserSessionsDelete(w http.ResponseWriter, r *http.Request) {
+	userName := chi.URLParam(r, "username")
+	if userName != JWTUser(r) && !HasRole(JWTRole(r), RoleAdmin) {
+		e := &Error{Code: http.StatusForbidden, Message: errors.New("users can only log themselves out")}
+		e.Write(w, r)
+		return
+	}
+	if e := EndAllSessions(userName); e != nil {
+		e.Write(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func APIPollsGet(w http.ResponseWriter, r *http.Request) {
+	_, page, e := ListPage(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, page)
+}
+
+// apiPoll loads the poll named in the URL, with whatever the user isn't
+// allowed to see stripped out.
+func apiPoll(r *http.Request) (*Poll, *Error) {
+	poll, err := env.Store.PollByName(chi.URLParam(r, "pollname"))
+	if err != nil {
+		return nil, StoreError(err)
+	}
+	return poll.Redact(JWTUser(r) != ""), nil
+}
+
+func APIPollGet(w http.ResponseWriter, r *http.Request) {
+	poll, e := apiPoll(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, poll)
+}
+
+func APIPollsPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *pollPostMax)
+	defer r.Body.Close()
+
+	poll, e := PollFromJSON(r.Body, &Poll{})
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if e = poll.Create(JWTUser(r)); e != nil {
+		e.Write(w, r)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/polls/%s", apiPrefix, poll.Name))
+	WriteJSON(w, r, http.StatusCreated, poll)
+}
+
+func APIPollPut(w http.ResponseWriter, r *http.Request) {
+	apiPollUpdate(w, r, true)
+}
+
+func APIPollPatch(w http.ResponseWriter, r *http.Request) {
+	apiPollUpdate(w, r, false)
+}
+
+func apiPollUpdate(w http.ResponseWriter, r *http.Request, replace bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, *pollPostMax)
+	defer r.Body.Close()
+
+	poll, e := PollForEdit(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	poll, e = poll.Edit(replace, func(base *Poll) (*Poll, *Error) {
+		return PollFromJSON(r.Body, base)
+	})
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, poll.Redact(true))
+}
+
+func APIOptionsGet(w http.ResponseWriter, r *http.Request) {
+	poll, e := apiPoll(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	options := poll.Options
+	if options == nil {
+		options = []*PollOption{}
+	}
+	WriteJSON(w, r, http.StatusOK, options)
+}
+
+func APIOptionsPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *pollPostMax)
+	defer r.Body.Close()
+
+	option, e := PollOptionFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	poll, e := PollForEdit(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if e = option.Add(poll.Name); e != nil {
+		e.Write(w, r)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/polls/%s/options", apiPrefix, poll.Name))
+	WriteJSON(w, r, http.StatusCreated, option)
+}
+
+// APIVotesGet lists everyone's ballots, for polls that show who voted how.
+func APIVotesGet(w http.ResponseWriter, r *http.Request) {
+	poll, err := env.Store.PollByName(chi.URLParam(r, "pollname"))
+	if err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	if !poll.ShowsVoters() {
+		e := &Error{Code: http.StatusForbidden, Message: errors.New("votes in this poll aren't public")}
+		e.Write(w, r)
+		return
+	}
+	ballots := poll.Ballots
+	if ballots == nil {
+		ballots = map[string][]string{}
+	}
+	WriteJSON(w, r, http.StatusOK, ballots)
+}
+
+// APIVoteGet shows one user's ballot. Users can always see their own, but
+// other people's only when the poll shows who voted how.
+func APIVoteGet(w http.ResponseWriter, r *http.Request) {
+	poll, err := env.Store.PollByName(chi.URLParam(r, "pollname"))
+	if err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	userName := chi.URLParam(r, "username")
+	if userName != JWTUser(r) && !poll.ShowsVoters() {
+		e := &Error{Code: http.StatusForbidden, Message: errors.New("votes in this poll aren't public")}
+		e.Write(w, r)
+		return
+	}
+	choices, ok := poll.Ballots[poll.VoterKey(userName)]
+	if !ok {
+		e := &Error{Code: http.StatusNotFound, Message: ErrNoVote}
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, &Ballot{Choices: choices})
+}
+
+// APIVotePut casts the user's ballot, replacing any earlier one.
+func APIVotePut(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *pollPostMax)
+	defer r.Body.Close()
+
+	userName := JWTUser(r)
+	if chi.URLParam(r, "username") != userName {
+		e := &Error{Code: http.StatusForbidden, Message: errors.New("users can only vote for themselves")}
+		e.Write(w, r)
+		return
+	}
+	ballot, e := BallotFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if e = ballot.Cast(chi.URLParam(r, "pollname"), userName); e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, ballot)
+}
+
+func APIResultsGet(w http.ResponseWriter, r *http.Request) {
+	poll, err := env.Store.PollByName(chi.URLParam(r, "pollname"))
+	if err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	if poll.ResultsHidden() {
+		e := &Error{Code: http.StatusForbidden, Message: ErrResultsHidden}
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, poll.Results())
+}
@@ -1,31 +1,1038 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
 )
 
-var boltBuckets = []string{"users", "polls"}
+// Each poll gets its own bucket under "polls":
+//
+//	polls/<name>/poll           -> poll JSON, without votes
+//	polls/<name>/votes/<user>   -> ballot, a JSON array of responses
+//	polls/<name>/counts/<resp>  -> vote count, big-endian uint64
+//
+// so a vote only touches the voter's key and the counters it changes.
+var (
+	usersBucket  = []byte("users")
+	pollsBucket  = []byte("polls")
+	metaBucket   = []byte("meta")
+	votesBucket  = []byte("votes")
+	countsBucket = []byte("counts")
+	pollKey      = []byte("poll")
+	versionKey   = []byte("version")
+)
+
+// Tokens are kept flat, in buckets of their own:
+//
+//	refresh/<id>         -> refresh token JSON
+//	revoked/<jti>        -> when the revocation expires, unix seconds
+//	revokedUsers/<user>  -> user revocation JSON
+var (
+	refreshBucket      = []byte("refresh")
+	revokedBucket      = []byte("revoked")
+	revokedUsersBucket = []byte("revokedUsers")
+)
+
+// Invitations and password resets are kept by the hash of their code:
+//
+//	invitations/<id>     -> invitation JSON
+//	resets/<id>          -> password reset JSON
+var (
+	invitationsBucket = []byte("invitations")
+	resetsBucket      = []byte("resets")
+)
+
+// Two-factor settings are kept by user:
+//
+//	mfa/<user>           -> MFA JSON
+var mfaBucket = []byte("mfa")
+
+var boltBuckets = [][]byte{usersBucket, pollsBucket, metaBucket,
+	refreshBucket, revokedBucket, revokedUsersBucket, invitationsBucket,
+	resetsBucket, mfaBucket}
+
+// boltMigrations are applied in order, each recorded in meta/version once it
+// succeeds. Append new ones to the end, never edit one that has shipped.
+var boltMigrations = []func(tx *bolt.Tx) error{
+	boltNormalizeVotes,
+	boltVoteBallots,
+}
+
+// BoltStore keeps users and polls as JSON in a single bolt file.
+type BoltStore struct {
+	DB *bolt.DB
+}
 
-func BoltOpen(file string) error {
-	var err error
+func BoltOpen(file string) (*BoltStore, error) {
 	var opt = bolt.Options{Timeout: 1 * time.Second}
-	env.DB, err = bolt.Open(file, 0600, &opt)
+	db, err := bolt.Open(file, 0600, &opt)
 	if err != nil {
-		return errors.Wrap(err, "boltdb open failed")
+		return nil, errors.Wrap(err, "boltdb open failed")
 	}
 
-	err = env.DB.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx *bolt.Tx) error {
 		var err error
 		// create buckets
 		for _, name := range boltBuckets {
-			if _, err = tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			if _, err = tx.CreateBucketIfNotExists(name); err != nil {
 				return errors.Wrap(err, "boltdb bucket creation failed")
 			}
 		}
 		return nil
 	})
-	return err
+	if err == nil {
+		err = boltMigrate(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{DB: db}, nil
+}
+
+func boltMigrate(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		var current uint64
+		if val := meta.Get(versionKey); val != nil {
+			current = binary.BigEndian.Uint64(val)
+		}
+		for i := current; i < uint64(len(boltMigrations)); i++ {
+			if err := boltMigrations[i](tx); err != nil {
+				return errors.Wrapf(err, "boltdb migration %d failed", i+1)
+			}
+			if err := meta.Put(versionKey, boltUint64(i+1)); err != nil {
+				return errors.Wrap(err, "boltdb version update failed")
+			}
+		}
+		return nil
+	})
+}
+
+// boltNormalizeVotes converts polls stored as a single JSON value, votes and
+// all, into per-poll buckets.
+func boltNormalizeVotes(tx *bolt.Tx) error {
+	b := tx.Bucket(pollsBucket)
+	old := map[string][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		// nested buckets have nil values, anything else is an old poll
+		if v != nil {
+			old[string(k)] = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, val := range old {
+		poll := &Poll{}
+		if err = json.Unmarshal(val, poll); err != nil {
+			return errors.Wrapf(err, "poll %s unmarshal failed", name)
+		}
+		if err = b.Delete([]byte(name)); err != nil {
+			return errors.Wrap(err, "old poll delete failed")
+		}
+		if err = boltPutPollV1(b, poll); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltPutPollV1 writes a poll in the layout boltNormalizeVotes introduced,
+// with a single response stored per voter. Old polls could list a voter
+// under more than one response; the first one listed is kept. Counts are
+// of the votes kept, not of the old lists, which had false entries too.
+func boltPutPollV1(b *bolt.Bucket, p *Poll) error {
+	pb, err := b.CreateBucket([]byte(p.Name))
+	if err != nil {
+		return errors.Wrap(err, "poll bucket creation failed")
+	}
+	votes, err := pb.CreateBucket(votesBucket)
+	if err != nil {
+		return errors.Wrap(err, "votes bucket creation failed")
+	}
+	counts, err := pb.CreateBucket(countsBucket)
+	if err != nil {
+		return errors.Wrap(err, "counts bucket creation failed")
+	}
+
+	meta := *p
+	meta.Options = nil
+	for _, option := range p.Options {
+		meta.Options = append(meta.Options, &PollOption{Response: option.Response})
+		var n uint64
+		for user, voted := range option.Votes {
+			if !voted || votes.Get([]byte(user)) != nil {
+				continue
+			}
+			if err = votes.Put([]byte(user), []byte(option.Response)); err != nil {
+				return errors.Wrap(err, "vote failed")
+			}
+			n++
+		}
+		if err = counts.Put([]byte(option.Response), boltUint64(n)); err != nil {
+			return errors.Wrap(err, "count failed")
+		}
+	}
+	return boltPutPollMeta(pb, &meta)
+}
+
+// boltVoteBallots turns each stored vote, a bare response, into a ballot
+// with that response as its only choice.
+func boltVoteBallots(tx *bolt.Tx) error {
+	b := tx.Bucket(pollsBucket)
+	return b.ForEach(func(name, _ []byte) error {
+		pb := b.Bucket(name)
+		if pb == nil {
+			return nil
+		}
+		votes := pb.Bucket(votesBucket)
+		ballots := map[string][]byte{}
+		err := votes.ForEach(func(user, response []byte) error {
+			jsonBytes, err := json.Marshal([]string{string(response)})
+			if err != nil {
+				return errors.Wrap(err, "ballot marshal failed")
+			}
+			ballots[string(user)] = jsonBytes
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for user, ballot := range ballots {
+			if err = votes.Put([]byte(user), ballot); err != nil {
+				return errors.Wrap(err, "vote failed")
+			}
+		}
+		return nil
+	})
+}
+
+func boltUint64(n uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, n)
+	return buf
+}
+
+// boltIncr adds delta to the counter stored under key.
+func boltIncr(b *bolt.Bucket, key []byte, delta int) error {
+	var n uint64
+	if val := b.Get(key); val != nil {
+		n = binary.BigEndian.Uint64(val)
+	}
+	n = uint64(int64(n) + int64(delta))
+	return b.Put(key, boltUint64(n))
+}
+
+func (s *BoltStore) Close() error {
+	return s.DB.Close()
+}
+
+func (s *BoltStore) UserByName(name string) (*User, error) {
+	user := &User{}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		if b == nil {
+			return errors.New("no users bucket")
+		}
+		jsonBytes := b.Get([]byte(name))
+		if jsonBytes == nil {
+			return ErrNoSuchUser
+		}
+		if err := json.Unmarshal(jsonBytes, user); err != nil {
+			return errors.Wrap(err, "user unmarshal failed")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *BoltStore) CreateUser(u *User) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return boltCreateUser(tx, u)
+	})
+}
+
+func boltCreateUser(tx *bolt.Tx, u *User) error {
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		return errors.Wrap(err, "user marshal failed")
+	}
+	b := tx.Bucket(usersBucket)
+	if b == nil {
+		return errors.New("no users bucket")
+	}
+	if val := b.Get([]byte(u.Name)); val != nil {
+		return ErrUserExists
+	}
+	if err := b.Put([]byte(u.Name), jsonBytes); err != nil {
+		return errors.Wrap(err, "create failed")
+	}
+	return nil
+}
+
+func (s *BoltStore) UpdateUser(u *User) error {
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		return errors.Wrap(err, "user marshal failed")
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		if b.Get([]byte(u.Name)) == nil {
+			return ErrNoSuchUser
+		}
+		return errors.Wrap(b.Put([]byte(u.Name), jsonBytes), "user update failed")
+	})
+}
+
+func (s *BoltStore) AllUsers() ([]*User, error) {
+	var users []*User
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			user := &User{}
+			if err := json.Unmarshal(v, user); err != nil {
+				return errors.Wrap(err, "user unmarshal failed")
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *BoltStore) CreateFirstAdmin(u *User) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			var user User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return errors.Wrap(err, "user unmarshal failed")
+			}
+			if user.Role == RoleAdmin {
+				return ErrAdminExists
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return boltCreateUser(tx, u)
+	})
+}
+
+// boltGetPoll assembles a poll from its bucket. Who voted for what is only
+// read when withVotes is set, otherwise just the counters are.
+func boltGetPoll(pb *bolt.Bucket, withVotes bool) (*Poll, error) {
+	poll := &Poll{}
+	if err := json.Unmarshal(pb.Get(pollKey), poll); err != nil {
+		return nil, errors.Wrap(err, "poll unmarshal failed")
+	}
+
+	counts := pb.Bucket(countsBucket)
+	for _, option := range poll.Options {
+		if val := counts.Get([]byte(option.Response)); val != nil {
+			option.Count = int(binary.BigEndian.Uint64(val))
+		}
+	}
+
+	if !withVotes {
+		return poll, nil
+	}
+	err := pb.Bucket(votesBucket).ForEach(func(user, ballot []byte) error {
+		var choices []string
+		if err := json.Unmarshal(ballot, &choices); err != nil {
+			return errors.Wrapf(err, "ballot for %s unmarshal failed", user)
+		}
+		if poll.Ballots == nil {
+			poll.Ballots = map[string][]string{}
+		}
+		poll.Ballots[string(user)] = choices
+		for _, response := range poll.counted(choices) {
+			option := poll.option(response)
+			if option == nil {
+				continue
+			}
+			if option.Votes == nil {
+				option.Votes = map[string]bool{}
+			}
+			option.Votes[string(user)] = true
+		}
+		return nil
+	})
+	return poll, err
+}
+
+// boltPutPoll writes out a poll, ballots included, replacing any existing
+// one. Counters are taken from each option's Count.
+func boltPutPoll(b *bolt.Bucket, p *Poll) error {
+	if b.Bucket([]byte(p.Name)) != nil {
+		if err := b.DeleteBucket([]byte(p.Name)); err != nil {
+			return errors.Wrap(err, "poll delete failed")
+		}
+	}
+	pb, err := b.CreateBucket([]byte(p.Name))
+	if err != nil {
+		return errors.Wrap(err, "poll bucket creation failed")
+	}
+	votes, err := pb.CreateBucket(votesBucket)
+	if err != nil {
+		return errors.Wrap(err, "votes bucket creation failed")
+	}
+	counts, err := pb.CreateBucket(countsBucket)
+	if err != nil {
+		return errors.Wrap(err, "counts bucket creation failed")
+	}
+
+	for user, choices := range p.Ballots {
+		jsonBytes, err := json.Marshal(choices)
+		if err != nil {
+			return errors.Wrap(err, "ballot marshal failed")
+		}
+		if err = votes.Put([]byte(user), jsonBytes); err != nil {
+			return errors.Wrap(err, "vote failed")
+		}
+	}
+
+	meta := *p
+	meta.Options, meta.Ballots = nil, nil
+	for _, option := range p.Options {
+		meta.Options = append(meta.Options, &PollOption{Response: option.Response})
+		err = counts.Put([]byte(option.Response), boltUint64(uint64(option.Count)))
+		if err != nil {
+			return errors.Wrap(err, "count failed")
+		}
+	}
+	return boltPutPollMeta(pb, &meta)
+}
+
+func boltPutPollMeta(pb *bolt.Bucket, p *Poll) error {
+	jsonBytes, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "poll marshal failed")
+	}
+	if err = pb.Put(pollKey, jsonBytes); err != nil {
+		return errors.Wrap(err, "poll update failed")
+	}
+	return nil
+}
+
+// pollBucket finds the bucket for the named poll.
+func pollBucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	b := tx.Bucket(pollsBucket)
+	if b == nil {
+		return nil, errors.New("no poll bucket")
+	}
+	pb := b.Bucket([]byte(name))
+	if pb == nil {
+		return nil, ErrNoSuchPoll
+	}
+	return pb, nil
+}
+
+func (s *BoltStore) PollByName(name string) (*Poll, error) {
+	var poll *Poll
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		pb, err := pollBucket(tx, name)
+		if err != nil {
+			return err
+		}
+		poll, err = boltGetPoll(pb, true)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return poll, nil
+}
+
+func (s *BoltStore) AllPolls() (map[string]Poll, error) {
+	polls := map[string]Poll{}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pollsBucket)
+		if b == nil {
+			return errors.New("no poll bucket")
+		}
+		// iterate over all polls, reading counts but not votes
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			pb := b.Bucket(k)
+			if pb == nil {
+				continue
+			}
+			poll, err := boltGetPoll(pb, false)
+			if err != nil {
+				return err
+			}
+			polls[string(k)] = *poll
+		}
+		return nil
+	})
+	return polls, err
+}
+
+// ListPolls walks the polls bucket from the cursor when listing by name, so
+// only as many polls are read as it takes to fill the page. Other orders need
+// every poll.
+func (s *BoltStore) ListPolls(q *PollQuery) (*PollPage, error) {
+	if q.Sort != SortName {
+		polls, err := s.AllPolls()
+		if err != nil {
+			return nil, err
+		}
+		return q.Page(polls), nil
+	}
+
+	page := &PollPage{}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pollsBucket)
+		if b == nil {
+			return errors.New("no poll bucket")
+		}
+		c := b.Cursor()
+		k, _ := c.First()
+		if q.After != "" {
+			k, _ = c.Seek([]byte(q.afterName))
+			if k != nil && string(k) == q.afterName {
+				k, _ = c.Next()
+			}
+		}
+		for ; k != nil; k, _ = c.Next() {
+			pb := b.Bucket(k)
+			if pb == nil {
+				continue
+			}
+			poll, err := boltGetPoll(pb, false)
+			if err != nil {
+				return err
+			}
+			if !q.Match(poll) {
+				continue
+			}
+			if len(page.Polls) == q.Limit {
+				page.Next = q.cursor(&page.Polls[q.Limit-1])
+				break
+			}
+			page.Polls = append(page.Polls, *poll)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (s *BoltStore) CreatePoll(p *Poll) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pollsBucket)
+		if b == nil {
+			return errors.New("no poll bucket")
+		}
+		if b.Bucket([]byte(p.Name)) != nil {
+			return ErrPollExists
+		}
+		return boltPutPoll(b, p)
+	})
+}
+
+func (s *BoltStore) UpdatePoll(p *Poll) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		pb, err := pollBucket(tx, p.Name)
+		if err != nil {
+			return err
+		}
+		old, err := boltGetPoll(pb, true)
+		if err != nil {
+			return err
+		}
+		if err = p.CheckEdit(old, len(old.Ballots) > 0); err != nil {
+			return err
+		}
+		updated := *p
+		updated.Options, updated.Ballots = old.Options, old.Ballots
+		updated.SetOptions(p.Options)
+		// ballots lose choices for dropped responses, so count them again
+		updated.Recount()
+		return boltPutPoll(tx.Bucket(pollsBucket), &updated)
+	})
+}
+
+func (s *BoltStore) DeletePoll(name string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pollsBucket)
+		if b == nil {
+			return errors.New("no poll bucket")
+		}
+		err := b.DeleteBucket([]byte(name))
+		if err == bolt.ErrBucketNotFound {
+			return ErrNoSuchPoll
+		}
+		return errors.Wrap(err, "poll delete failed")
+	})
+}
+
+func (s *BoltStore) AddOption(pollName string, o *PollOption) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		pb, err := pollBucket(tx, pollName)
+		if err != nil {
+			return err
+		}
+		poll := &Poll{}
+		if err = json.Unmarshal(pb.Get(pollKey), poll); err != nil {
+			return errors.Wrap(err, "poll unmarshal failed")
+		}
+		if err = poll.CheckOpen(time.Now()); err != nil {
+			return err
+		}
+		for _, option := range poll.Options {
+			if option.Response == o.Response {
+				return nil
+			}
+		}
+		poll.Options = append(poll.Options, &PollOption{Response: o.Response})
+		err = pb.Bucket(countsBucket).Put([]byte(o.Response), boltUint64(0))
+		if err != nil {
+			return errors.Wrap(err, "count failed")
+		}
+		return boltPutPollMeta(pb, poll)
+	})
+}
+
+func (s *BoltStore) Vote(pollName, userName string, choices []string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		pb, err := pollBucket(tx, pollName)
+		if err != nil {
+			return err
+		}
+		poll := &Poll{}
+		if err = json.Unmarshal(pb.Get(pollKey), poll); err != nil {
+			return errors.Wrap(err, "poll unmarshal failed")
+		}
+		if err = poll.CheckOpen(time.Now()); err != nil {
+			return err
+		}
+		if err = poll.CheckBallot(choices); err != nil {
+			return err
+		}
+
+		votes, counts := pb.Bucket(votesBucket), pb.Bucket(countsBucket)
+		user := []byte(poll.VoterKey(userName))
+
+		if val := votes.Get(user); val != nil {
+			var old []string
+			if err = json.Unmarshal(val, &old); err != nil {
+				return errors.Wrap(err, "ballot unmarshal failed")
+			}
+			for _, response := range poll.counted(old) {
+				if counts.Get([]byte(response)) == nil {
+					continue
+				}
+				if err = boltIncr(counts, []byte(response), -1); err != nil {
+					return errors.Wrap(err, "count failed")
+				}
+			}
+		}
+
+		jsonBytes, err := json.Marshal(choices)
+		if err != nil {
+			return errors.Wrap(err, "ballot marshal failed")
+		}
+		if err = votes.Put(user, jsonBytes); err != nil {
+			return errors.Wrap(err, "vote failed")
+		}
+		for _, response := range poll.counted(choices) {
+			if err = boltIncr(counts, []byte(response), 1); err != nil {
+				return errors.Wrap(err, "count failed")
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) CreateRefreshToken(t *RefreshToken) error {
+	jsonBytes, err := json.Marshal(t)
+	if err != nil {
+		return errors.Wrap(err, "refresh token marshal failed")
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(refreshBucket).Put([]byte(t.ID), jsonBytes)
+		return errors.Wrap(err, "refresh token create failed")
+	})
+}
+
+func (s *BoltStore) UseRefreshToken(id string, now time.Time) (*RefreshToken, error) {
+	t := &RefreshToken{}
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(refreshBucket)
+		val := b.Get([]byte(id))
+		if val == nil {
+			return ErrNoSuchToken
+		}
+		if err := json.Unmarshal(val, t); err != nil {
+			return errors.Wrap(err, "refresh token unmarshal failed")
+		}
+		if t.UsedAt != nil {
+			return nil
+		}
+		used := *t
+		used.UsedAt = &now
+		jsonBytes, err := json.Marshal(&used)
+		if err != nil {
+			return errors.Wrap(err, "refresh token marshal failed")
+		}
+		return errors.Wrap(b.Put([]byte(id), jsonBytes), "refresh token update failed")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// boltDeleteRefreshTokens deletes the refresh tokens del picks out.
+func boltDeleteRefreshTokens(tx *bolt.Tx, del func(t *RefreshToken) bool) (int, error) {
+	b := tx.Bucket(refreshBucket)
+	var doomed [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		t := &RefreshToken{}
+		if err := json.Unmarshal(v, t); err != nil {
+			return errors.Wrap(err, "refresh token unmarshal failed")
+		}
+		if del(t) {
+			doomed = append(doomed, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range doomed {
+		if err = b.Delete(k); err != nil {
+			return 0, errors.Wrap(err, "refresh token delete failed")
+		}
+	}
+	return len(doomed), nil
+}
+
+func (s *BoltStore) DeleteSession(session string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, err := boltDeleteRefreshTokens(tx, func(t *RefreshToken) bool {
+			return t.Session == session
+		})
+		return err
+	})
+}
+
+func (s *BoltStore) RevokeToken(id string, expiresAt time.Time) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(revokedBucket).Put([]byte(id), boltUint64(uint64(expiresAt.Unix())))
+		return errors.Wrap(err, "token revoke failed")
+	})
+}
+
+func (s *BoltStore) TokenRevoked(id string) (bool, error) {
+	var revoked bool
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		revoked = tx.Bucket(revokedBucket).Get([]byte(id)) != nil
+		return nil
+	})
+	return revoked, err
+}
+
+func (s *BoltStore) RevokeUserTokens(userName string, now, expiresAt time.Time) error {
+	jsonBytes, err := json.Marshal(&userRevocation{At: now, ExpiresAt: expiresAt})
+	if err != nil {
+		return errors.Wrap(err, "user revocation marshal failed")
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, err := boltDeleteRefreshTokens(tx, func(t *RefreshToken) bool {
+			return t.User == userName
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(revokedUsersBucket).Put([]byte(userName), jsonBytes)
+		return errors.Wrap(err, "user revocation failed")
+	})
+}
+
+func (s *BoltStore) UserTokensRevokedAt(userName string) (time.Time, error) {
+	var rev userRevocation
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(revokedUsersBucket).Get([]byte(userName))
+		if val == nil {
+			return nil
+		}
+		return errors.Wrap(json.Unmarshal(val, &rev), "user revocation unmarshal failed")
+	})
+	return rev.At, err
+}
+
+func (s *BoltStore) DeleteExpiredTokens(now time.Time) (int, error) {
+	var deleted int
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		n, err := boltDeleteRefreshTokens(tx, func(t *RefreshToken) bool {
+			return now.After(t.ExpiresAt)
+		})
+		if err != nil {
+			return err
+		}
+		deleted += n
+
+		var doomed [][]byte
+		revoked := tx.Bucket(revokedBucket)
+		revoked.ForEach(func(k, v []byte) error {
+			if int64(binary.BigEndian.Uint64(v)) < now.Unix() {
+				doomed = append(doomed, k)
+			}
+			return nil
+		})
+		for _, k := range doomed {
+			if err = revoked.Delete(k); err != nil {
+				return errors.Wrap(err, "revocation delete failed")
+			}
+		}
+		deleted += len(doomed)
+
+		doomed = nil
+		users := tx.Bucket(revokedUsersBucket)
+		err = users.ForEach(func(k, v []byte) error {
+			var rev userRevocation
+			if err := json.Unmarshal(v, &rev); err != nil {
+				return errors.Wrap(err, "user revocation unmarshal failed")
+			}
+			if now.After(rev.ExpiresAt) {
+				doomed = append(doomed, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range doomed {
+			if err = users.Delete(k); err != nil {
+				return errors.Wrap(err, "user revocation delete failed")
+			}
+		}
+		deleted += len(doomed)
+
+		n, err = boltDeleteResets(tx, func(reset *PasswordReset) bool {
+			return now.After(reset.ExpiresAt)
+		})
+		deleted += n
+		return err
+	})
+	return deleted, err
+}
+
+func (s *BoltStore) CreateInvitation(inv *Invitation) error {
+	jsonBytes, err := json.Marshal(inv)
+	if err != nil {
+		return errors.Wrap(err, "invitation marshal failed")
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(invitationsBucket).Put([]byte(inv.ID), jsonBytes)
+		return errors.Wrap(err, "invitation create failed")
+	})
+}
+
+func (s *BoltStore) Invitations() ([]*Invitation, error) {
+	var invitations []*Invitation
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(invitationsBucket).ForEach(func(k, v []byte) error {
+			inv := &Invitation{}
+			if err := json.Unmarshal(v, inv); err != nil {
+				return errors.Wrap(err, "invitation unmarshal failed")
+			}
+			invitations = append(invitations, inv)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+func (s *BoltStore) DeleteInvitation(id string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(invitationsBucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrNoSuchInvitation
+		}
+		return errors.Wrap(b.Delete([]byte(id)), "invitation delete failed")
+	})
+}
+
+func (s *BoltStore) CreateInvitedUser(u *User, invitationID string, now time.Time) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(invitationsBucket)
+		val := b.Get([]byte(invitationID))
+		if val == nil {
+			return ErrNoSuchInvitation
+		}
+		inv := &Invitation{}
+		if err := json.Unmarshal(val, inv); err != nil {
+			return errors.Wrap(err, "invitation unmarshal failed")
+		}
+		if !inv.Admits(u.Name, now) {
+			return ErrNoSuchInvitation
+		}
+		if err := boltCreateUser(tx, u); err != nil {
+			return err
+		}
+		return errors.Wrap(b.Delete([]byte(invitationID)), "invitation delete failed")
+	})
+}
+
+// boltDeleteResets deletes the password resets doomed picks, and returns
+// how many there were.
+func boltDeleteResets(tx *bolt.Tx, doomed func(*PasswordReset) bool) (int, error) {
+	b := tx.Bucket(resetsBucket)
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		reset := &PasswordReset{}
+		if err := json.Unmarshal(v, reset); err != nil {
+			return errors.Wrap(err, "password reset unmarshal failed")
+		}
+		if doomed(reset) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		if err = b.Delete(k); err != nil {
+			return 0, errors.Wrap(err, "password reset delete failed")
+		}
+	}
+	return len(keys), nil
+}
+
+func (s *BoltStore) CreatePasswordReset(reset *PasswordReset) error {
+	jsonBytes, err := json.Marshal(reset)
+	if err != nil {
+		return errors.Wrap(err, "password reset marshal failed")
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(resetsBucket).Put([]byte(reset.ID), jsonBytes)
+		return errors.Wrap(err, "password reset create failed")
+	})
+}
+
+func (s *BoltStore) ResetPassword(resetID, userName, pass string, now time.Time) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		val := tx.Bucket(resetsBucket).Get([]byte(resetID))
+		if val == nil {
+			return ErrNoSuchReset
+		}
+		reset := &PasswordReset{}
+		if err := json.Unmarshal(val, reset); err != nil {
+			return errors.Wrap(err, "password reset unmarshal failed")
+		}
+		if !reset.Admits(userName, now) {
+			return ErrNoSuchReset
+		}
+
+		users := tx.Bucket(usersBucket)
+		val = users.Get([]byte(userName))
+		if val == nil {
+			return ErrNoSuchUser
+		}
+		user := &User{}
+		if err := json.Unmarshal(val, user); err != nil {
+			return errors.Wrap(err, "user unmarshal failed")
+		}
+		user.Pass = pass
+		jsonBytes, err := json.Marshal(user)
+		if err != nil {
+			return errors.Wrap(err, "user marshal failed")
+		}
+		if err = users.Put([]byte(userName), jsonBytes); err != nil {
+			return errors.Wrap(err, "user update failed")
+		}
+
+		_, err = boltDeleteResets(tx, func(other *PasswordReset) bool {
+			return other.User == userName
+		})
+		return err
+	})
+}
+
+func (s *BoltStore) MFAByUser(userName string) (*MFA, error) {
+	m := &MFA{}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(mfaBucket).Get([]byte(userName))
+		if val == nil {
+			return ErrNoSuchMFA
+		}
+		return errors.Wrap(json.Unmarshal(val, m), "mfa unmarshal failed")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *BoltStore) SaveMFA(m *MFA) error {
+	jsonBytes, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "mfa marshal failed")
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(mfaBucket).Put([]byte(m.User), jsonBytes)
+		return errors.Wrap(err, "mfa save failed")
+	})
+}
+
+func (s *BoltStore) DeleteMFA(userName string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mfaBucket)
+		if b.Get([]byte(userName)) == nil {
+			return ErrNoSuchMFA
+		}
+		return errors.Wrap(b.Delete([]byte(userName)), "mfa delete failed")
+	})
+}
+
+func (s *BoltStore) UseMFA(userName, code, tokenID string, now, expiresAt time.Time) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		revoked := tx.Bucket(revokedBucket)
+		if revoked.Get([]byte(tokenID)) != nil {
+			return ErrTokenRevoked
+		}
+		b := tx.Bucket(mfaBucket)
+		if val := b.Get([]byte(userName)); val != nil {
+			m := &MFA{}
+			if err := json.Unmarshal(val, m); err != nil {
+				return errors.Wrap(err, "mfa unmarshal failed")
+			}
+			if m.Enabled {
+				if !m.Use(code, now) {
+					return ErrWrongCode
+				}
+				jsonBytes, err := json.Marshal(m)
+				if err != nil {
+					return errors.Wrap(err, "mfa marshal failed")
+				}
+				if err = b.Put([]byte(userName), jsonBytes); err != nil {
+					return errors.Wrap(err, "mfa save failed")
+				}
+			}
+		}
+		err := revoked.Put([]byte(tokenID), boltUint64(uint64(expiresAt.Unix())))
+		return errors.Wrap(err, "token revoke failed")
+	})
 }
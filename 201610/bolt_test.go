@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// A poll from before votes had a bucket of their own, with a vote taken
+// back and a voter listed under two responses.
+func TestBoltNormalizeVotes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bolt.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(pollsBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("beer"), []byte(`{"Name": "beer", "Question": "Best?", "Options": [
+			{"Response": "ipa", "Count": 2, "Votes": {"alice": true, "bob": false}},
+			{"Response": "stout", "Count": 2, "Votes": {"alice": true, "carol": true}},
+			{"Response": "lager", "Count": 1, "Votes": {"dave": false}}]}`))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := BoltOpen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	poll, err := s.PollByName("beer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantBallots := map[string][]string{"alice": {"ipa"}, "carol": {"stout"}}
+	if !reflect.DeepEqual(poll.Ballots, wantBallots) {
+		t.Errorf("ballots %v, want %v", poll.Ballots, wantBallots)
+	}
+	counts := map[string]int{}
+	for _, option := range poll.Options {
+		counts[option.Response] = option.Count
+	}
+	wantCounts := map[string]int{"ipa": 1, "stout": 1, "lager": 0}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("counts %v, want %v", counts, wantCounts)
+	}
+}
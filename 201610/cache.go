@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CachedStore answers first pages from ListPolls with summaries of every
+// poll: what's needed to filter, sort and show them, but no ballots or voter
+// lists. The whole set is reloaded at most once per ttl, which is what picks
+// up changes made by other processes sharing the database. Writes through
+// this store mark just the poll they touched, which is reloaded by itself on
+// the next read. Later pages go to the store, which may be able to seek to
+// the cursor instead of loading everything.
+type CachedStore struct {
+	Store
+	ttl time.Duration
+
+	mu        sync.Mutex
+	summaries map[string]Poll
+	loadedAt  time.Time
+	// loading is closed when the reload in progress is done
+	loading chan struct{}
+	// dirty polls, with the write count as of each one's last write
+	dirty  map[string]uint64
+	writes uint64
+	stats  CacheStats
+}
+
+// CacheStats counts how listings were answered. A hit touched the store
+// not at all, a refresh reloaded only polls that had been written to, and
+// a miss reloaded everything. Passes were later pages, left to the store.
+type CacheStats struct {
+	Polls     int
+	Hits      int64
+	Refreshes int64
+	Misses    int64
+	Passes    int64
+	// HitRate is the share of listings that were hits.
+	HitRate float64
+}
+
+func NewCachedStore(store Store, ttl time.Duration) *CachedStore {
+	return &CachedStore{
+		Store: store,
+		ttl:   ttl,
+		dirty: map[string]uint64{},
+	}
+}
+
+// Summary is p without anything that grows with the number of voters.
+func (p *Poll) Summary() Poll {
+	summary := *p
+	summary.Ballots = nil
+	summary.Options = make([]*PollOption, len(p.Options))
+	for i, option := range p.Options {
+		summary.Options[i] = &PollOption{Response: option.Response, Count: option.Count}
+	}
+	return summary
+}
+
+func (s *CachedStore) ListPolls(q *PollQuery) (*PollPage, error) {
+	if q.After != "" {
+		s.mu.Lock()
+		s.stats.Passes++
+		s.mu.Unlock()
+		return s.Store.ListPolls(q)
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	page := q.Page(s.summaries)
+	// callers redact what they're given, which mustn't touch the cache
+	for i := range page.Polls {
+		page.Polls[i] = page.Polls[i].Summary()
+	}
+	return page, nil
+}
+
+// load brings the summaries up to date. The store is read without holding
+// the lock, so writes and hits aren't held up behind a reload, but only one
+// full reload runs at a time.
+func (s *CachedStore) load() error {
+	s.mu.Lock()
+	for s.loading != nil {
+		loading := s.loading
+		s.mu.Unlock()
+		<-loading
+		s.mu.Lock()
+	}
+
+	switch {
+	case s.summaries == nil || time.Since(s.loadedAt) >= s.ttl:
+		s.stats.Misses++
+		s.loading = make(chan struct{})
+		writes := s.writes
+		s.mu.Unlock()
+
+		polls, err := s.Store.AllPolls()
+		summaries := make(map[string]Poll, len(polls))
+		for name, poll := range polls {
+			summaries[name] = poll.Summary()
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		close(s.loading)
+		s.loading = nil
+		if err != nil {
+			return err
+		}
+		s.summaries = summaries
+		s.loadedAt = time.Now()
+		// polls written to during the reload may have been read before
+		for name, n := range s.dirty {
+			if n <= writes {
+				delete(s.dirty, name)
+			}
+		}
+		return nil
+
+	case len(s.dirty) > 0:
+		s.stats.Refreshes++
+		dirty := make(map[string]uint64, len(s.dirty))
+		for name, n := range s.dirty {
+			dirty[name] = n
+		}
+		s.mu.Unlock()
+
+		fresh := map[string]*Poll{}
+		for name := range dirty {
+			poll, err := s.Store.PollByName(name)
+			if err != nil && errors.Cause(err) != ErrNoSuchPoll {
+				return err
+			}
+			fresh[name] = poll
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for name, poll := range fresh {
+			// written to again since, so this may be out of date
+			if s.dirty[name] != dirty[name] {
+				continue
+			}
+			if poll == nil {
+				delete(s.summaries, name)
+			} else {
+				s.summaries[name] = poll.Summary()
+			}
+			delete(s.dirty, name)
+		}
+		return nil
+	}
+
+	s.stats.Hits++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *CachedStore) changed(pollName string) {
+	s.mu.Lock()
+	s.writes++
+	s.dirty[pollName] = s.writes
+	s.mu.Unlock()
+}
+
+func (s *CachedStore) CreatePoll(p *Poll) error {
+	defer s.changed(p.Name)
+	return s.Store.CreatePoll(p)
+}
+
+func (s *CachedStore) UpdatePoll(p *Poll) error {
+	defer s.changed(p.Name)
+	return s.Store.UpdatePoll(p)
+}
+
+func (s *CachedStore) DeletePoll(name string) error {
+	defer s.changed(name)
+	return s.Store.DeletePoll(name)
+}
+
+func (s *CachedStore) AddOption(pollName string, o *PollOption) error {
+	defer s.changed(pollName)
+	return s.Store.AddOption(pollName, o)
+}
+
+func (s *CachedStore) Vote(pollName, userName string, choices []string) error {
+	defer s.changed(pollName)
+	return s.Store.Vote(pollName, userName, choices)
+}
+
+func (s *CachedStore) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Polls = len(s.summaries)
+	if total := stats.Hits + stats.Refreshes + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// CacheStatsGet reports how well the poll summary cache is doing.
+func CacheStatsGet(w http.ResponseWriter, r *http.Request) {
+	cached, ok := env.Store.(*CachedStore)
+	if !ok {
+		e := &Error{Code: http.StatusNotFound, Message: errors.New("poll summaries aren't being cached")}
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, cached.Stats())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedStorePaging(t *testing.T) {
+	testPaging(t, NewCachedStore(NewMemStore(), time.Hour))
+}
+
+// slowStore counts listings, and holds up AllPolls after reading, until
+// it's let go.
+type slowStore struct {
+	Store
+	lists   int
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) ListPolls(q *PollQuery) (*PollPage, error) {
+	s.lists++
+	return s.Store.ListPolls(q)
+}
+
+func (s *slowStore) AllPolls() (map[string]Poll, error) {
+	polls, err := s.Store.AllPolls()
+	if s.read != nil {
+		s.read <- struct{}{}
+		<-s.release
+	}
+	return polls, err
+}
+
+func TestCachedStorePassesPagesThrough(t *testing.T) {
+	backing := &slowStore{Store: NewMemStore()}
+	s := NewCachedStore(backing, time.Hour)
+	for _, p := range listingPolls(time.Now()) {
+		if err := s.CreatePoll(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := pageAll(t, s, PollQuery{Sort: SortName, Limit: 3})
+	if len(names) != 7 {
+		t.Errorf("listed %v", names)
+	}
+	// the first page came from the cache, the other two from the store
+	stats := s.Stats()
+	if backing.lists != 2 || stats.Misses != 1 || stats.Passes != 2 {
+		t.Errorf("store listed %d times, stats %+v", backing.lists, stats)
+	}
+}
+
+func TestCachedStoreReloadsUnlocked(t *testing.T) {
+	backing := &slowStore{Store: NewMemStore(), read: make(chan struct{}), release: make(chan struct{})}
+	s := NewCachedStore(backing, time.Hour)
+	if err := backing.CreatePoll(&Poll{Name: "beer", Question: "Best?", Options: []*PollOption{{Response: "ipa"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := make(chan error)
+	go func() {
+		_, err := s.ListPolls(&PollQuery{Sort: SortName, Limit: 10})
+		listed <- err
+	}()
+	<-backing.read
+
+	// neither of these wait for the reload
+	if err := s.Vote("beer", "alice", []string{"ipa"}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Misses != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	close(backing.release)
+	if err := <-listed; err != nil {
+		t.Fatal(err)
+	}
+	backing.read = nil
+
+	// the vote came after the reload read the poll, so it's still dirty
+	page, err := s.ListPolls(&PollQuery{Sort: SortName, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Polls) != 1 || page.Polls[0].Options[0].Count != 1 {
+		t.Errorf("listed %+v", page.Polls)
+	}
+	if stats := s.Stats(); stats.Refreshes != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+var configFile = flag.String("config", "", "file of settings keyed by flag name, in JSON, YAML or TOML going by its extension (.json, .yaml or .yml, .toml), like port: 8080")
+
+// envPrefix starts the environment variables that set flags: DENGO_PORT
+// is -port.
+const envPrefix = "DENGO_"
+
+// fileSuffix on a setting's name reads its value from the file named, so
+// secrets needn't show up in ps or the environment: DENGO_SECRET_FILE, or
+// "secret_file" in the config file.
+const fileSuffix = "_file"
+
+// LoadConfig fills in the flags that weren't given on the command line,
+// from DENGO_* environment variables, then from the config file, so flags
+// beat the environment, which beats the file, which beats the defaults.
+// Call it after flag.Parse. Settings that aren't flags are errors, since
+// they're likely typos.
+func LoadConfig() error {
+	return loadConfig(flag.CommandLine)
+}
+
+func loadConfig(flags *flag.FlagSet) error {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	fromEnv, err := envSettings(flags)
+	if err != nil {
+		return err
+	}
+	var path string
+	if f := flags.Lookup("config"); f != nil {
+		path = f.Value.String()
+	}
+	if path == "" {
+		path = fromEnv["config"]
+	}
+	var fromFile map[string]string
+	if path != "" {
+		if fromFile, err = fileSettings(flags, path); err != nil {
+			return err
+		}
+	}
+
+	for _, layer := range []struct {
+		from     string
+		settings map[string]string
+	}{{"environment", fromEnv}, {path, fromFile}} {
+		for _, name := range sortedNames(layer.settings) {
+			if set[name] {
+				continue
+			}
+			if err := flags.Set(name, layer.settings[name]); err != nil {
+				return errors.Wrapf(err, "%s: bad %s", layer.from, name)
+			}
+			set[name] = true
+		}
+	}
+	return nil
+}
+
+// envSettings are the DENGO_* environment variables, by flag name.
+func envSettings(flags *flag.FlagSet) (map[string]string, error) {
+	raw := map[string]string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		raw[strings.ToLower(kv[len(envPrefix):i])] = kv[i+1:]
+	}
+	settings, err := resolveSettings(flags, raw)
+	return settings, errors.Wrap(err, "environment")
+}
+
+// configDecoders read config files into values by name, going by the
+// file's extension.
+var configDecoders = map[string]func([]byte, *map[string]interface{}) error{
+	".json": func(data []byte, values *map[string]interface{}) error {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		return dec.Decode(values)
+	},
+	".yaml": func(data []byte, values *map[string]interface{}) error {
+		return yaml.Unmarshal(data, values)
+	},
+	".yml": func(data []byte, values *map[string]interface{}) error {
+		return yaml.Unmarshal(data, values)
+	},
+	".toml": func(data []byte, values *map[string]interface{}) error {
+		_, err := toml.Decode(string(data), values)
+		return err
+	},
+}
+
+// fileSettings are the settings in a config file, by flag name. Values may
+// be strings, numbers or booleans.
+func fileSettings(flags *flag.FlagSet, path string) (map[string]string, error) {
+	decode, ok := configDecoders[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return nil, errors.Errorf("%s: config files should end in .json, .yaml, .yml or .toml", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "config read failed")
+	}
+	var values map[string]interface{}
+	if err = decode(data, &values); err != nil {
+		return nil, errors.Wrapf(err, "%s: config decode failed", path)
+	}
+
+	raw := map[string]string{}
+	for name, v := range values {
+		switch v := v.(type) {
+		case string:
+			raw[name] = v
+		case json.Number:
+			raw[name] = v.String()
+		case int:
+			raw[name] = strconv.Itoa(v)
+		case int64:
+			raw[name] = strconv.FormatInt(v, 10)
+		case float64:
+			raw[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			raw[name] = strconv.FormatBool(v)
+		default:
+			return nil, errors.Errorf("%s: %s should be a string, number or boolean", path, name)
+		}
+	}
+	if _, ok := raw["config"]; ok {
+		return nil, errors.Errorf("%s: config files can't name another", path)
+	}
+	settings, err := resolveSettings(flags, raw)
+	return settings, errors.Wrap(err, path)
+}
+
+// resolveSettings reads the values of _file settings, and checks every
+// name is one of the flags.
+func resolveSettings(flags *flag.FlagSet, raw map[string]string) (map[string]string, error) {
+	settings := map[string]string{}
+	for _, name := range sortedNames(raw) {
+		value := raw[name]
+		if strings.HasSuffix(name, fileSuffix) {
+			name = strings.TrimSuffix(name, fileSuffix)
+			if _, ok := raw[name]; ok {
+				return nil, errors.Errorf("%s and %s%s are both set", name, name, fileSuffix)
+			}
+			data, err := ioutil.ReadFile(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s%s read failed", name, fileSuffix)
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		}
+		if flags.Lookup(name) == nil {
+			return nil, errors.Errorf("no such setting: %s", name)
+		}
+		settings[name] = value
+	}
+	return settings, nil
+}
+
+func sortedNames(settings map[string]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckConfig catches settings that can't work, all of them at once, so
+// nothing starts half configured.
+func CheckConfig() error {
+	var problems []string
+	for _, check := range []func() error{CheckCookieFlags, CheckServerFlags, checkTunables} {
+		if err := check(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("bad config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkTunables catches limits that are out of range.
+func checkTunables() error {
+	var problems []string
+	if *bcryptCost < 10 || *bcryptCost > bcrypt.MaxCost {
+		problems = append(problems, "-bcryptcost should be 10 to 31")
+	}
+	for _, max := range []struct {
+		name  string
+		value int64
+	}{
+		{"signuppostmax", *signupPostMax},
+		{"loginpostmax", *loginPostMax},
+		{"userchangepostmax", *userChangePostMax},
+		{"invitationpostmax", *invitationPostMax},
+		{"mfapostmax", *mfaPostMax},
+		{"passwordpostmax", *passwordPostMax},
+		{"pollpostmax", *pollPostMax},
+	} {
+		if max.value < 256 {
+			problems = append(problems, "-"+max.name+" should be at least 256")
+		}
+	}
+	if *accessLifetime <= 0 || *accessLifetime >= *refreshLifetime {
+		problems = append(problems, "-accesslifetime should be more than 0 and less than -refreshlifetime")
+	}
+	if *requestTimeout <= 0 {
+		problems = append(problems, "-requesttimeout should be more than 0")
+	}
+	if *tokenCleanup <= 0 {
+		problems = append(problems, "-tokencleanup should be more than 0")
+	}
+	if *passwordMin < 1 {
+		problems = append(problems, "-passwordmin should be at least 1")
+	}
+	if *shutdownDelay < 0 || *shutdownTimeout < 0 {
+		problems = append(problems, "-shutdowndelay and -shutdowntimeout can't be negative")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileSettings(t *testing.T) {
+	want := map[string]string{
+		"port":         "8081",
+		"summaryttl":   "2s",
+		"cookiesecure": "true",
+		"dbpath":       "/var/lib/dengo/bolt.db",
+	}
+	for name, content := range map[string]string{
+		"dengo.json": `{"port": 8081, "summaryttl": "2s", "cookiesecure": true, "dbpath": "/var/lib/dengo/bolt.db"}`,
+		"dengo.yaml": "port: 8081\nsummaryttl: 2s\ncookiesecure: true\ndbpath: /var/lib/dengo/bolt.db\n",
+		"dengo.yml":  "# same again\nport: 8081\nsummaryttl: \"2s\"\ncookiesecure: yes\ndbpath: '/var/lib/dengo/bolt.db'\n",
+		"dengo.toml": "port = 8081\nsummaryttl = \"2s\"\ncookiesecure = true\ndbpath = \"/var/lib/dengo/bolt.db\"\n",
+		"DENGO.JSON": `{"port": "8081", "summaryttl": "2s", "cookiesecure": "true", "dbpath": "/var/lib/dengo/bolt.db"}`,
+	} {
+		got, err := fileSettings(flag.CommandLine, writeFile(t, name, content))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestFileSettingsErrors(t *testing.T) {
+	secret := writeFile(t, "secret", "s\n")
+	for _, tt := range []struct {
+		name, content, err string
+	}{
+		{"dengo.ini", "port=8081", "should end in"},
+		{"dengo.conf", `{"port": 8081}`, "should end in"},
+		{"dengo.json", `{"port": 8081,}`, "decode failed"},
+		{"dengo.yaml", "port: [8081", "decode failed"},
+		{"dengo.toml", "port = ", "decode failed"},
+		{"dengo.yaml", "server:\n  port: 8081\n", "should be a string, number or boolean"},
+		{"dengo.toml", "[server]\nport = 8081\n", "should be a string, number or boolean"},
+		{"dengo.yaml", "prot: 8081\n", "no such setting: prot"},
+		{"dengo.yaml", "config: other.yaml\n", "can't name another"},
+		{"dengo.yaml", "secret: s\nsecret_file: " + secret + "\n", "both set"},
+		{"dengo.toml", "secret_file = \"/nonexistent\"\n", "secret_file read failed"},
+	} {
+		_, err := fileSettings(flag.CommandLine, writeFile(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: got %v, want %q", tt.name, tt.content, err, tt.err)
+		}
+	}
+}
+
+// Flags beat the environment, which beats the config file, which beats
+// the defaults.
+func TestLoadConfig(t *testing.T) {
+	flags := flag.NewFlagSet("dengo", flag.ContinueOnError)
+	config := flags.String("config", "", "")
+	port := flags.Int("port", 8080, "")
+	failures := flags.Int("loginfailures", 5, "")
+	ttl := flags.Duration("summaryttl", time.Second, "")
+	passMin := flags.Int("passwordmin", 8, "")
+	secret := flags.String("secret", "", "")
+	timeout := flags.Duration("requesttimeout", 10*time.Second, "")
+
+	secretFile := writeFile(t, "secret", "from the secret file\n")
+	configFile := writeFile(t, "dengo.yaml", strings.Join([]string{
+		"port: 8083",
+		"loginfailures: 7",
+		"passwordmin: 12",
+		"secret_file: " + secretFile,
+	}, "\n"))
+	t.Setenv("DENGO_CONFIG", configFile)
+	t.Setenv("DENGO_PORT", "8082")
+	t.Setenv("DENGO_LOGINFAILURES", "6")
+	t.Setenv("DENGO_SUMMARYTTL", "3s")
+	if err := flags.Parse([]string{"-port", "8081"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadConfig(flags); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"config, from the environment", *config, configFile},
+		{"port, from the flag", *port, 8081},
+		{"loginfailures, from the environment", *failures, 6},
+		{"summaryttl, from the environment", *ttl, 3 * time.Second},
+		{"passwordmin, from the file", *passMin, 12},
+		{"secret, from secret_file", *secret, "from the secret file"},
+		{"requesttimeout, from the default", *timeout, 10 * time.Second},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestEnvSettings(t *testing.T) {
+	t.Setenv("DENGO_DSN_FILE", writeFile(t, "dsn", "postgres://dengo:hunter2@db/dengo\r\n"))
+	t.Setenv("DENGO_COOKIEPATH", "/dengo")
+	got, err := envSettings(flag.CommandLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"dsn": "postgres://dengo:hunter2@db/dengo", "cookiepath": "/dengo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	t.Setenv("DENGO_COKIEPATH", "/dengo")
+	if _, err = envSettings(flag.CommandLine); err == nil || !strings.Contains(err.Error(), "no such setting: cokiepath") {
+		t.Errorf("got %v, want a typo caught", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var cookieSecure = flag.Bool("cookiesecure", false, "only send cookies over https; turn on when serving https")
+var cookieSameSite = sameSiteFlag("cookiesamesite", http.SameSiteLaxMode, "SameSite for cookies: lax, strict or none (none needs -cookiesecure)")
+var cookieDomain = flag.String("cookiedomain", "", "Domain for cookies, empty for the host that set them")
+var cookiePath = flag.String("cookiepath", "/", "Path for cookies")
+
+// SameSite is http.SameSite as a flag.
+type SameSite http.SameSite
+
+var sameSiteNames = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func (s *SameSite) String() string {
+	for name, mode := range sameSiteNames {
+		if http.SameSite(*s) == mode {
+			return name
+		}
+	}
+	return ""
+}
+
+func (s *SameSite) Set(name string) error {
+	mode, ok := sameSiteNames[strings.ToLower(name)]
+	if !ok {
+		return errors.Errorf("SameSite %q should be lax, strict or none", name)
+	}
+	*s = SameSite(mode)
+	return nil
+}
+
+// sameSiteFlag is flag.String, for SameSites.
+func sameSiteFlag(name string, value http.SameSite, usage string) *SameSite {
+	s := SameSite(value)
+	flag.Var(&s, name, usage)
+	return &s
+}
+
+// CheckCookieFlags catches cookie settings browsers would refuse.
+func CheckCookieFlags() error {
+	if http.SameSite(*cookieSameSite) == http.SameSiteNoneMode && !*cookieSecure {
+		return errors.New("-cookiesamesite none needs -cookiesecure")
+	}
+	if !strings.HasPrefix(*cookiePath, "/") {
+		return errors.Errorf("-cookiepath %q should start with /", *cookiePath)
+	}
+	return nil
+}
+
+// newCookie is a cookie with the -cookie flags applied. None of ours are
+// for scripts, so they're all HttpOnly. A zero expires makes it last until
+// the browser closes.
+func newCookie(name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     *cookiePath,
+		Domain:   *cookieDomain,
+		Expires:  expires,
+		Secure:   *cookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSite(*cookieSameSite),
+	}
+}
+
+// clearCookie has a browser forget the cookie name.
+func clearCookie(w http.ResponseWriter, name string) {
+	c := newCookie(name, "", time.Unix(0, 0))
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
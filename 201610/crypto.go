@@ -2,37 +2,34 @@ package main
 
 import (
 	"net/http"
-	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/goware/jwtauth"
 	"github.com/yargevad/crypto/naclutil"
 )
 
+// privKey keys the HMACs that hide voters' names. Tokens are signed with
+// the keys in tokenAuth.
 var pubKey, privKey []byte
-var tokenAuth *jwtauth.JwtAuth
+var tokenAuth *TokenAuth
 
-func init() {
+// LoadKeys generates new or reads existing keys. It's called once flags
+// have been parsed, since they say where the keys are.
+func LoadKeys() error {
 	var err error
-	// generate new or read existing keys
 	pubKey, privKey, err = naclutil.FetchKeypair(*keyPath, *keyName)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	// init jwt context using private key
-	tokenAuth = jwtauth.New("HS256", privKey, nil)
-}
-
-func JWTString(name string) (string, error) {
-	claims := jwtauth.Claims{"user": name}.
-		SetExpiryIn(time.Hour * 24).
-		SetIssuedNow()
-	_, str, err := tokenAuth.Encode(claims)
-	return str, err
+	tokenAuth, err = LoadTokenAuth(*keyPath, *keyName)
+	return err
 }
 
 func JWTUser(r *http.Request) string {
 	ctx := r.Context()
+	// expired and revoked tokens are still in the context
+	if err, _ := ctx.Value("jwt.err").(error); err != nil {
+		return ""
+	}
 	token, ok := ctx.Value("jwt").(*jwt.Token)
 	if !ok || token == nil {
 		return ""
@@ -44,3 +41,17 @@ func JWTUser(r *http.Request) string {
 	}
 	return user
 }
+
+// VerifyToken checks a token the same way tokenAuth.Verifier and
+// SessionChecks do: it has to be signed with one of our keys, and not be
+// expired or revoked. Errors are the ones jwtauth uses.
+func VerifyToken(tokenStr string) (*jwt.Token, error) {
+	token, err := tokenAuth.Verify(tokenStr)
+	if err != nil {
+		return token, err
+	}
+	if err = CheckRevoked(token); err != nil {
+		return token, err
+	}
+	return token, nil
+}
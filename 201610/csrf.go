@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	csrfCookie = "csrf"
+	csrfField  = "CSRFToken"
+	csrfHeader = "X-CSRF-Token"
+)
+
+var ErrCSRF = errors.New("CSRF token is missing or wrong, reload the page and try again")
+
+// CSRF is a middleware that goes after ContentTypeChecks, and stops other
+// sites from submitting forms as our users. Each browser gets a random
+// token in a cookie, which other sites can't read, and every POST, PUT,
+// PATCH and DELETE has to send it back, in a CSRFToken form field or an
+// X-CSRF-Token header. JSON and requests with an Authorization header are
+// let through: browsers won't send either to another site without asking
+// it first, and we never say yes.
+func CSRF(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if cookie, err := r.Cookie(csrfCookie); err == nil {
+			token = cookie.Value
+		}
+
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			if e := checkCSRF(w, r, token); e != nil {
+				e.Write(w, r)
+				return
+			}
+		}
+
+		if token == "" {
+			var err error
+			if token, err = randomString(16); err != nil {
+				e := &Error{Code: http.StatusInternalServerError, Message: err}
+				e.Write(w, r)
+				return
+			}
+			http.SetCookie(w, newCookie(csrfCookie, token, time.Time{}))
+		}
+		ctx := context.WithValue(r.Context(), "csrf", token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func checkCSRF(w http.ResponseWriter, r *http.Request, token string) *Error {
+	inType, _ := r.Context().Value("content-type").(string)
+	if inType == JSON || r.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	sent := r.Header.Get(csrfHeader)
+	if inType == FormURL {
+		r.Body = http.MaxBytesReader(w, r.Body, csrfPostMax())
+		if err := r.ParseForm(); err != nil {
+			e := &Error{
+				Code:    http.StatusBadRequest,
+				Message: errors.Wrap(err, "ParseForm failed"),
+			}
+			return e
+		}
+		if sent == "" {
+			sent = r.PostForm.Get(csrfField)
+		}
+		// or decoding the form would fail on it
+		r.PostForm.Del(csrfField)
+		r.Form.Del(csrfField)
+	}
+
+	if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		return &Error{Code: http.StatusForbidden, Message: ErrCSRF}
+	}
+	return nil
+}
+
+// csrfPostMax bounds the forms CSRF reads to find the token. It's the most
+// any of them may be.
+func csrfPostMax() int64 {
+	max := *pollPostMax
+	for _, n := range []int64{*signupPostMax, *loginPostMax, *userChangePostMax,
+		*invitationPostMax, *mfaPostMax, *passwordPostMax} {
+		if n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// CSRFToken is the request's token, for forms to send back.
+func CSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value("csrf").(string)
+	return token
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"html"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/pressly/chi/middleware"
 	"github.com/uber-go/zap"
@@ -12,6 +15,21 @@ import (
 type Error struct {
 	Code    int
 	Message error
+	// RetryAfter, if set, is sent as a Retry-After header.
+	RetryAfter time.Duration
+}
+
+// MarshalJSON spells out Message, which would otherwise encode as whatever
+// fields the error value happens to have.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	var msg string
+	if e.Message != nil {
+		msg = e.Message.Error()
+	}
+	return json.Marshal(struct {
+		Code    int
+		Message string
+	}{e.Code, msg})
 }
 
 func (e *Error) Write(w http.ResponseWriter, r *http.Request) {
@@ -32,6 +50,11 @@ func (e *Error) Write(w http.ResponseWriter, r *http.Request) {
 		zap.String("reqID", reqID))
 
 	w.Header().Set("Content-Type", ctype)
+	if e.RetryAfter > 0 {
+		// whole seconds, rounded up so clients don't come back too soon
+		secs := int64((e.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
 	w.WriteHeader(e.Code)
 
 	if ctype == "application/json" {
@@ -45,7 +68,8 @@ func (e *Error) Write(w http.ResponseWriter, r *http.Request) {
 
 	} else if ctype == "text/html" {
 		// FIXME: use an actual template here
+		// messages may quote the request, so they're escaped like any input
 		fmt.Fprintf(w, "<html><head><title>%d error</title></head><body><h1>%d</h1><h4>%s</h4</body></html>",
-			e.Code, e.Code, e.Message)
+			e.Code, e.Code, html.EscapeString(e.Message.Error()))
 	}
 }
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+	"github.com/uber-go/zap"
+)
+
+// How often an idle stream gets something written to it, so proxies and
+// clients don't give up on it.
+const eventKeepAlive = 30 * time.Second
+
+// Hub passes poll tallies from whoever changed them to whoever is watching.
+// It only lives as long as the process, so with more than one server,
+// watchers only hear about votes cast on theirs.
+type Hub struct {
+	sync.Mutex
+	subs map[string]map[chan *PollResults]bool
+	// one per watched poll whose hidden results are due to be revealed
+	reveals map[string]*time.Timer
+	done    chan struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs:    map[string]map[chan *PollResults]bool{},
+		reveals: map[string]*time.Timer{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Close ends every stream, for shutting down. Clients reconnect elsewhere.
+func (h *Hub) Close() {
+	h.Lock()
+	defer h.Unlock()
+	select {
+	case <-h.done:
+	default:
+		close(h.done)
+	}
+	for name, t := range h.reveals {
+		t.Stop()
+		delete(h.reveals, name)
+	}
+}
+
+// Done is closed by Close.
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Subscribe returns a channel with the latest tally for the poll. Tallies
+// replace each other, so a slow reader only misses ones that were already
+// out of date. nil means the poll was deleted. Call cancel when done.
+func (h *Hub) Subscribe(pollName string) (ch chan *PollResults, cancel func()) {
+	ch = make(chan *PollResults, 1)
+	h.Lock()
+	if h.subs[pollName] == nil {
+		h.subs[pollName] = map[chan *PollResults]bool{}
+	}
+	h.subs[pollName][ch] = true
+	h.Unlock()
+
+	cancel = func() {
+		h.Lock()
+		delete(h.subs[pollName], ch)
+		if len(h.subs[pollName]) == 0 {
+			delete(h.subs, pollName)
+			if t, ok := h.reveals[pollName]; ok {
+				t.Stop()
+				delete(h.reveals, pollName)
+			}
+		}
+		h.Unlock()
+	}
+	return ch, cancel
+}
+
+// Listening reports whether anyone is subscribed to the poll.
+func (h *Hub) Listening(pollName string) bool {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.subs[pollName]) > 0
+}
+
+// Publish hands res to the poll's subscribers without waiting for them.
+func (h *Hub) Publish(pollName string, res *PollResults) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subs[pollName] {
+		select {
+		case ch <- res:
+		default:
+			// only Publish sends, so once the stale tally is gone there's room
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- res
+		}
+	}
+}
+
+// Reveal publishes the tally of a watched poll with hidden results when it
+// closes on schedule, since nothing gets saved then. Each poll has one timer
+// for all its subscribers. It's kept unless reset, which picks up a new
+// ClosesAt.
+func (h *Hub) Reveal(p *Poll, reset bool) {
+	h.Lock()
+	defer h.Unlock()
+	t, ok := h.reveals[p.Name]
+	if ok && !reset {
+		return
+	} else if ok {
+		t.Stop()
+		delete(h.reveals, p.Name)
+	}
+	if len(h.subs[p.Name]) == 0 || !p.ResultsHidden() || p.ClosesAt == nil {
+		return
+	}
+	name := p.Name
+	t = time.AfterFunc(time.Until(*p.ClosesAt), func() {
+		h.Lock()
+		// a reset may have replaced this timer just as it fired
+		current := h.reveals[name] == t
+		if current {
+			delete(h.reveals, name)
+		}
+		h.Unlock()
+		if current {
+			h.PollChanged(name)
+		}
+	})
+	h.reveals[name] = t
+}
+
+// PollChanged tells the poll's subscribers its new tally, if they're allowed
+// to see it. Call it once a change to the poll has been saved.
+func (h *Hub) PollChanged(pollName string) {
+	if !h.Listening(pollName) {
+		return
+	}
+	poll, err := env.Store.PollByName(pollName)
+	if errors.Cause(err) == ErrNoSuchPoll {
+		h.Publish(pollName, nil)
+		return
+	} else if err != nil {
+		env.Log.Error("poll event load failed", zap.Error(err), zap.String("poll", pollName))
+		return
+	}
+	h.Reveal(poll, true)
+	if poll.ResultsHidden() {
+		return
+	}
+	h.Publish(pollName, poll.Results())
+}
+
+// PollEventsGet streams a poll's tally as it changes, as Server-Sent Events,
+// or over a WebSocket when the client asks to upgrade. Each message is the
+// same JSON as /polls/:pollname/results. Nothing is sent while the results
+// are hidden.
+func PollEventsGet(w http.ResponseWriter, r *http.Request) {
+	pollName := chi.URLParam(r, "pollname")
+
+	// subscribe first, so changes made while loading the poll aren't missed
+	ch, cancel := env.Events.Subscribe(pollName)
+	defer cancel()
+
+	poll, err := env.Store.PollByName(pollName)
+	if err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	var first *PollResults
+	if !poll.ResultsHidden() {
+		first = poll.Results()
+	}
+	env.Events.Reveal(poll, false)
+
+	if isWebSocket(r) {
+		pollWebSocket(w, r, ch, first)
+		return
+	}
+
+	// The stream lasts as long as the client watches, not -writetimeout.
+	// Every ResponseWriter between here and the server has to unwrap for
+	// this to reach the connection; otherwise the stream would be cut off.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		e := &Error{Code: http.StatusInternalServerError, Message: errors.Wrap(err, "streaming not supported")}
+		e.Write(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(res *PollResults) bool {
+		if res == nil {
+			io.WriteString(w, "event: deleted\ndata: {}\n\n")
+			return false
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			env.Log.Error("poll event encode failed", zap.Error(err))
+			return false
+		}
+		io.WriteString(w, "event: tally\ndata: ")
+		w.Write(data)
+		io.WriteString(w, "\n\n")
+		return true
+	}
+	if first != nil {
+		send(first)
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		// the server cancels this when the client goes away
+		case <-r.Context().Done():
+			return
+		case <-env.Events.Done():
+			return
+		case res := <-ch:
+			more := send(res)
+			if rc.Flush() != nil || !more {
+				return
+			}
+		case <-keepAlive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			if rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// The GUID RFC 6455 has servers mix into their handshake.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// The biggest frame we'll read. Clients have nothing to say but close and
+// ping, whose payloads are at most 125 bytes.
+const wsReadMax = 4096
+
+// ErrWSProtocol is a frame we won't read. Clients have no reason to send
+// fragments, so rather than reassemble them, the connection is closed.
+var ErrWSProtocol = errors.New("websocket protocol error")
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is the server end of a WebSocket. Only the handler writes tallies,
+// but the reader answers pings, so writes are serialized.
+type wsConn struct {
+	sync.Mutex
+	conn net.Conn
+	buf  *bufio.ReadWriter
+}
+
+func (c *wsConn) WriteFrame(opcode byte, payload []byte) error {
+	c.Lock()
+	defer c.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.buf.Write(header)
+	c.buf.Write(payload)
+	return c.buf.Flush()
+}
+
+// ReadFrame reads a client frame, which must be masked and unfragmented,
+// and unmasks it. Frames that break the rules return ErrWSProtocol.
+func (c *wsConn) ReadFrame() (opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.buf, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = head[0] & 0x0F
+	switch {
+	case head[0]&0x80 == 0 || opcode == wsContinuation:
+		return 0, nil, errors.Wrap(ErrWSProtocol, "fragmented frame")
+	case head[0]&0x70 != 0:
+		return 0, nil, errors.Wrap(ErrWSProtocol, "reserved bits set")
+	case head[1]&0x80 == 0:
+		return 0, nil, errors.Wrap(ErrWSProtocol, "unmasked client frame")
+	}
+	n := uint64(head[1] & 0x7F)
+	if opcode >= wsClose && n > 125 {
+		return 0, nil, errors.Wrap(ErrWSProtocol, "control frame too long")
+	}
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.buf, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.buf, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.buf, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	if n > wsReadMax {
+		// nothing a client sends us is worth reading
+		_, err = io.CopyN(ioutil.Discard, c.buf, int64(n))
+		return opcode, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.buf, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// sameOrigin reports whether the request's Origin, if it has one, is the
+// host it was sent to. Only browsers send one.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func pollWebSocket(w http.ResponseWriter, r *http.Request, ch chan *PollResults, first *PollResults) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("unsupported websocket handshake")}
+		e.Write(w, r)
+		return
+	}
+	// Browsers send cookies along with any site's WebSockets, and leave it
+	// to us to turn other sites away.
+	if !sameOrigin(r) {
+		e := &Error{Code: http.StatusForbidden, Message: errors.Errorf("websocket from another origin: %s", r.Header.Get("Origin"))}
+		e.Write(w, r)
+		return
+	}
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		e := &Error{Code: http.StatusInternalServerError, Message: errors.Wrap(err, "websockets not supported")}
+		e.Write(w, r)
+		return
+	}
+	defer conn.Close()
+	// the server's deadlines are still set; frames set their own
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err = buf.Flush(); err != nil {
+		return
+	}
+	ws := &wsConn{conn: conn, buf: buf}
+
+	// The connection no longer belongs to the http server, so its context
+	// won't tell us the client left. Reading will.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := ws.ReadFrame()
+			if errors.Cause(err) == ErrWSProtocol {
+				// 1002: protocol error
+				ws.WriteFrame(wsClose, []byte{0x03, 0xEA})
+				return
+			} else if err != nil {
+				return
+			}
+			switch opcode {
+			case wsClose:
+				ws.WriteFrame(wsClose, nil)
+				return
+			case wsPing:
+				ws.WriteFrame(wsPong, payload)
+			}
+		}
+	}()
+
+	send := func(res *PollResults) bool {
+		if res == nil {
+			// 1000: normal closure
+			ws.WriteFrame(wsClose, []byte{0x03, 0xE8})
+			return false
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			env.Log.Error("poll event encode failed", zap.Error(err))
+			return false
+		}
+		return ws.WriteFrame(wsText, data) == nil
+	}
+	if first != nil && !send(first) {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-env.Events.Done():
+			// 1001: going away
+			ws.WriteFrame(wsClose, []byte{0x03, 0xE9})
+			return
+		case res := <-ch:
+			if !send(res) {
+				return
+			}
+		case <-keepAlive.C:
+			if ws.WriteFrame(wsPing, nil) != nil {
+				return
+			}
+		}
+	}
+}
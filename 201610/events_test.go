@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+)
+
+// eventServer serves a poll's events the way buildRouter does, with a
+// write timeout short enough to matter.
+func eventServer(t *testing.T) *httptest.Server {
+	resetEnv(t)
+	poll := &Poll{Name: "beer", Question: "Best?", Options: []*PollOption{{Response: "ipa"}, {Response: "stout"}}}
+	if err := env.Store.CreatePoll(poll); err != nil {
+		t.Fatal(err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(StreamLogger)
+	r.Use(SecurityHeaders)
+	r.Get("/polls/:pollname/events", PollEventsGet)
+	srv := httptest.NewUnstartedServer(r)
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func vote(t *testing.T, userName, choice string) {
+	if err := env.Store.Vote("beer", userName, []string{choice}); err != nil {
+		t.Fatal(err)
+	}
+	env.Events.PollChanged("beer")
+}
+
+// readEvent reads up to the end of the next event, skipping keepalives.
+func readEvent(t *testing.T, br *bufio.Reader) string {
+	var event []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %q: %v", event, err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && len(event) > 0:
+			return strings.Join(event, "\n")
+		case line != "" && !strings.HasPrefix(line, ":"):
+			event = append(event, line)
+		}
+	}
+}
+
+func TestEventStreamOutlivesWriteTimeout(t *testing.T) {
+	srv := eventServer(t)
+	resp, err := http.Get(srv.URL + "/polls/beer/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	br := bufio.NewReader(resp.Body)
+	if event := readEvent(t, br); !strings.Contains(event, `"Voters":0`) {
+		t.Errorf("first event %q", event)
+	}
+
+	time.Sleep(2 * srv.Config.WriteTimeout)
+	vote(t, "alice", "ipa")
+	if event := readEvent(t, br); !strings.Contains(event, `"Voters":1`) {
+		t.Errorf("event after the write timeout %q", event)
+	}
+}
+
+// hideUnwrap is a ResponseWriter like the ones that don't unwrap.
+type hideUnwrap struct {
+	http.ResponseWriter
+}
+
+func TestEventStreamNeedsUnwrap(t *testing.T) {
+	resetEnv(t)
+	if err := env.Store.CreatePoll(&Poll{Name: "beer", Question: "Best?"}); err != nil {
+		t.Fatal(err)
+	}
+	r := chi.NewRouter()
+	r.Get("/polls/:pollname/events", func(w http.ResponseWriter, r *http.Request) {
+		PollEventsGet(hideUnwrap{w}, r)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/polls/beer/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+}
+
+// clientFrame is a masked frame, as clients send them.
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+	frame := []byte{head}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestReadFrame(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		frame   []byte
+		opcode  byte
+		payload string
+		err     error
+	}{
+		{"ping", clientFrame(true, wsPing, []byte("hi")), wsPing, "hi", nil},
+		{"close", clientFrame(true, wsClose, []byte{0x03, 0xE8}), wsClose, "\x03\xe8", nil},
+		{"text", clientFrame(true, wsText, []byte("hello")), wsText, "hello", nil},
+		{"first fragment", clientFrame(false, wsText, []byte("hel")), 0, "", ErrWSProtocol},
+		{"continuation", clientFrame(true, wsContinuation, []byte("lo")), 0, "", ErrWSProtocol},
+		{"reserved bits", append([]byte{0x80 | 0x40 | wsText}, clientFrame(true, wsText, nil)[1:]...), 0, "", ErrWSProtocol},
+		{"unmasked", []byte{0x80 | wsText, 2, 'h', 'i'}, 0, "", ErrWSProtocol},
+		{"long ping", clientFrame(true, wsPing, make([]byte, 126)), 0, "", ErrWSProtocol},
+		{"short read", clientFrame(true, wsText, []byte("hello"))[:8], 0, "", io.ErrUnexpectedEOF},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &wsConn{buf: bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(tt.frame)), nil)}
+			opcode, payload, err := c.ReadFrame()
+			if errors.Cause(err) != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && (opcode != tt.opcode || string(payload) != tt.payload) {
+				t.Errorf("got %x %q, want %x %q", opcode, payload, tt.opcode, tt.payload)
+			}
+		})
+	}
+}
+
+// dialWebSocket sends a handshake with the headers given, and returns the
+// connection and the response to it.
+func dialWebSocket(t *testing.T, srv *httptest.Server, header http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest("GET", srv.URL+"/polls/beer/events", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err = req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+// readServerFrame reads an unmasked frame from the server.
+func readServerFrame(t *testing.T, br *bufio.Reader) (byte, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := int(head[1] & 0x7F)
+	if n == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(br, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	srv := eventServer(t)
+	host := srv.Listener.Addr().String()
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		code   int
+	}{
+		{"no origin", nil, http.StatusSwitchingProtocols},
+		{"same origin", http.Header{"Origin": {"http://" + host}}, http.StatusSwitchingProtocols},
+		{"other origin", http.Header{"Origin": {"http://evil.example"}}, http.StatusForbidden},
+		{"bad origin", http.Header{"Origin": {"://"}}, http.StatusForbidden},
+		{"old version", http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, br, resp := dialWebSocket(t, srv, tt.header)
+			if resp.StatusCode != tt.code {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.code)
+			}
+			if tt.code != http.StatusSwitchingProtocols {
+				return
+			}
+			// RFC 6455's example key and answer
+			if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("accept %q", accept)
+			}
+			opcode, payload := readServerFrame(t, br)
+			if opcode != wsText || !bytes.Contains(payload, []byte(`"Name":"beer"`)) {
+				t.Errorf("first frame %x %q", opcode, payload)
+			}
+		})
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	srv := eventServer(t)
+	for _, tt := range []struct {
+		name   string
+		send   []byte
+		opcode byte
+		reply  string
+	}{
+		{"ping", clientFrame(true, wsPing, []byte("hi")), wsPong, "hi"},
+		{"close", clientFrame(true, wsClose, []byte{0x03, 0xE8}), wsClose, ""},
+		{"fragment", clientFrame(false, wsText, []byte("hel")), wsClose, "\x03\xea"},
+		{"continuation", clientFrame(true, wsContinuation, []byte("lo")), wsClose, "\x03\xea"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, br, resp := dialWebSocket(t, srv, nil)
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			readServerFrame(t, br)
+			if _, err := conn.Write(tt.send); err != nil {
+				t.Fatal(err)
+			}
+			opcode, payload := readServerFrame(t, br)
+			if opcode != tt.opcode || string(payload) != tt.reply {
+				t.Errorf("got %x %q, want %x %q", opcode, payload, tt.opcode, tt.reply)
+			}
+		})
+	}
+}
+
+// A hidden poll's watchers share one reveal, which follows the poll when
+// its closing time moves.
+func TestRevealFollowsClosesAt(t *testing.T) {
+	resetEnv(t)
+	closes := time.Now().Add(100 * time.Millisecond)
+	poll := &Poll{Name: "beer", Question: "Best?", Visibility: VisibilityHidden, ClosesAt: &closes,
+		Options: []*PollOption{{Response: "ipa"}, {Response: "stout"}}}
+	if err := env.Store.CreatePoll(poll); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Store.Vote("beer", "alice", []string{"ipa"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var chans []chan *PollResults
+	for i := 0; i < 3; i++ {
+		ch, cancel := env.Events.Subscribe("beer")
+		defer cancel()
+		env.Events.Reveal(poll, false)
+		chans = append(chans, ch)
+	}
+	env.Events.Lock()
+	timers := len(env.Events.reveals)
+	env.Events.Unlock()
+	if timers != 1 {
+		t.Fatalf("%d reveal timers, want 1", timers)
+	}
+
+	later := time.Now().Add(400 * time.Millisecond)
+	poll.ClosesAt = &later
+	if err := env.Store.UpdatePoll(poll); err != nil {
+		t.Fatal(err)
+	}
+	env.Events.PollChanged("beer")
+
+	for i, ch := range chans {
+		select {
+		case res := <-ch:
+			if now := time.Now(); now.Before(later) {
+				t.Errorf("subscriber %d: revealed %v before closing", i, later.Sub(now))
+			}
+			if res == nil || res.Voters != 1 {
+				t.Errorf("subscriber %d: got %+v", i, res)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("subscriber %d: never revealed", i)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var hsts = flag.Duration("hsts", 0, "max-age for Strict-Transport-Security, 0 to leave it off; only set it when serving https")
+
+// SecurityHeaders is a middleware that sets the headers that tell browsers
+// what pages may do. Scripts need the request's nonce, which keeps out
+// anything injected into a page, and our own scripts are served from
+// /static. Nothing else may frame our pages, and other sites aren't told
+// which page linked to them, since some URLs hold codes.
+func SecurityHeaders(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := randomString(16)
+		if err != nil {
+			e := &Error{Code: http.StatusInternalServerError, Message: err}
+			e.Write(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; "+
+			"script-src 'self' 'nonce-%s'; style-src 'self'; img-src 'self'; "+
+			"connect-src 'self'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'", nonce))
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+		if *hsts > 0 {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", *hsts/time.Second))
+		}
+
+		ctx := context.WithValue(r.Context(), "csp-nonce", nonce)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// CSPNonce is the request's nonce, for script tags.
+func CSPNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value("csp-nonce").(string)
+	return nonce
+}
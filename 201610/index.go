@@ -10,31 +10,39 @@ import (
 type IndexModel struct {
 	LoggedIn bool
 	Username string
-	Polls    map[string]Poll
+	// Admin is set for admins, who get a link to the admin console.
+	Admin bool
+	Query *PollQuery
+	Polls []Poll
+	// Next links to the following page, if there is one.
+	Next string
 }
 
 var indexTemplate *template.Template
 
 func init() {
-	indexTemplate = template.Must(template.ParseFiles("templates/index.html"))
+	indexTemplate = parseTemplate("templates/index.html")
 }
 
 func Index(w http.ResponseWriter, r *http.Request) {
-	var err error
 	model := &IndexModel{}
 	model.Username = JWTUser(r)
 	if model.Username != "" {
 		model.LoggedIn = true
+		model.Admin = HasRole(JWTRole(r), RoleAdmin)
 	}
 
-	model.Polls, err = AllPolls()
-	if err != nil {
-		e := &Error{Code: http.StatusInternalServerError, Message: err}
+	q, page, e := ListPage(r)
+	if e != nil {
 		e.Write(w, r)
 		return
 	}
+	model.Query, model.Polls = q, page.Polls
+	if page.Next != "" {
+		model.Next = q.URL(page.Next)
+	}
 
-	err = indexTemplate.Execute(w, model)
+	err := renderTemplate(w, r, indexTemplate, model)
 	if err != nil {
 		e := &Error{
 			Code:    http.StatusInternalServerError,
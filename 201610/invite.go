@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+)
+
+const (
+	invitationLifetime    = 7 * 24 * time.Hour
+	invitationLifetimeMax = 30 * 24 * time.Hour
+)
+
+var invitationPostMax = flag.Int64("invitationpostmax", 1024, "largest body for making an invitation")
+
+// Invitation lets someone sign up, once. Like refresh tokens, only the
+// hash of the code is kept.
+type Invitation struct {
+	ID string
+	// User is who the invitation is for. Anyone may use it when it's empty.
+	User      string `json:",omitempty"`
+	CreatedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Admits reports whether userName may sign up with the invitation at now.
+func (inv *Invitation) Admits(userName string, now time.Time) bool {
+	return (inv.User == "" || inv.User == userName) && !now.After(inv.ExpiresAt)
+}
+
+// IssuedInvitation is what an admin gets back when inviting someone: the
+// only time the code itself is around.
+type IssuedInvitation struct {
+	Invitation
+	Code string
+	// Link is the signup page, with the code filled in.
+	Link string
+}
+
+// Invite is what an admin sends to invite someone.
+type Invite struct {
+	// User, if set, is the only name the invitation can sign up.
+	User string
+	// ExpiresIn is a duration like "48h". It's a week when unset.
+	ExpiresIn string
+}
+
+func (i *Invite) Validate() (*Invite, *Error) {
+	if i.ExpiresIn == "" {
+		return i, nil
+	}
+	d, err := time.ParseDuration(i.ExpiresIn)
+	if err != nil {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.Wrap(err, "ExpiresIn is invalid")}
+		return nil, e
+	}
+	if d <= 0 || d > invitationLifetimeMax {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Errorf("ExpiresIn must be between 0 and %s", invitationLifetimeMax),
+		}
+		return nil, e
+	}
+	return i, nil
+}
+
+func InviteFromForm(r *http.Request) (*Invite, *Error) {
+	var err error
+	invite := &Invite{}
+
+	if err = r.ParseForm(); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "ParseForm failed"),
+		}
+		return nil, e
+	}
+
+	err = env.Form.Decode(invite, r.PostForm)
+	if err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "Decode failed"),
+		}
+		return nil, e
+	}
+
+	return invite.Validate()
+}
+
+func InviteFromJSON(r io.Reader) (*Invite, *Error) {
+	invite := &Invite{}
+	if err := json.NewDecoder(r).Decode(invite); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "json decoding failed"),
+		}
+		return nil, e
+	}
+	return invite.Validate()
+}
+
+// Issue makes and saves an invitation from admin.
+func (i *Invite) Issue(admin string) (*IssuedInvitation, *Error) {
+	code, err := randomString(16)
+	if err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Message: err}
+	}
+	lifetime := invitationLifetime
+	if i.ExpiresIn != "" {
+		// checked by Validate
+		lifetime, _ = time.ParseDuration(i.ExpiresIn)
+	}
+
+	now := time.Now()
+	issued := &IssuedInvitation{
+		Invitation: Invitation{
+			ID:        hashToken(code),
+			User:      i.User,
+			CreatedBy: admin,
+			CreatedAt: now,
+			ExpiresAt: now.Add(lifetime),
+		},
+		Code: code,
+		Link: "/signup?" + url.Values{"invitation": {code}}.Encode(),
+	}
+	if err = env.Store.CreateInvitation(&issued.Invitation); err != nil {
+		return nil, StoreError(err)
+	}
+	return issued, nil
+}
+
+func APIInvitationsPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *invitationPostMax)
+	defer r.Body.Close()
+
+	invite, e := InviteFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	issued, e := invite.Issue(JWTUser(r))
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusCreated, issued)
+}
+
+// APIInvitationsGet lists invitations that haven't been used yet, oldest
+// first, expired ones included.
+func APIInvitationsGet(w http.ResponseWriter, r *http.Request) {
+	invitations, err := env.Store.Invitations()
+	if err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	sort.Slice(invitations, func(i, j int) bool {
+		return invitations[i].CreatedAt.Before(invitations[j].CreatedAt)
+	})
+	if invitations == nil {
+		invitations = []*Invitation{}
+	}
+	WriteJSON(w, r, http.StatusOK, invitations)
+}
+
+func APIInvitationDelete(w http.ResponseWriter, r *http.Request) {
+	if err := env.Store.DeleteInvitation(chi.URLParam(r, "id")); err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/base64"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Orders a poll listing can be sorted in.
+const (
+	SortName    = "name"
+	SortNewest  = "newest"
+	SortVotes   = "votes"
+	SortClosing = "closing"
+)
+
+var pollSorts = map[string]bool{
+	SortName:    true,
+	SortNewest:  true,
+	SortVotes:   true,
+	SortClosing: true,
+}
+
+// States a poll listing can be filtered by.
+const (
+	StateOpen     = "open"
+	StateClosed   = "closed"
+	StateUpcoming = "upcoming"
+)
+
+var pollStates = map[string]bool{
+	"":            true,
+	StateOpen:     true,
+	StateClosed:   true,
+	StateUpcoming: true,
+}
+
+const (
+	pollPageDefault = 20
+	pollPageMax     = 100
+)
+
+// PollQuery picks out one page of polls. Pages are ordered by a sort key,
+// then by name, and After is an opaque cursor from the previous page.
+//
+// Paging by name or newest sees every poll once, since neither key changes.
+// The votes and closing keys do, as votes come in and polls close: a poll
+// whose key moves across the cursor between pages is skipped, or shown a
+// second time. Those orders are for looking at, not for walking every poll.
+type PollQuery struct {
+	Sort    string
+	Creator string
+	State   string
+	Search  string
+	After   string
+	Limit   int
+
+	// decoded from After
+	afterKey  int64
+	afterName string
+}
+
+// PollPage is a page of polls. Next is the cursor for the following page,
+// empty on the last one.
+type PollPage struct {
+	Polls []Poll
+	Next  string `json:",omitempty"`
+}
+
+// PollQueryFromURL reads a PollQuery from the request's query string:
+// sort, creator, state, q (searched for in questions), after and limit.
+func PollQueryFromURL(r *http.Request) (*PollQuery, *Error) {
+	params := r.URL.Query()
+	q := &PollQuery{
+		Sort:    params.Get("sort"),
+		Creator: params.Get("creator"),
+		State:   params.Get("state"),
+		Search:  params.Get("q"),
+		After:   params.Get("after"),
+		Limit:   pollPageDefault,
+	}
+	if q.Sort == "" {
+		q.Sort = SortName
+	}
+	if !pollSorts[q.Sort] {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.Errorf("unknown sort %q", q.Sort)}
+		return nil, e
+	}
+	if !pollStates[q.State] {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.Errorf("unknown state %q", q.State)}
+		return nil, e
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			e := &Error{Code: http.StatusBadRequest, Message: errors.Errorf("bad limit %q", limit)}
+			return nil, e
+		}
+		if n > pollPageMax {
+			n = pollPageMax
+		}
+		q.Limit = n
+	}
+	if q.After != "" {
+		if err := q.decodeCursor(); err != nil {
+			e := &Error{Code: http.StatusBadRequest, Message: err}
+			return nil, e
+		}
+	}
+	return q, nil
+}
+
+// cursor encodes the position just past p, along with the sort it's for.
+func (q *PollQuery) cursor(p *Poll) string {
+	raw := q.Sort + ":" + strconv.FormatInt(q.key(p), 10) + ":" + p.Name
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func (q *PollQuery) decodeCursor() error {
+	raw, err := base64.RawURLEncoding.DecodeString(q.After)
+	if err != nil {
+		return errors.Wrap(err, "bad cursor")
+	}
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 || parts[0] != q.Sort {
+		return errors.New("cursor doesn't match this sort")
+	}
+	if q.afterKey, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return errors.Wrap(err, "bad cursor")
+	}
+	q.afterName = parts[2]
+	return nil
+}
+
+// key is what polls are ordered by, smallest first, before their names.
+// Polls without a creation time sort after the rest when newest is wanted,
+// and polls that have no closing time, or have already closed, come last
+// when it's closing soon.
+func (q *PollQuery) key(p *Poll) int64 {
+	switch q.Sort {
+	case SortNewest:
+		if p.CreatedAt != nil {
+			return -p.CreatedAt.Unix()
+		}
+	case SortVotes:
+		// hidden results shouldn't leak through the order
+		if p.ResultsHidden() {
+			return 0
+		}
+		n := 0
+		for _, option := range p.Options {
+			n += option.Count
+		}
+		return -int64(n)
+	case SortClosing:
+		if p.ClosesAt != nil && p.CheckOpen(time.Now()) != ErrPollClosed {
+			return p.ClosesAt.Unix()
+		}
+		return math.MaxInt64
+	}
+	return 0
+}
+
+// Match reports whether p passes the query's filters.
+func (q *PollQuery) Match(p *Poll) bool {
+	if q.Creator != "" && p.Creator != q.Creator {
+		return false
+	}
+	if q.Search != "" && !strings.Contains(strings.ToLower(p.Question), strings.ToLower(q.Search)) {
+		return false
+	}
+	err := p.CheckOpen(time.Now())
+	switch q.State {
+	case StateOpen:
+		return err == nil
+	case StateClosed:
+		return err == ErrPollClosed
+	case StateUpcoming:
+		return err == ErrPollNotOpen
+	}
+	return true
+}
+
+// past reports whether p comes after the cursor.
+func (q *PollQuery) past(p *Poll) bool {
+	if q.After == "" {
+		return true
+	}
+	key := q.key(p)
+	return key > q.afterKey || (key == q.afterKey && p.Name > q.afterName)
+}
+
+// Page filters, sorts and pages through polls. Stores that can't do better
+// than loading every poll use it to answer ListPolls.
+func (q *PollQuery) Page(polls map[string]Poll) *PollPage {
+	var matched []Poll
+	for _, poll := range polls {
+		if q.Match(&poll) && q.past(&poll) {
+			matched = append(matched, poll)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		ki, kj := q.key(&matched[i]), q.key(&matched[j])
+		if ki != kj {
+			return ki < kj
+		}
+		return matched[i].Name < matched[j].Name
+	})
+
+	page := &PollPage{Polls: matched}
+	if len(matched) > q.Limit {
+		page.Polls = matched[:q.Limit]
+		page.Next = q.cursor(&page.Polls[q.Limit-1])
+	}
+	return page
+}
+
+// URL is the query string for this query with after set to cursor, for
+// linking to other pages.
+func (q *PollQuery) URL(cursor string) string {
+	params := url.Values{}
+	if q.Sort != SortName {
+		params.Set("sort", q.Sort)
+	}
+	if q.Creator != "" {
+		params.Set("creator", q.Creator)
+	}
+	if q.State != "" {
+		params.Set("state", q.State)
+	}
+	if q.Search != "" {
+		params.Set("q", q.Search)
+	}
+	if q.Limit != pollPageDefault {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if cursor != "" {
+		params.Set("after", cursor)
+	}
+	return "?" + params.Encode()
+}
+
+// ListPage loads the page of polls the request asks for, with anything the
+// user isn't allowed to see stripped out.
+func ListPage(r *http.Request) (*PollQuery, *PollPage, *Error) {
+	q, e := PollQueryFromURL(r)
+	if e != nil {
+		return nil, nil, e
+	}
+	page, err := env.Store.ListPolls(q)
+	if err != nil {
+		return nil, nil, StoreError(err)
+	}
+	loggedIn := JWTUser(r) != ""
+	for i := range page.Polls {
+		page.Polls[i].Redact(loggedIn)
+	}
+	return q, page, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listingPolls are polls whose keys tie under every sort, so pages have
+// to fall back on names.
+func listingPolls(now time.Time) []*Poll {
+	var polls []*Poll
+	for i, name := range []string{"g", "b", "e", "a", "f", "c", "d"} {
+		created := now.Add(-time.Duration(i/2) * time.Hour)
+		closes := now.Add(time.Duration(i%3+1) * time.Hour)
+		p := &Poll{
+			Name:      name,
+			Question:  "q " + name,
+			Creator:   "alice",
+			CreatedAt: &created,
+			ClosesAt:  &closes,
+			Options:   []*PollOption{{Response: "x"}, {Response: "y"}},
+		}
+		if i%2 == 0 {
+			p.Creator = "bob"
+		}
+		polls = append(polls, p)
+	}
+	return polls
+}
+
+// pageAll lists every page for q, and returns the names in the order seen.
+func pageAll(t *testing.T, s Store, q PollQuery) []string {
+	var names []string
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("%s: too many pages", q.Sort)
+		}
+		query := q
+		if query.After != "" {
+			if err := query.decodeCursor(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		page, err := s.ListPolls(&query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Polls) > q.Limit {
+			t.Fatalf("%s: page of %d, limit %d", q.Sort, len(page.Polls), q.Limit)
+		}
+		for _, poll := range page.Polls {
+			names = append(names, poll.Name)
+		}
+		if page.Next == "" {
+			return names
+		}
+		q.After = page.Next
+	}
+}
+
+func testPaging(t *testing.T, s Store) {
+	now := time.Now()
+	for _, p := range listingPolls(now) {
+		if err := s.CreatePoll(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// two votes for a, b and c; one for d
+	for i, name := range []string{"a", "b", "c", "d", "a", "b", "c"} {
+		if err := s.Vote(name, "voter"+strconv.Itoa(i), []string{"x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		sort    string
+		creator string
+		want    []string
+	}{
+		{SortName, "", []string{"a", "b", "c", "d", "e", "f", "g"}},
+		{SortName, "bob", []string{"d", "e", "f", "g"}},
+		{SortNewest, "", []string{"b", "g", "a", "e", "c", "f", "d"}},
+		{SortVotes, "", []string{"a", "b", "c", "d", "e", "f", "g"}},
+		{SortVotes, "alice", []string{"a", "b", "c"}},
+		{SortClosing, "", []string{"a", "d", "g", "b", "f", "c", "e"}},
+	} {
+		for _, limit := range []int{1, 2, 3, 100} {
+			got := pageAll(t, s, PollQuery{Sort: tt.sort, Creator: tt.creator, Limit: limit})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sort %s, creator %q, limit %d: got %v, want %v",
+					tt.sort, tt.creator, limit, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestMemStorePaging(t *testing.T) {
+	testPaging(t, NewMemStore())
+}
+
+func TestBoltStorePaging(t *testing.T) {
+	s, err := BoltOpen(filepath.Join(t.TempDir(), "bolt.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testPaging(t, s)
+}
+
+// Votes between pages don't move anything when paging by name.
+func TestPagingByNameIgnoresVotes(t *testing.T) {
+	s := NewMemStore()
+	for _, p := range listingPolls(time.Now()) {
+		if err := s.CreatePoll(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := &PollQuery{Sort: SortName, Limit: 3}
+	first, err := s.ListPolls(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Vote("g", "voter", []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+	q = &PollQuery{Sort: SortName, Limit: 10, After: first.Next}
+	if err = q.decodeCursor(); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.ListPolls(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, page := range []*PollPage{first, second} {
+		for _, poll := range page.Polls {
+			names = append(names, poll.Name)
+		}
+	}
+	if want := []string{"a", "b", "c", "d", "e", "f", "g"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+}
+
+func TestCursorSortMismatch(t *testing.T) {
+	votes := &PollQuery{Sort: SortVotes}
+	cursor := votes.cursor(&Poll{Name: "a"})
+	q := &PollQuery{Sort: SortName, After: cursor}
+	if err := q.decodeCursor(); err == nil {
+		t.Error("a votes cursor decoded for a name sort")
+	}
+	q = &PollQuery{Sort: SortVotes, After: cursor}
+	if err := q.decodeCursor(); err != nil {
+		t.Error(err)
+	}
+	if q.afterName != "a" {
+		t.Errorf("afterName = %q", q.afterName)
+	}
+}
+
+// Query parameters quoted back in errors don't become markup.
+func TestQueryErrorEscaped(t *testing.T) {
+	for _, query := range []string{
+		"sort=<img+src=x+onerror=alert(1)>",
+		"state=<script>",
+		"limit=<b>",
+	} {
+		r := httptest.NewRequest("GET", "/?"+query, nil)
+		_, e := PollQueryFromURL(r)
+		if e == nil {
+			t.Fatalf("%s: no error", query)
+		}
+		w := httptest.NewRecorder()
+		e.Write(w, r)
+		body := w.Body.String()
+		if strings.Contains(body, "<img") || strings.Contains(body, "<script") || strings.Contains(body, "<b>") {
+			t.Errorf("%s: unescaped body %s", query, body)
+		}
+		if !strings.Contains(body, "&lt;") {
+			t.Errorf("%s: input missing from body %s", query, body)
+		}
+	}
+}
@@ -2,30 +2,30 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"flag"
 	"html/template"
 	"io"
 	"net/http"
-	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
 	Name string
-	Pass string
+	Pass string `json:",omitempty"`
+	// Role and Disabled are set by admins, never taken from requests.
+	Role     string `json:",omitempty" schema:"-"`
+	Disabled bool   `json:",omitempty" schema:"-"`
 }
 
-const (
-	loginPostMax int64 = 1024
-)
+var loginPostMax = flag.Int64("loginpostmax", 1024, "largest login form or JSON body")
 
 var loginTemplate *template.Template
 
 func init() {
-	loginTemplate = template.Must(template.ParseFiles("templates/login.html"))
+	loginTemplate = parseTemplate("templates/login.html")
 }
 
 func LoginGet(w http.ResponseWriter, r *http.Request) {
@@ -36,7 +36,7 @@ func LoginGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := loginTemplate.Execute(w, nil)
+	err := renderTemplate(w, r, loginTemplate, nil)
 	if err != nil {
 		e := &Error{
 			Code:    http.StatusInternalServerError,
@@ -51,7 +51,7 @@ func LoginPost(w http.ResponseWriter, r *http.Request) {
 	inType := r.Context().Value("content-type").(string)
 
 	// limit the amount of data we accept for a login request
-	r.Body = http.MaxBytesReader(w, r.Body, loginPostMax)
+	r.Body = http.MaxBytesReader(w, r.Body, *loginPostMax)
 	defer r.Body.Close()
 
 	var user *User
@@ -72,11 +72,25 @@ func LoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	e = user.Verify()
+	e = user.Authenticate(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+
+	// with two-factor authentication, the password only gets a challenge
+	challenge, e := MFAChallengeFor(user.Name)
 	if e != nil {
 		e.Write(w, r)
 		return
 	}
+	if challenge != nil {
+		if inType == FormURL {
+			challenge.SetMFACookie(w)
+		}
+		Respond(w, r, http.StatusAccepted, challenge, "/login/mfa")
+		return
+	}
 
 	e = user.SetLoggedIn(w, r)
 	if e != nil {
@@ -84,8 +98,7 @@ func LoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Location", "/")
-	w.WriteHeader(http.StatusFound)
+	Respond(w, r, http.StatusOK, &User{Name: user.Name}, "/")
 }
 
 func (u *User) Validate() (*User, *Error) {
@@ -139,27 +152,9 @@ func UserFromJSON(r io.Reader) (*User, *Error) {
 }
 
 func UserByUsername(name string) (*User, *Error) {
-	code := http.StatusInternalServerError
-	user := &User{}
-	err := env.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("users"))
-		if b == nil {
-			return errors.New("no such bucket")
-		}
-		if jsonBytes := b.Get([]byte(name)); jsonBytes != nil {
-			err := json.Unmarshal(jsonBytes, user)
-			if err != nil {
-				return errors.Wrap(err, "user unmarshal failed")
-			}
-		} else {
-			code = http.StatusNotFound
-			return errors.New("no such user")
-		}
-		return nil
-	})
+	user, err := env.Store.UserByName(name)
 	if err != nil {
-		e := &Error{Code: code, Message: err}
-		return nil, e
+		return nil, StoreError(err)
 	}
 	return user, nil
 }
@@ -177,28 +172,43 @@ func (u *User) Verify() *Error {
 		}
 		return e
 	}
+	if user.Disabled {
+		return &Error{Code: http.StatusForbidden, Message: ErrAccountDisabled}
+	}
+	user.rehash(u.Pass)
 	return nil
 }
 
+// rehash saves pass hashed anew, if the stored hash isn't at -bcryptcost.
+// Failing is no reason to turn the user away, so it's only logged.
+func (u *User) rehash(pass string) {
+	if cost, err := bcrypt.Cost([]byte(u.Pass)); err == nil && cost == *bcryptCost {
+		return
+	}
+	hash, e := HashPassword(pass)
+	if e != nil {
+		env.Log.Error("password rehash failed", zap.Error(e.Message))
+		return
+	}
+	u.Pass = hash
+	if err := env.Store.UpdateUser(u); err != nil {
+		env.Log.Error("password rehash failed", zap.Error(err))
+	}
+}
+
 func (u *User) SetLoggedIn(w http.ResponseWriter, r *http.Request) *Error {
-	signed, err := JWTString(u.Name)
-	if err != nil {
-		e := &Error{
-			Code:    http.StatusInternalServerError,
-			Message: errors.Wrap(err, "jwt encoding failed"),
-		}
+	session, e := NewSession(u.Name)
+	if e != nil {
 		return e
 	}
 
 	inType := r.Context().Value("content-type").(string)
 	switch {
 	case inType == FormURL:
-		c := &http.Cookie{
-			Name: "jwt", Value: signed, HttpOnly: true, // Secure: true,
-		}
-		http.SetCookie(w, c)
+		session.SetCookies(w)
 	case inType == JSON:
-		w.Header().Set("X-JWT", signed)
+		w.Header().Set("X-JWT", session.Token)
+		w.Header().Set("X-Refresh-Token", session.RefreshToken)
 	default:
 		e := &Error{
 			Code:    http.StatusUnsupportedMediaType,
@@ -210,11 +220,26 @@ func (u *User) SetLoggedIn(w http.ResponseWriter, r *http.Request) *Error {
 	return nil
 }
 
-func LogoutGet(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Set-Cookie", fmt.Sprintf("jwt=; expires=%s; HttpOnly",
-		time.Now().Format(time.RFC1123)))
-	w.Header().Set("Location", "/")
-	w.WriteHeader(http.StatusFound)
+// LogoutPost revokes the user's token, whether it came from a cookie or an
+// X-JWT header, and has browsers forget theirs. It's a POST so that other
+// sites can't log people out with a link or an image.
+func LogoutPost(w http.ResponseWriter, r *http.Request) {
+	if e := EndSession(r); e != nil {
+		e.Write(w, r)
+		return
+	}
+	ClearSessionCookies(w)
+	Respond(w, r, http.StatusNoContent, nil, "/")
+}
+
+// LogoutEverywherePost revokes every token the user has been issued.
+func LogoutEverywherePost(w http.ResponseWriter, r *http.Request) {
+	if e := EndAllSessions(JWTUser(r)); e != nil {
+		e.Write(w, r)
+		return
+	}
+	ClearSessionCookies(w)
+	Respond(w, r, http.StatusNoContent, nil, "/")
 }
 
 func LogAuthErrors(next http.Handler) http.Handler {
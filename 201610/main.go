@@ -2,51 +2,140 @@ package main
 
 import (
 	"flag"
-	"fmt"
-	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/gorilla/schema"
 	"github.com/uber-go/zap"
 )
 
 // Our application-wide configuration.
 type Env struct {
-	DB     *bolt.DB
+	Store  Store
 	Log    zap.Logger
 	Form   *schema.Decoder
 	Secret string
+	Events *Hub
+	Limits LimitStore
 }
 
 var keyPath = flag.String("keypath", "./.keys", "where to store keys")
 var keyName = flag.String("keyname", "201610", "base name for keys")
 var port = flag.Int("port", 8080, "where to listen for http requests")
-var dbPath = flag.String("dbpath", "bolt.db", "path to db file")
-var secret = flag.String("secret", "", "secret key needed to create a user")
+var dbPath = flag.String("dbpath", "bolt.db", "path to db file, or :memory: for no persistence")
+var dbDriver = flag.String("dbdriver", "bolt", "storage backend: bolt, or a database/sql driver (sqlite3, postgres)")
+var dsn = flag.String("dsn", "", "data source name, for database/sql drivers")
+var secret = flag.String("secret", "", "secret key needed to sign up the first admin; set DENGO_SECRET_FILE instead to keep it out of ps")
+var tokenCleanup = flag.Duration("tokencleanup", time.Hour, "how often expired refresh tokens and revocations are deleted")
+var rotateKeys = flag.Bool("rotatekeys", false, "make a new token signing key, then exit")
+var summaryTTL = flag.Duration("summaryttl", time.Second, "how long poll listings may be served from cached summaries, 0 to always load them")
+var loginRate = rateFlag("loginrate", Rate{N: 20, Window: time.Minute}, "login attempts allowed per client address, like 20/1m, or 0 for no limit")
+var signupRate = rateFlag("signuprate", Rate{N: 10, Window: time.Hour}, "signups allowed per client address")
+var pollRate = rateFlag("pollrate", Rate{N: 20, Window: time.Hour}, "polls each user may create")
+var voteRate = rateFlag("voterate", Rate{N: 60, Window: time.Minute}, "votes each user may cast")
+var passwordMin = flag.Int("passwordmin", 8, "shortest password allowed for new passwords")
+var passwordBlocklist = flag.String("passwordblocklist", "", "file of breached passwords nobody may pick, one per line")
+var loginFailures = flag.Int("loginfailures", 5, "failed logins allowed per account name or client address before lockouts start")
+var lockoutMax = flag.Duration("lockoutmax", 15*time.Minute, "longest lockout after failed logins")
+var trustedProxies = proxiesFlag("trustedproxies", "load balancers and proxies whose X-Forwarded-For gives the client address, as addresses or CIDRs separated by commas; \"unix\" for whatever connects to -socket")
 
 var env = &Env{}
 
 func main() {
-	// get values from command line
+	// get values from command line, then the environment and config file
 	flag.Parse()
 	env.Log = zap.New(zap.NewJSONEncoder(), zap.Output(os.Stdout))
+	if err := LoadConfig(); err != nil {
+		env.Log.Fatal(err.Error())
+	}
+	if err := CheckConfig(); err != nil {
+		env.Log.Fatal(err.Error())
+	}
 
-	if *secret == "" {
-		env.Log.Fatal("secret is required")
+	if *rotateKeys {
+		key, err := RotateKeys(*keyPath, *keyName)
+		if err != nil {
+			env.Log.Fatal(err.Error())
+		}
+		env.Log.Info("token signing key rotated", zap.String("kid", key.ID))
+		return
 	}
+	if err := LoadKeys(); err != nil {
+		env.Log.Fatal(err.Error())
+	}
+
+	if *passwordBlocklist != "" {
+		if err := LoadPasswordBlocklist(*passwordBlocklist); err != nil {
+			env.Log.Fatal(err.Error())
+		}
+	}
+
+	// only good for signing up the first admin, who then invites everyone
 	env.Secret = *secret
-	env.Log.Info("secret loaded", zap.String("secret", env.Secret))
 
 	env.Form = schema.NewDecoder()
+	env.Form.RegisterConverter(time.Time{}, FormTime)
+
+	env.Events = NewHub()
+	env.Limits = NewMemLimitStore()
 
 	router := buildRouter()
-	err := BoltOpen(*dbPath)
+
+	switch {
+	case *dbDriver != "bolt":
+		store, err := SQLOpen(*dbDriver, *dsn)
+		if err != nil {
+			env.Log.Fatal(err.Error())
+		}
+		env.Store = store
+	case *dbPath == ":memory:":
+		env.Store = NewMemStore()
+	default:
+		store, err := BoltOpen(*dbPath)
+		if err != nil {
+			env.Log.Fatal(err.Error())
+		}
+		env.Store = store
+	}
+	if *summaryTTL > 0 {
+		env.Store = NewCachedStore(env.Store, *summaryTTL)
+	}
+	stopCleanup := make(chan struct{})
+	var cleanup sync.WaitGroup
+	cleanup.Add(1)
+	go func() {
+		defer cleanup.Done()
+		CleanupTokens(*tokenCleanup, stopCleanup)
+	}()
+
+	errs := make(chan error, 2)
+	servers, err := Serve(router, errs)
 	if err != nil {
 		env.Log.Fatal(err.Error())
 	}
 
-	portSpec := fmt.Sprintf(":%d", *port)
-	env.Log.Info("Listening on " + portSpec)
-	env.Log.Fatal(http.ListenAndServe(portSpec, router).Error())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		env.Log.Fatal(err.Error())
+	case sig := <-signals:
+		env.Log.Info("shutting down", zap.String("signal", sig.String()))
+	}
+	// a second signal kills the process without waiting
+	signal.Stop(signals)
+
+	Shutdown(servers)
+	// a cleanup already running finishes first
+	close(stopCleanup)
+	cleanup.Wait()
+	// after the servers, so votes in flight get saved
+	if err := env.Store.Close(); err != nil {
+		env.Log.Error("store close failed", zap.Error(err))
+	}
+	env.Log.Info("shut down")
+	os.Stdout.Sync()
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/uber-go/zap"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	env.Log = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+	os.Exit(m.Run())
+}
+
+// resetEnv gives a test empty stores and signing keys of its own.
+func resetEnv(t *testing.T) {
+	env.Store = NewMemStore()
+	env.Events = NewHub()
+	env.Limits = NewMemLimitStore()
+	t.Cleanup(env.Events.Close)
+
+	var err error
+	if tokenAuth, err = LoadTokenAuth(t.TempDir(), "test"); err != nil {
+		t.Fatal(err)
+	}
+}
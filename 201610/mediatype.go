@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"html/template"
+	"io"
 	"mime"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -11,6 +17,7 @@ import (
 const (
 	FormURL = "application/x-www-form-urlencoded"
 	JSON    = "application/json"
+	HTML    = "text/html"
 )
 
 func RequestType(r *http.Request) (mediaType string, err error) {
@@ -24,13 +31,159 @@ func RequestType(r *http.Request) (mediaType string, err error) {
 	return mediaType, nil
 }
 
+// AcceptType picks JSON or HTML for the response, whichever the Accept
+// header gives the higher q value, or lists first if they tie. Without an
+// Accept header, or with only a wildcard, JSON requests get JSON back and
+// everything else gets HTML. An Accept header that rules out both is an error.
+func AcceptType(r *http.Request) (string, error) {
+	fallback := HTML
+	if inType, _ := RequestType(r); inType == JSON {
+		fallback = JSON
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return fallback, nil
+	}
+
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		var respType string
+		switch mediaType {
+		case JSON, "application/*":
+			respType = JSON
+		case HTML, "text/*":
+			respType = HTML
+		case "*/*":
+			respType = fallback
+		}
+		if respType != "" && q > bestQ {
+			best, bestQ = respType, q
+		}
+	}
+	if best == "" {
+		return "", errors.Errorf("can't satisfy Accept: %s", accept)
+	}
+	return best, nil
+}
+
+// ResponseType returns what AcceptChecks picked for the response.
+func ResponseType(r *http.Request) string {
+	if respType, ok := r.Context().Value("responseType").(string); ok {
+		return respType
+	}
+	if respType, err := AcceptType(r); err == nil {
+		return respType
+	}
+	return HTML
+}
+
+// AcceptChecks is a middleware that stores the negotiated response type in
+// the request context as "responseType".
+func AcceptChecks(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		respType, err := AcceptType(r)
+		if err != nil {
+			r = r.WithContext(context.WithValue(r.Context(), "responseType", HTML))
+			e := &Error{Code: http.StatusNotAcceptable, Message: err}
+			e.Write(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), "responseType", respType))
+		w.Header().Add("Vary", "Accept")
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// Respond finishes off a successful request. Browsers are redirected to
+// location, API clients get code and v as JSON. A 201 also gets location as
+// its Location header, and v may be nil for a response with no body.
+func Respond(w http.ResponseWriter, r *http.Request, code int, v interface{}, location string) {
+	if ResponseType(r) != JSON {
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	if code == http.StatusCreated {
+		w.Header().Set("Location", location)
+	}
+	WriteJSON(w, r, code, v)
+}
+
+// WriteJSON sends v to the client as JSON, whatever it asked for.
+func WriteJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	if v == nil {
+		w.WriteHeader(code)
+		return
+	}
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "response marshal failed"),
+		}
+		e.Write(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", JSON)
+	w.WriteHeader(code)
+	w.Write(jsonBytes)
+}
+
+// templateFuncs are placeholders, for parsing. renderTemplate replaces them
+// with ones for the request:
+//
+//	csrfField  a hidden input with the CSRF token, for inside forms
+//	cspNonce   the nonce script tags need to get past the CSP
+var templateFuncs = template.FuncMap{
+	"csrfField": func() template.HTML { return "" },
+	"cspNonce":  func() string { return "" },
+}
+
+// parseTemplate is template.ParseFiles, for templates renderTemplate
+// executes.
+func parseTemplate(file string) *template.Template {
+	return template.Must(template.New(filepath.Base(file)).Funcs(templateFuncs).ParseFiles(file))
+}
+
+// renderTemplate executes t for r. Every template goes through here, so
+// every form gets its CSRF token, and every script its nonce.
+func renderTemplate(w io.Writer, r *http.Request, t *template.Template, data interface{}) error {
+	// executing t would stop it being cloned for the next request
+	t, err := t.Clone()
+	if err != nil {
+		return err
+	}
+	token, nonce := CSRFToken(r), CSPNonce(r)
+	t.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfField +
+				`" value="` + template.HTMLEscapeString(token) + `" />`)
+		},
+		"cspNonce": func() string { return nonce },
+	})
+	return t.Execute(w, data)
+}
+
 func ContentTypeChecks(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		var inType string
 		var err error
 		var e *Error
 
-		if r.Method == "POST" {
+		switch r.Method {
+		case "POST", "PUT", "PATCH":
 			if inType, err = RequestType(r); err != nil {
 				e = &Error{Code: http.StatusBadRequest, Message: err}
 				e.Write(w, r)
@@ -40,7 +193,7 @@ func ContentTypeChecks(next http.Handler) http.Handler {
 			if inType == "" {
 				e = &Error{
 					Code:    http.StatusBadRequest,
-					Message: errors.New("POST requests require a content-type"),
+					Message: errors.Errorf("%s requests require a content-type", r.Method),
 				}
 				e.Write(w, r)
 				return
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MemStore keeps everything in memory, which is handy for tests and demos.
+// Records are stored marshaled, same as in bolt, so callers never share
+// pointers with the store.
+type MemStore struct {
+	mu           sync.RWMutex
+	users        map[string][]byte
+	polls        map[string][]byte
+	refresh      map[string][]byte
+	revoked      map[string]time.Time
+	revokedUsers map[string]userRevocation
+	invitations  map[string][]byte
+	resets       map[string][]byte
+	mfa          map[string][]byte
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		users:        map[string][]byte{},
+		polls:        map[string][]byte{},
+		refresh:      map[string][]byte{},
+		revoked:      map[string]time.Time{},
+		revokedUsers: map[string]userRevocation{},
+		invitations:  map[string][]byte{},
+		resets:       map[string][]byte{},
+		mfa:          map[string][]byte{},
+	}
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
+
+func (s *MemStore) UserByName(name string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.users[name]
+	if !ok {
+		return nil, ErrNoSuchUser
+	}
+	user := &User{}
+	if err := json.Unmarshal(val, user); err != nil {
+		return nil, errors.Wrap(err, "user unmarshal failed")
+	}
+	return user, nil
+}
+
+func (s *MemStore) CreateUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createUser(u)
+}
+
+// createUser is CreateUser for callers holding the lock.
+func (s *MemStore) createUser(u *User) error {
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		return errors.Wrap(err, "user marshal failed")
+	}
+	if _, ok := s.users[u.Name]; ok {
+		return ErrUserExists
+	}
+	s.users[u.Name] = jsonBytes
+	return nil
+}
+
+func (s *MemStore) UpdateUser(u *User) error {
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
+		return errors.Wrap(err, "user marshal failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.Name]; !ok {
+		return ErrNoSuchUser
+	}
+	s.users[u.Name] = jsonBytes
+	return nil
+}
+
+func (s *MemStore) AllUsers() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]*User, 0, len(s.users))
+	for _, val := range s.users {
+		user := &User{}
+		if err := json.Unmarshal(val, user); err != nil {
+			return nil, errors.Wrap(err, "user unmarshal failed")
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (s *MemStore) CreateFirstAdmin(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, val := range s.users {
+		var user User
+		if err := json.Unmarshal(val, &user); err != nil {
+			return errors.Wrap(err, "user unmarshal failed")
+		}
+		if user.Role == RoleAdmin {
+			return ErrAdminExists
+		}
+	}
+	return s.createUser(u)
+}
+
+func (s *MemStore) PollByName(name string) (*Poll, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.polls[name]
+	if !ok {
+		return nil, ErrNoSuchPoll
+	}
+	poll := &Poll{}
+	if err := json.Unmarshal(val, poll); err != nil {
+		return nil, errors.Wrap(err, "poll unmarshal failed")
+	}
+	return poll, nil
+}
+
+func (s *MemStore) AllPolls() (map[string]Poll, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	polls := map[string]Poll{}
+	for name, val := range s.polls {
+		var poll Poll
+		if err := json.Unmarshal(val, &poll); err != nil {
+			return nil, errors.Wrap(err, "poll unmarshal failed")
+		}
+		polls[name] = poll
+	}
+	return polls, nil
+}
+
+func (s *MemStore) ListPolls(q *PollQuery) (*PollPage, error) {
+	polls, err := s.AllPolls()
+	if err != nil {
+		return nil, err
+	}
+	return q.Page(polls), nil
+}
+
+func (s *MemStore) CreatePoll(p *Poll) error {
+	jsonBytes, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "poll marshal failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.polls[p.Name]; ok {
+		return ErrPollExists
+	}
+	s.polls[p.Name] = jsonBytes
+	return nil
+}
+
+func (s *MemStore) UpdatePoll(p *Poll) error {
+	return s.updatePoll(p.Name, func(poll *Poll) error {
+		if err := p.CheckEdit(poll, len(poll.Ballots) > 0); err != nil {
+			return err
+		}
+		updated := *p
+		updated.Options = poll.Options
+		updated.Ballots = poll.Ballots
+		updated.SetOptions(p.Options)
+		updated.Recount()
+		*poll = updated
+		return nil
+	})
+}
+
+func (s *MemStore) DeletePoll(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.polls[name]; !ok {
+		return ErrNoSuchPoll
+	}
+	delete(s.polls, name)
+	return nil
+}
+
+func (s *MemStore) updatePoll(name string, fn func(p *Poll) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.polls[name]
+	if !ok {
+		return ErrNoSuchPoll
+	}
+	poll := &Poll{}
+	if err := json.Unmarshal(val, poll); err != nil {
+		return errors.Wrap(err, "poll unmarshal failed")
+	}
+	if err := fn(poll); err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(poll)
+	if err != nil {
+		return errors.Wrap(err, "poll marshal failed")
+	}
+	s.polls[name] = jsonBytes
+	return nil
+}
+
+func (s *MemStore) AddOption(pollName string, o *PollOption) error {
+	return s.updatePoll(pollName, func(poll *Poll) error {
+		if err := poll.CheckOpen(time.Now()); err != nil {
+			return err
+		}
+		poll.AddOption(o.Response)
+		return nil
+	})
+}
+
+func (s *MemStore) Vote(pollName, userName string, choices []string) error {
+	return s.updatePoll(pollName, func(poll *Poll) error {
+		if err := poll.CheckOpen(time.Now()); err != nil {
+			return err
+		}
+		if err := poll.CheckBallot(choices); err != nil {
+			return err
+		}
+		poll.Vote(poll.VoterKey(userName), choices)
+		return nil
+	})
+}
+
+func (s *MemStore) CreateRefreshToken(t *RefreshToken) error {
+	jsonBytes, err := json.Marshal(t)
+	if err != nil {
+		return errors.Wrap(err, "refresh token marshal failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh[t.ID] = jsonBytes
+	return nil
+}
+
+func (s *MemStore) UseRefreshToken(id string, now time.Time) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.refresh[id]
+	if !ok {
+		return nil, ErrNoSuchToken
+	}
+	t := &RefreshToken{}
+	if err := json.Unmarshal(val, t); err != nil {
+		return nil, errors.Wrap(err, "refresh token unmarshal failed")
+	}
+	if t.UsedAt != nil {
+		return t, nil
+	}
+	used := *t
+	used.UsedAt = &now
+	jsonBytes, err := json.Marshal(&used)
+	if err != nil {
+		return nil, errors.Wrap(err, "refresh token marshal failed")
+	}
+	s.refresh[id] = jsonBytes
+	return t, nil
+}
+
+// deleteRefreshTokens deletes the refresh tokens del picks out. s.mu must
+// be held.
+func (s *MemStore) deleteRefreshTokens(del func(t *RefreshToken) bool) (int, error) {
+	n := 0
+	for id, val := range s.refresh {
+		t := &RefreshToken{}
+		if err := json.Unmarshal(val, t); err != nil {
+			return n, errors.Wrap(err, "refresh token unmarshal failed")
+		}
+		if del(t) {
+			delete(s.refresh, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemStore) DeleteSession(session string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.deleteRefreshTokens(func(t *RefreshToken) bool {
+		return t.Session == session
+	})
+	return err
+}
+
+func (s *MemStore) RevokeToken(id string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[id] = expiresAt
+	return nil
+}
+
+func (s *MemStore) TokenRevoked(id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.revoked[id]
+	return ok, nil
+}
+
+func (s *MemStore) RevokeUserTokens(userName string, now, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.deleteRefreshTokens(func(t *RefreshToken) bool {
+		return t.User == userName
+	})
+	if err != nil {
+		return err
+	}
+	s.revokedUsers[userName] = userRevocation{At: now, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (s *MemStore) UserTokensRevokedAt(userName string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revokedUsers[userName].At, nil
+}
+
+func (s *MemStore) DeleteExpiredTokens(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.deleteRefreshTokens(func(t *RefreshToken) bool {
+		return now.After(t.ExpiresAt)
+	})
+	if err != nil {
+		return n, err
+	}
+	for id, expiresAt := range s.revoked {
+		if now.After(expiresAt) {
+			delete(s.revoked, id)
+			n++
+		}
+	}
+	for name, rev := range s.revokedUsers {
+		if now.After(rev.ExpiresAt) {
+			delete(s.revokedUsers, name)
+			n++
+		}
+	}
+	for id, val := range s.resets {
+		reset := &PasswordReset{}
+		if err := json.Unmarshal(val, reset); err != nil {
+			return n, errors.Wrap(err, "password reset unmarshal failed")
+		}
+		if now.After(reset.ExpiresAt) {
+			delete(s.resets, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemStore) CreateInvitation(inv *Invitation) error {
+	jsonBytes, err := json.Marshal(inv)
+	if err != nil {
+		return errors.Wrap(err, "invitation marshal failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invitations[inv.ID] = jsonBytes
+	return nil
+}
+
+func (s *MemStore) Invitations() ([]*Invitation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	invitations := make([]*Invitation, 0, len(s.invitations))
+	for _, val := range s.invitations {
+		inv := &Invitation{}
+		if err := json.Unmarshal(val, inv); err != nil {
+			return nil, errors.Wrap(err, "invitation unmarshal failed")
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, nil
+}
+
+func (s *MemStore) DeleteInvitation(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.invitations[id]; !ok {
+		return ErrNoSuchInvitation
+	}
+	delete(s.invitations, id)
+	return nil
+}
+
+func (s *MemStore) CreateInvitedUser(u *User, invitationID string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.invitations[invitationID]
+	if !ok {
+		return ErrNoSuchInvitation
+	}
+	inv := &Invitation{}
+	if err := json.Unmarshal(val, inv); err != nil {
+		return errors.Wrap(err, "invitation unmarshal failed")
+	}
+	if !inv.Admits(u.Name, now) {
+		return ErrNoSuchInvitation
+	}
+	if err := s.createUser(u); err != nil {
+		return err
+	}
+	delete(s.invitations, invitationID)
+	return nil
+}
+
+func (s *MemStore) CreatePasswordReset(reset *PasswordReset) error {
+	jsonBytes, err := json.Marshal(reset)
+	if err != nil {
+		return errors.Wrap(err, "password reset marshal failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resets[reset.ID] = jsonBytes
+	return nil
+}
+
+func (s *MemStore) ResetPassword(resetID, userName, pass string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.resets[resetID]
+	if !ok {
+		return ErrNoSuchReset
+	}
+	reset := &PasswordReset{}
+	if err := json.Unmarshal(val, reset); err != nil {
+		return errors.Wrap(err, "password reset unmarshal failed")
+	}
+	if !reset.Admits(userName, now) {
+		return ErrNoSuchReset
+	}
+
+	val, ok = s.users[userName]
+	if !ok {
+		return ErrNoSuchUser
+	}
+	user := &User{}
+	if err := json.Unmarshal(val, user); err != nil {
+		return errors.Wrap(err, "user unmarshal failed")
+	}
+	user.Pass = pass
+	jsonBytes, err := json.Marshal(user)
+	if err != nil {
+		return errors.Wrap(err, "user marshal failed")
+	}
+	s.users[userName] = jsonBytes
+
+	for id, val := range s.resets {
+		other := &PasswordReset{}
+		if err = json.Unmarshal(val, other); err != nil {
+			return errors.Wrap(err, "password reset unmarshal failed")
+		}
+		if other.User == userName {
+			delete(s.resets, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) MFAByUser(userName string) (*MFA, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.mfa[userName]
+	if !ok {
+		return nil, ErrNoSuchMFA
+	}
+	m := &MFA{}
+	if err := json.Unmarshal(val, m); err != nil {
+		return nil, errors.Wrap(err, "mfa unmarshal failed")
+	}
+	return m, nil
+}
+
+func (s *MemStore) SaveMFA(m *MFA) error {
+	jsonBytes, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "mfa marshal failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mfa[m.User] = jsonBytes
+	return nil
+}
+
+func (s *MemStore) DeleteMFA(userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mfa[userName]; !ok {
+		return ErrNoSuchMFA
+	}
+	delete(s.mfa, userName)
+	return nil
+}
+
+func (s *MemStore) UseMFA(userName, code, tokenID string, now, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.revoked[tokenID]; ok {
+		return ErrTokenRevoked
+	}
+	if val, ok := s.mfa[userName]; ok {
+		m := &MFA{}
+		if err := json.Unmarshal(val, m); err != nil {
+			return errors.Wrap(err, "mfa unmarshal failed")
+		}
+		if m.Enabled {
+			if !m.Use(code, now) {
+				return ErrWrongCode
+			}
+			jsonBytes, err := json.Marshal(m)
+			if err != nil {
+				return errors.Wrap(err, "mfa marshal failed")
+			}
+			s.mfa[userName] = jsonBytes
+		}
+	}
+	s.revoked[tokenID] = expiresAt
+	return nil
+}
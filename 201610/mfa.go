@@ -0,0 +1,652 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goware/jwtauth"
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+)
+
+// Codes are RFC 6238 TOTP with the parameters authenticator apps assume:
+// SHA-1, six digits, every 30 seconds. A step either side is allowed for
+// clocks that are a little off.
+const (
+	totpPeriod  = 30
+	totpDigits  = 6
+	totpModulus = 1000000 // 10^totpDigits
+	totpSkew    = 1
+)
+
+const (
+	// mfaPendingLifetime is how long there is to enter a code after the
+	// password.
+	mfaPendingLifetime = 5 * time.Minute
+	recoveryCodeCount  = 10
+)
+
+var mfaPostMax = flag.Int64("mfapostmax", 1024, "largest two-factor form or JSON body")
+
+const (
+	mfaCookie = "mfa"
+	mfaIssuer = "dengo"
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ErrWrongCode is a code that was never good, or has been used already.
+var ErrWrongCode = errors.New("Code is wrong")
+
+// MFA is a user's two-factor authentication. It's set up but not Enabled
+// until the user has entered a code from it, so a mistyped secret can't
+// lock them out. Recovery codes are stored hashed, and each works once.
+type MFA struct {
+	User          string
+	Secret        string
+	Enabled       bool
+	RecoveryCodes []string
+	// LastStep is the time step of the last code used, which can't be used
+	// again.
+	LastStep int64
+}
+
+// MFASetup is what a user puts in their authenticator app: the URI, as a
+// link or QR code, or the secret by hand.
+type MFASetup struct {
+	Secret string
+	URI    string
+}
+
+// MFAChallenge is what logging in gets you when a second factor is needed.
+// The token only works for sending the code.
+type MFAChallenge struct {
+	MFAToken  string
+	ExpiresAt time.Time
+}
+
+// MFACode is a code from an authenticator app, or a recovery code. Logins
+// send the MFAToken from their challenge along with it.
+type MFACode struct {
+	MFAToken string `json:",omitempty"`
+	Code     string
+}
+
+// RecoveryCodes are shown once, when two-factor authentication is turned
+// on.
+type RecoveryCodes struct {
+	RecoveryCodes []string
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := b32.DecodeString(secret)
+	if err != nil {
+		return "", errors.Wrap(err, "mfa secret decode failed")
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%totpModulus), nil
+}
+
+// checkTOTP looks for code among the ones around now, and returns its time
+// step. Steps at or before LastStep don't count.
+func (m *MFA) checkTOTP(code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= m.LastStep {
+			continue
+		}
+		want, err := totpCode(m.Secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeCode drops what people tend to type around codes.
+func normalizeCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// Use reports whether code is good for m at now, using it up. Stores call
+// it in the transaction that saves m, so a code can't be used twice.
+func (m *MFA) Use(code string, now time.Time) bool {
+	code = normalizeCode(code)
+	if step, ok := m.checkTOTP(code, now); ok {
+		m.LastStep = step
+		return true
+	}
+	hash := hashToken(code)
+	for i, rc := range m.RecoveryCodes {
+		if hmac.Equal([]byte(rc), []byte(hash)) {
+			m.RecoveryCodes = append(m.RecoveryCodes[:i], m.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// URI is an otpauth:// URI, the format authenticator apps read from QR
+// codes.
+func (m *MFA) URI() string {
+	label := url.PathEscape(mfaIssuer + ":" + m.User)
+	v := url.Values{
+		"secret":    {m.Secret},
+		"issuer":    {mfaIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// recoveryCode is ten letters and digits, shown split in two.
+func recoveryCode() (string, error) {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "random read failed")
+	}
+	for i := range buf {
+		buf[i] = alphabet[int(buf[i])%len(alphabet)]
+	}
+	return string(buf[:5]) + "-" + string(buf[5:]), nil
+}
+
+// MFAByUser returns userName's settings, or nil if they haven't any.
+func MFAByUser(userName string) (*MFA, *Error) {
+	m, err := env.Store.MFAByUser(userName)
+	if errors.Cause(err) == ErrNoSuchMFA {
+		return nil, nil
+	} else if err != nil {
+		return nil, StoreError(err)
+	}
+	return m, nil
+}
+
+// mfaSelf makes sure whoever's logged in is userName: nobody sets up a
+// second factor for anyone else.
+func mfaSelf(r *http.Request, userName string) *Error {
+	if JWTUser(r) != userName {
+		return &Error{Code: http.StatusForbidden, Message: errors.New("users can only set up their own two-factor authentication")}
+	}
+	return nil
+}
+
+// StartMFA makes a new secret for userName, replacing one they haven't
+// confirmed yet.
+func StartMFA(userName string) (*MFASetup, *Error) {
+	m, e := MFAByUser(userName)
+	if e != nil {
+		return nil, e
+	}
+	if m != nil && m.Enabled {
+		return nil, &Error{Code: http.StatusConflict, Message: errors.New("two-factor authentication is already on")}
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Message: errors.Wrap(err, "random read failed")}
+	}
+	m = &MFA{User: userName, Secret: b32.EncodeToString(key)}
+	if err := env.Store.SaveMFA(m); err != nil {
+		return nil, StoreError(err)
+	}
+	return &MFASetup{Secret: m.Secret, URI: m.URI()}, nil
+}
+
+// ConfirmMFA turns on two-factor authentication for userName once they've
+// entered a code from the secret StartMFA gave them, and returns their
+// recovery codes.
+func ConfirmMFA(userName, code string) (*RecoveryCodes, *Error) {
+	m, e := MFAByUser(userName)
+	if e != nil {
+		return nil, e
+	}
+	if m == nil {
+		return nil, &Error{Code: http.StatusNotFound, Message: ErrNoSuchMFA}
+	} else if m.Enabled {
+		return nil, &Error{Code: http.StatusConflict, Message: errors.New("two-factor authentication is already on")}
+	}
+	step, ok := m.checkTOTP(normalizeCode(code), time.Now())
+	if !ok {
+		return nil, &Error{Code: http.StatusBadRequest, Message: errors.New("Code is wrong, check the clock on your device")}
+	}
+
+	codes := &RecoveryCodes{}
+	m.RecoveryCodes = nil
+	for i := 0; i < recoveryCodeCount; i++ {
+		rc, err := recoveryCode()
+		if err != nil {
+			return nil, &Error{Code: http.StatusInternalServerError, Message: err}
+		}
+		codes.RecoveryCodes = append(codes.RecoveryCodes, rc)
+		m.RecoveryCodes = append(m.RecoveryCodes, hashToken(normalizeCode(rc)))
+	}
+	m.Enabled, m.LastStep = true, step
+	if err := env.Store.SaveMFA(m); err != nil {
+		return nil, StoreError(err)
+	}
+	return codes, nil
+}
+
+// DisableMFA turns off userName's two-factor authentication. They have to
+// enter a code to do it themselves; admins can do it for someone who has
+// lost their device and their recovery codes.
+func DisableMFA(r *http.Request, userName, code string) *Error {
+	if JWTUser(r) != userName {
+		if !HasRole(JWTRole(r), RoleAdmin) {
+			return &Error{Code: http.StatusForbidden, Message: errors.New("users can only turn off their own two-factor authentication")}
+		}
+	} else {
+		m, e := MFAByUser(userName)
+		if e != nil {
+			return e
+		}
+		if m != nil && m.Enabled {
+			if !m.Use(code, time.Now()) {
+				return &Error{Code: http.StatusBadRequest, Message: ErrWrongCode}
+			}
+		}
+	}
+	if err := env.Store.DeleteMFA(userName); err != nil {
+		return StoreError(err)
+	}
+	return nil
+}
+
+// MFAChallengeFor returns what userName needs to finish logging in, or nil
+// if their password was enough.
+func MFAChallengeFor(userName string) (*MFAChallenge, *Error) {
+	m, e := MFAByUser(userName)
+	if e != nil || m == nil || !m.Enabled {
+		return nil, e
+	}
+	jti, err := randomString(16)
+	if err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Message: err}
+	}
+
+	now := time.Now()
+	c := &MFAChallenge{ExpiresAt: now.Add(mfaPendingLifetime)}
+	claims := setIssuedAt(jwtauth.Claims{"user": userName, "jti": jti, "mfa": "pending"}.
+		SetExpiry(c.ExpiresAt), now)
+	if _, c.MFAToken, err = tokenAuth.Encode(claims); err != nil {
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "jwt encoding failed"),
+		}
+		return nil, e
+	}
+	return c, nil
+}
+
+// CompleteMFA checks the code sent with an MFA token, and returns who it
+// logs in. Wrong codes count towards login lockouts, and the token works
+// only once.
+func CompleteMFA(r *http.Request, c *MFACode) (string, *Error) {
+	token, err := tokenAuth.verify(c.MFAToken)
+	if err == nil && tokenClaim(token, "mfa") != "pending" {
+		err = jwtauth.ErrUnauthorized
+	}
+	if err == nil {
+		err = CheckRevoked(token)
+	}
+	if err != nil {
+		return "", &Error{Code: http.StatusUnauthorized, Message: err}
+	}
+
+	userName := tokenClaim(token, "user")
+	keys := loginKeys(userName, r)
+	if e := loginLocked(keys); e != nil {
+		return "", e
+	}
+	// the code and the token are used up together, so two posts of them
+	// can't both log in
+	err = env.Store.UseMFA(userName, c.Code, tokenClaim(token, "jti"), time.Now(), timeClaim(token, "exp"))
+	switch errors.Cause(err) {
+	case nil:
+	case ErrWrongCode:
+		loginFailed(keys)
+		return "", &Error{Code: http.StatusUnauthorized, Message: err}
+	case ErrTokenRevoked:
+		return "", &Error{Code: http.StatusUnauthorized, Message: err}
+	default:
+		return "", StoreError(err)
+	}
+	env.Limits.Reset(keys[0])
+	return userName, nil
+}
+
+func (c *MFACode) Validate() (*MFACode, *Error) {
+	if len(c.Code) == 0 {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("Code is required")}
+		return nil, e
+	}
+	return c, nil
+}
+
+func MFACodeFromForm(r *http.Request) (*MFACode, *Error) {
+	var err error
+	code := &MFACode{}
+
+	if err = r.ParseForm(); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "ParseForm failed"),
+		}
+		return nil, e
+	}
+
+	err = env.Form.Decode(code, r.PostForm)
+	if err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "Decode failed"),
+		}
+		return nil, e
+	}
+
+	return code.Validate()
+}
+
+func MFACodeFromJSON(r io.Reader) (*MFACode, *Error) {
+	code := &MFACode{}
+	if err := json.NewDecoder(r).Decode(code); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "json decoding failed"),
+		}
+		return nil, e
+	}
+	return code.Validate()
+}
+
+// mfaCodeFromRequest reads an MFACode from a form or JSON.
+func mfaCodeFromRequest(r *http.Request) (*MFACode, *Error) {
+	inType := r.Context().Value("content-type").(string)
+	switch {
+	case inType == FormURL:
+		return MFACodeFromForm(r)
+	case inType == JSON:
+		return MFACodeFromJSON(r.Body)
+	}
+	e := &Error{
+		Code:    http.StatusUnsupportedMediaType,
+		Message: errors.New("supported types are form, json"),
+	}
+	return nil, e
+}
+
+// SetMFACookie has a browser hold on to its challenge until the code is
+// entered.
+func (c *MFAChallenge) SetMFACookie(w http.ResponseWriter) {
+	http.SetCookie(w, newCookie(mfaCookie, c.MFAToken, c.ExpiresAt))
+}
+
+type MFAModel struct {
+	Username string
+	Enabled  bool
+	// Remaining is how many recovery codes are left.
+	Remaining int
+	// Setup is there while a new secret waits to be confirmed, and
+	// RecoveryCodes right after it has been.
+	Setup         *MFASetup
+	RecoveryCodes []string
+}
+
+var mfaTemplate, mfaLoginTemplate *template.Template
+
+func init() {
+	mfaTemplate = parseTemplate("templates/mfa.html")
+	mfaLoginTemplate = parseTemplate("templates/mfalogin.html")
+}
+
+// renderMFA shows userName's two-factor authentication, along with
+// whatever was just made in model.
+func renderMFA(w http.ResponseWriter, r *http.Request, model *MFAModel) {
+	m, e := MFAByUser(model.Username)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if m != nil {
+		model.Enabled, model.Remaining = m.Enabled, len(m.RecoveryCodes)
+		if !m.Enabled && model.Setup == nil {
+			model.Setup = &MFASetup{Secret: m.Secret, URI: m.URI()}
+		}
+	}
+
+	if ResponseType(r) == JSON {
+		WriteJSON(w, r, http.StatusOK, model)
+		return
+	}
+	if err := renderTemplate(w, r, mfaTemplate, model); err != nil {
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "executing mfa template"),
+		}
+		e.Write(w, r)
+		return
+	}
+}
+
+// MFAGet shows whether two-factor authentication is on, and the way to
+// turn it on or off.
+func MFAGet(w http.ResponseWriter, r *http.Request) {
+	userName := chi.URLParam(r, "username")
+	if e := mfaSelf(r, userName); e != nil {
+		e.Write(w, r)
+		return
+	}
+	renderMFA(w, r, &MFAModel{Username: userName})
+}
+
+// MFAPost starts setting up two-factor authentication.
+func MFAPost(w http.ResponseWriter, r *http.Request) {
+	userName := chi.URLParam(r, "username")
+	if e := mfaSelf(r, userName); e != nil {
+		e.Write(w, r)
+		return
+	}
+	setup, e := StartMFA(userName)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	renderMFA(w, r, &MFAModel{Username: userName, Setup: setup})
+}
+
+// MFAConfirmPost turns two-factor authentication on, and shows the
+// recovery codes.
+func MFAConfirmPost(w http.ResponseWriter, r *http.Request) {
+	userName := chi.URLParam(r, "username")
+	if e := mfaSelf(r, userName); e != nil {
+		e.Write(w, r)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, *mfaPostMax)
+	defer r.Body.Close()
+
+	code, e := mfaCodeFromRequest(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	codes, e := ConfirmMFA(userName, code.Code)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	// the codes are gone after this, so no redirect
+	renderMFA(w, r, &MFAModel{Username: userName, RecoveryCodes: codes.RecoveryCodes})
+}
+
+// MFADeletePost is DELETE /api/v1/users/:username/mfa for forms.
+func MFADeletePost(w http.ResponseWriter, r *http.Request) {
+	userName := chi.URLParam(r, "username")
+	r.Body = http.MaxBytesReader(w, r.Body, *mfaPostMax)
+	defer r.Body.Close()
+
+	code, e := mfaCodeFromRequest(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if e = DisableMFA(r, userName, code.Code); e != nil {
+		e.Write(w, r)
+		return
+	}
+	Respond(w, r, http.StatusNoContent, nil, "/users/"+url.PathEscape(userName)+"/mfa")
+}
+
+// LoginMFAGet asks for the code after the password, when there's a
+// challenge waiting.
+func LoginMFAGet(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(mfaCookie); err != nil {
+		w.Header().Set("Location", "/login")
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	if err := renderTemplate(w, r, mfaLoginTemplate, nil); err != nil {
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "executing mfa login template"),
+		}
+		e.Write(w, r)
+		return
+	}
+}
+
+// LoginMFAPost finishes logging in with a code. Browsers send the token
+// back in its cookie.
+func LoginMFAPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *mfaPostMax)
+	defer r.Body.Close()
+
+	code, e := mfaCodeFromRequest(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if code.MFAToken == "" {
+		if cookie, err := r.Cookie(mfaCookie); err == nil {
+			code.MFAToken = cookie.Value
+		}
+	}
+	userName, e := CompleteMFA(r, code)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	clearCookie(w, mfaCookie)
+
+	user := &User{Name: userName}
+	if e = user.SetLoggedIn(w, r); e != nil {
+		e.Write(w, r)
+		return
+	}
+	Respond(w, r, http.StatusOK, user, "/")
+}
+
+func APISessionsMFAPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *mfaPostMax)
+	defer r.Body.Close()
+
+	code, e := MFACodeFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	userName, e := CompleteMFA(r, code)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	session, e := NewSession(userName)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusCreated, session)
+}
+
+func APIMFAPost(w http.ResponseWriter, r *http.Request) {
+	userName := chi.URLParam(r, "username")
+	if e := mfaSelf(r, userName); e != nil {
+		e.Write(w, r)
+		return
+	}
+	setup, e := StartMFA(userName)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusCreated, setup)
+}
+
+func APIMFAPut(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *mfaPostMax)
+	defer r.Body.Close()
+
+	userName := chi.URLParam(r, "username")
+	if e := mfaSelf(r, userName); e != nil {
+		e.Write(w, r)
+		return
+	}
+	code, e := MFACodeFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	codes, e := ConfirmMFA(userName, code.Code)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, codes)
+}
+
+// APIMFADelete takes the code in the body, which admins can leave out.
+func APIMFADelete(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *mfaPostMax)
+	defer r.Body.Close()
+
+	code := &MFACode{}
+	if err := json.NewDecoder(r.Body).Decode(code); err != nil && err != io.EOF {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "json decoding failed"),
+		}
+		e.Write(w, r)
+		return
+	}
+	if e := DisableMFA(r, chi.URLParam(r, "username"), code.Code); e != nil {
+		e.Write(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
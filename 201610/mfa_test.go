@@ -0,0 +1,179 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The SHA-1 vectors from RFC 6238 Appendix B. They're eight digits, and
+// codes here are the last six of them.
+func TestTOTPVectors(t *testing.T) {
+	secret := b32.EncodeToString([]byte("12345678901234567890"))
+	for _, tt := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		got, err := totpCode(secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.want[len(tt.want)-totpDigits:]; got != want {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func testMFA() *MFA {
+	return &MFA{User: "alice", Secret: b32.EncodeToString([]byte("12345678901234567890")), Enabled: true}
+}
+
+func codeAt(t *testing.T, m *MFA, step int64) string {
+	code, err := totpCode(m.Secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestMFASkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	for offset := int64(-3); offset <= 3; offset++ {
+		m := testMFA()
+		want := offset >= -totpSkew && offset <= totpSkew
+		if got := m.Use(codeAt(t, m, current+offset), now); got != want {
+			t.Errorf("step %+d: got %t, want %t", offset, got, want)
+		}
+	}
+}
+
+func TestMFAReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	m := testMFA()
+	if !m.Use(codeAt(t, m, current), now) {
+		t.Fatal("first use refused")
+	}
+	if m.LastStep != current {
+		t.Errorf("LastStep %d, want %d", m.LastStep, current)
+	}
+	if m.Use(codeAt(t, m, current), now) {
+		t.Error("same code used twice")
+	}
+	// the step before is within the skew, but older than the one used
+	if m.Use(codeAt(t, m, current-1), now) {
+		t.Error("earlier code used after a later one")
+	}
+	if !m.Use(codeAt(t, m, current+1), now) {
+		t.Error("next code refused")
+	}
+}
+
+func TestMFARecoveryCode(t *testing.T) {
+	m := testMFA()
+	m.RecoveryCodes = []string{hashToken("abcde23456"), hashToken("fghij23456")}
+	now := time.Now()
+	if !m.Use(" ABCDE-23456 ", now) {
+		t.Fatal("recovery code refused")
+	}
+	if m.Use("abcde-23456", now) {
+		t.Error("recovery code used twice")
+	}
+	if len(m.RecoveryCodes) != 1 || m.RecoveryCodes[0] != hashToken("fghij23456") {
+		t.Errorf("left %v", m.RecoveryCodes)
+	}
+	if m.Use("zzzzz-23456", now) {
+		t.Error("made up recovery code accepted")
+	}
+}
+
+// testUseMFA checks that s lets each code and each token log in once, however
+// many logins race for them.
+func testUseMFA(t *testing.T, s Store) {
+	m := testMFA()
+	m.RecoveryCodes = []string{hashToken("abcde23456"), hashToken("fghij23456")}
+	if err := s.SaveMFA(m); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expires := now.Add(mfaPendingLifetime)
+	code := codeAt(t, m, now.Unix()/totpPeriod)
+
+	race := func(codes ...string) []error {
+		errs := make(chan error)
+		for i, code := range codes {
+			token := "token" + strconv.Itoa(i) + code
+			go func(code, token string) { errs <- s.UseMFA("alice", code, token, now, expires) }(code, token)
+		}
+		var got []error
+		for range codes {
+			got = append(got, <-errs)
+		}
+		return got
+	}
+	used := 0
+	for _, err := range race(code, code, code, code) {
+		switch errors.Cause(err) {
+		case nil:
+			used++
+		case ErrWrongCode:
+		default:
+			t.Errorf("same code: %v", err)
+		}
+	}
+	if used != 1 {
+		t.Errorf("same code used %d times", used)
+	}
+
+	for _, err := range race("abcde-23456", "fghij-23456") {
+		if err != nil {
+			t.Errorf("recovery codes: %v", err)
+		}
+	}
+	got, err := s.MFAByUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.RecoveryCodes) != 0 {
+		t.Errorf("%d recovery codes left", len(got.RecoveryCodes))
+	}
+	if err = s.UseMFA("alice", "abcde-23456", "later", now, expires); errors.Cause(err) != ErrWrongCode {
+		t.Errorf("used recovery code: got %v, want %v", err, ErrWrongCode)
+	}
+
+	// a token goes with the first code sent, right or wrong
+	if err = s.UseMFA("alice", codeAt(t, m, now.Unix()/totpPeriod+1), "token", now, expires); err != nil {
+		t.Fatalf("next code: %v", err)
+	}
+	if err = s.UseMFA("alice", "000000", "token", now, expires); errors.Cause(err) != ErrTokenRevoked {
+		t.Errorf("token again: got %v, want %v", err, ErrTokenRevoked)
+	}
+	revoked, err := s.TokenRevoked("token")
+	if err != nil || !revoked {
+		t.Errorf("token revoked: %t, %v", revoked, err)
+	}
+}
+
+func TestMemStoreUseMFA(t *testing.T) {
+	testUseMFA(t, NewMemStore())
+}
+
+func TestBoltStoreUseMFA(t *testing.T) {
+	s, err := BoltOpen(filepath.Join(t.TempDir(), "bolt.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testUseMFA(t, s)
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+)
+
+// openAPIDoc describes everything APIRouter serves. CheckOpenAPI compares
+// the two when the server starts, so a route can't be added or removed
+// without updating this as well.
+const openAPIDoc = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "dengo polls",
+    "version": "1.0.0",
+    "description": "Create polls and vote in them. Every response is JSON, errors included. Send tokens from POST /sessions as an \"Authorization: Bearer\" header."
+  },
+  "servers": [{"url": "/api/v1"}],
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+    },
+    "parameters": {
+      "pollname": {"name": "pollname", "in": "path", "required": true, "schema": {"type": "string", "pattern": "^\\w+$"}},
+      "username": {"name": "username", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {
+        "description": "Something went wrong; Code repeats the status code.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      },
+      "TooManyRequests": {
+        "description": "Rate limited, or locked out after too many failed logins.",
+        "headers": {"Retry-After": {"description": "Seconds until trying again may work", "schema": {"type": "integer"}}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "Code": {"type": "integer"},
+          "Message": {"type": "string"}
+        }
+      },
+      "User": {
+        "type": "object",
+        "properties": {
+          "Name": {"type": "string"},
+          "Role": {"type": "string", "enum": ["", "moderator", "admin"], "description": "Empty for plain users"},
+          "Disabled": {"type": "boolean"}
+        }
+      },
+      "UserChange": {
+        "type": "object",
+        "properties": {
+          "Role": {"type": "string", "enum": ["", "moderator", "admin"]},
+          "Disabled": {"type": "boolean", "description": "Disabled users can't log in; disabling revokes their tokens"}
+        }
+      },
+      "Signup": {
+        "type": "object",
+        "required": ["Name", "Pass"],
+        "properties": {
+          "Name": {"type": "string", "pattern": "^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$"},
+          "Pass": {"type": "string"},
+          "Invitation": {"type": "string", "description": "Code from an admin's invitation"},
+          "Secret": {"type": "string", "description": "Signs up the first admin instead, while there isn't one"}
+        }
+      },
+      "Invite": {
+        "type": "object",
+        "properties": {
+          "User": {"type": "string", "description": "The only name the invitation may sign up, if set"},
+          "ExpiresIn": {"type": "string", "description": "A duration like \"48h\", at most 720h", "default": "168h"}
+        }
+      },
+      "Invitation": {
+        "type": "object",
+        "properties": {
+          "ID": {"type": "string"},
+          "User": {"type": "string"},
+          "CreatedBy": {"type": "string"},
+          "CreatedAt": {"type": "string", "format": "date-time"},
+          "ExpiresAt": {"type": "string", "format": "date-time"}
+        }
+      },
+      "IssuedInvitation": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Invitation"},
+          {
+            "type": "object",
+            "properties": {
+              "Code": {"type": "string", "description": "Only ever shown here"},
+              "Link": {"type": "string", "description": "The signup page, with the code filled in"}
+            }
+          }
+        ]
+      },
+      "PasswordChange": {
+        "type": "object",
+        "required": ["New"],
+        "properties": {
+          "Old": {"type": "string", "description": "The current password; needs a token for the same user"},
+          "Reset": {"type": "string", "description": "A reset code from an admin, instead of Old"},
+          "New": {"type": "string"}
+        }
+      },
+      "IssuedPasswordReset": {
+        "type": "object",
+        "properties": {
+          "ID": {"type": "string"},
+          "User": {"type": "string"},
+          "CreatedBy": {"type": "string"},
+          "CreatedAt": {"type": "string", "format": "date-time"},
+          "ExpiresAt": {"type": "string", "format": "date-time"},
+          "Code": {"type": "string", "description": "Only ever shown here"},
+          "Link": {"type": "string", "description": "The page for setting a new password, with the code filled in"}
+        }
+      },
+      "Credentials": {
+        "type": "object",
+        "required": ["Name", "Pass"],
+        "properties": {
+          "Name": {"type": "string"},
+          "Pass": {"type": "string"}
+        }
+      },
+      "Session": {
+        "type": "object",
+        "properties": {
+          "Name": {"type": "string"},
+          "Token": {"type": "string", "description": "Access token, for the Authorization header"},
+          "ExpiresAt": {"type": "string", "format": "date-time"},
+          "RefreshToken": {"type": "string", "description": "Gets a new session from POST /sessions/refresh, once"},
+          "RefreshExpiresAt": {"type": "string", "format": "date-time"}
+        }
+      },
+      "MFAChallenge": {
+        "type": "object",
+        "properties": {
+          "MFAToken": {"type": "string", "description": "Send to POST /sessions/mfa with a code; good for nothing else"},
+          "ExpiresAt": {"type": "string", "format": "date-time"}
+        }
+      },
+      "MFACode": {
+        "type": "object",
+        "required": ["Code"],
+        "properties": {
+          "MFAToken": {"type": "string", "description": "From the challenge, when logging in"},
+          "Code": {"type": "string", "description": "From an authenticator app, or a recovery code"}
+        }
+      },
+      "MFASetup": {
+        "type": "object",
+        "properties": {
+          "Secret": {"type": "string", "description": "Base32, for entering by hand"},
+          "URI": {"type": "string", "description": "otpauth:// URI, for a link or QR code"}
+        }
+      },
+      "RecoveryCodes": {
+        "type": "object",
+        "properties": {
+          "RecoveryCodes": {"type": "array", "items": {"type": "string"}, "description": "Each logs in once; only ever shown here"}
+        }
+      },
+      "Refresh": {
+        "type": "object",
+        "required": ["RefreshToken"],
+        "properties": {"RefreshToken": {"type": "string"}}
+      },
+      "PollOption": {
+        "type": "object",
+        "required": ["Response"],
+        "properties": {
+          "Response": {"type": "string"},
+          "Count": {"type": "integer", "readOnly": true},
+          "Votes": {
+            "type": "object",
+            "readOnly": true,
+            "nullable": true,
+            "description": "Who voted for this response, when the poll shows that and you're logged in.",
+            "additionalProperties": {"type": "boolean"}
+          }
+        }
+      },
+      "Poll": {
+        "type": "object",
+        "required": ["Name", "Question"],
+        "properties": {
+          "Name": {"type": "string", "pattern": "^\\w+$"},
+          "Question": {"type": "string"},
+          "Creator": {"type": "string", "readOnly": true},
+          "OpensAt": {"type": "string", "format": "date-time"},
+          "ClosesAt": {"type": "string", "format": "date-time"},
+          "CreatedAt": {"type": "string", "format": "date-time", "readOnly": true},
+          "Method": {"type": "string", "enum": ["", "single", "multi", "approval", "ranked"]},
+          "MaxPicks": {"type": "integer", "description": "How many responses a multi poll's ballots may pick."},
+          "Visibility": {"type": "string", "enum": ["", "public", "anonymous", "hidden"]},
+          "Options": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/PollOption"}},
+          "Ballots": {
+            "type": "object",
+            "readOnly": true,
+            "additionalProperties": {"type": "array", "items": {"type": "string"}}
+          }
+        }
+      },
+      "PollPage": {
+        "type": "object",
+        "properties": {
+          "Polls": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/Poll"}},
+          "Next": {"type": "string", "description": "Pass as after to get the next page. Missing on the last page."}
+        }
+      },
+      "Ballot": {
+        "type": "object",
+        "properties": {
+          "Response": {"type": "string", "description": "Shorthand for a single choice."},
+          "Choices": {"type": "array", "items": {"type": "string"}, "description": "In order of preference for ranked polls."}
+        }
+      },
+      "Ballots": {
+        "type": "object",
+        "description": "Each voter's choices, by name.",
+        "additionalProperties": {"type": "array", "items": {"type": "string"}}
+      },
+      "OptionResult": {
+        "type": "object",
+        "properties": {
+          "Response": {"type": "string"},
+          "Votes": {"type": "integer"},
+          "Percent": {"type": "number"}
+        }
+      },
+      "Round": {
+        "type": "object",
+        "properties": {
+          "Number": {"type": "integer"},
+          "Options": {"type": "array", "items": {"$ref": "#/components/schemas/OptionResult"}},
+          "Eliminated": {"type": "array", "nullable": true, "items": {"type": "string"}},
+          "Exhausted": {"type": "integer"}
+        }
+      },
+      "PollResults": {
+        "type": "object",
+        "properties": {
+          "Name": {"type": "string"},
+          "Question": {"type": "string"},
+          "Method": {"type": "string"},
+          "Options": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/OptionResult"}},
+          "Rounds": {"type": "array", "items": {"$ref": "#/components/schemas/Round"}},
+          "Voters": {"type": "integer"},
+          "Leader": {"type": "string"},
+          "Tie": {"type": "boolean"}
+        }
+      }
+    }
+  },
+  "paths": {
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {"200": {"description": "OpenAPI document", "content": {"application/json": {}}}}
+      }
+    },
+    "/users": {
+      "get": {
+        "summary": "List users by name; admins only",
+        "security": [{"bearer": []}],
+        "responses": {
+          "200": {"description": "Users", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/User"}}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Sign up",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Signup"}}}},
+        "responses": {
+          "201": {"description": "Created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"}
+        }
+      }
+    },
+    "/sessions": {
+      "post": {
+        "summary": "Log in",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Credentials"}}}},
+        "responses": {
+          "201": {"description": "Logged in", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+          "202": {"description": "Password is right, and a code is needed too", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MFAChallenge"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"}
+        }
+      },
+      "delete": {
+        "summary": "Log out, revoking the access token and its refresh token",
+        "security": [{"bearer": []}],
+        "responses": {
+          "204": {"description": "Logged out"},
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/sessions/refresh": {
+      "post": {
+        "summary": "Swap a refresh token for a new session; the old refresh token stops working",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Refresh"}}}},
+        "responses": {
+          "200": {"description": "New session", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/sessions/mfa": {
+      "post": {
+        "summary": "Finish logging in with a code, after POST /sessions asked for one",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MFACode"}}}},
+        "responses": {
+          "201": {"description": "Logged in", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"}
+        }
+      }
+    },
+    "/users/{username}": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "patch": {
+        "summary": "Change a user's role, or disable or enable them; admins only, and not their own account",
+        "security": [{"bearer": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UserChange"}}}},
+        "responses": {
+          "200": {"description": "Changed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/{username}/mfa": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "post": {
+        "summary": "Start setting up two-factor authentication, with a new secret; your own account only",
+        "security": [{"bearer": []}],
+        "responses": {
+          "201": {"description": "Not on until confirmed with PUT", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MFASetup"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Turn two-factor authentication on with a code from the new secret",
+        "security": [{"bearer": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MFACode"}}}},
+        "responses": {
+          "200": {"description": "On", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RecoveryCodes"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Turn two-factor authentication off; with a code for your own account, or by an admin for anyone's",
+        "security": [{"bearer": []}],
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/MFACode"}}}},
+        "responses": {
+          "204": {"description": "Off"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/{username}/password": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "put": {
+        "summary": "Set a new password, with the old one or a reset code; ends every session the user has",
+        "security": [{"bearer": []}, {}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PasswordChange"}}}},
+        "responses": {
+          "204": {"description": "Changed; log in again"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"}
+        }
+      }
+    },
+    "/users/{username}/password-resets": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "post": {
+        "summary": "Issue a code the user can set a new password with, good for a day; admins only",
+        "security": [{"bearer": []}],
+        "responses": {
+          "201": {"description": "Issued", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssuedPasswordReset"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/{username}/sessions": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "delete": {
+        "summary": "Log out everywhere, revoking every token the user has",
+        "security": [{"bearer": []}],
+        "responses": {
+          "204": {"description": "Logged out"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/invitations": {
+      "get": {
+        "summary": "List unused invitations, oldest first; admins only",
+        "security": [{"bearer": []}],
+        "responses": {
+          "200": {"description": "Invitations", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Invitation"}}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Invite someone to sign up; admins only",
+        "security": [{"bearer": []}],
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Invite"}}}},
+        "responses": {
+          "201": {"description": "Invited", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssuedInvitation"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/invitations/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "delete": {
+        "summary": "Withdraw an invitation; admins only",
+        "security": [{"bearer": []}],
+        "responses": {
+          "204": {"description": "Withdrawn"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/polls": {
+      "get": {
+        "summary": "List polls a page at a time",
+        "parameters": [
+          {"name": "sort", "in": "query", "description": "votes and closing change as polls do, so paging through them can skip or repeat a poll that moved; name and newest can't", "schema": {"type": "string", "enum": ["name", "newest", "votes", "closing"]}},
+          {"name": "creator", "in": "query", "schema": {"type": "string"}},
+          {"name": "state", "in": "query", "schema": {"type": "string", "enum": ["open", "closed", "upcoming"]}},
+          {"name": "q", "in": "query", "description": "Text to look for in questions", "schema": {"type": "string"}},
+          {"name": "after", "in": "query", "description": "Next from the previous page", "schema": {"type": "string"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 100, "default": 20}}
+        ],
+        "responses": {
+          "200": {"description": "A page of polls", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PollPage"}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a poll",
+        "security": [{"bearer": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Poll"}}}},
+        "responses": {
+          "201": {"description": "Created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Poll"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"}
+        }
+      }
+    },
+    "/polls/{pollname}": {
+      "parameters": [{"$ref": "#/components/parameters/pollname"}],
+      "get": {
+        "summary": "Show a poll",
+        "responses": {
+          "200": {"description": "The poll", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Poll"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Replace a poll; its creator or a moderator only",
+        "security": [{"bearer": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Poll"}}}},
+        "responses": {
+          "200": {"description": "Updated", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Poll"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "summary": "Change some of a poll's fields; its creator or a moderator only",
+        "security": [{"bearer": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Poll"}}}},
+        "responses": {
+          "200": {"description": "Updated", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Poll"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a poll; its creator or a moderator only",
+        "security": [{"bearer": []}],
+        "responses": {
+          "204": {"description": "Deleted"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/polls/{pollname}/options": {
+      "parameters": [{"$ref": "#/components/parameters/pollname"}],
+      "get": {
+        "summary": "List a poll's responses",
+        "responses": {
+          "200": {"description": "Responses", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PollOption"}}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Add a response to a poll, creator only",
+        "security": [{"bearer": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PollOption"}}}},
+        "responses": {
+          "201": {"description": "Added", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PollOption"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/polls/{pollname}/votes": {
+      "parameters": [{"$ref": "#/components/parameters/pollname"}],
+      "get": {
+        "summary": "Everyone's ballots, for polls that show who voted how",
+        "security": [{"bearer": []}],
+        "responses": {
+          "200": {"description": "Ballots", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ballots"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/polls/{pollname}/votes/{username}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/pollname"},
+        {"$ref": "#/components/parameters/username"}
+      ],
+      "get": {
+        "summary": "One user's ballot; your own is always visible",
+        "security": [{"bearer": []}],
+        "responses": {
+          "200": {"description": "Ballot", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ballot"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Cast or replace your own ballot",
+        "security": [{"bearer": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ballot"}}}},
+        "responses": {
+          "200": {"description": "Recorded", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ballot"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"}
+        }
+      }
+    },
+    "/polls/{pollname}/results": {
+      "parameters": [{"$ref": "#/components/parameters/pollname"}],
+      "get": {
+        "summary": "Tally a poll's votes",
+        "responses": {
+          "200": {"description": "Results", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PollResults"}}}},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  }
+}
+`
+
+func OpenAPIGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", JSON)
+	w.Write([]byte(openAPIDoc))
+}
+
+var openAPIParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// CheckOpenAPI makes sure openAPIDoc lists exactly the operations routes
+// serves, no more and no less. The tests run it on APIRouter.
+func CheckOpenAPI(routes chi.Routes) error {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal([]byte(openAPIDoc), &doc); err != nil {
+		return errors.Wrap(err, "openapi doc unmarshal failed")
+	}
+
+	documented := map[string]bool{}
+	for path, item := range doc.Paths {
+		path = openAPIParam.ReplaceAllString(path, ":$1")
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	var problems []string
+	for _, route := range routes.Routes() {
+		for method := range route.Handlers {
+			if method == "*" {
+				continue
+			}
+			op := method + " " + route.Pattern
+			if !documented[op] {
+				problems = append(problems, "undocumented: "+op)
+			}
+			delete(documented, op)
+		}
+	}
+	for op := range documented {
+		problems = append(problems, "not routed: "+op)
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.Errorf("openapi doc doesn't match routes: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
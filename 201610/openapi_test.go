@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pressly/chi"
+)
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	if err := CheckOpenAPI(APIRouter()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenAPICatchesMissingRoutes(t *testing.T) {
+	r := chi.NewRouter()
+	r.Mount("/", APIRouter())
+	r.Get("/undocumented", func(w http.ResponseWriter, r *http.Request) {})
+	if err := CheckOpenAPI(r); err == nil {
+		t.Error("an undocumented route passed")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores everything past 72 bytes, so longer passwords would be
+// weaker than they look.
+const passwordMaxBytes = 72
+
+const passwordResetLifetime = 24 * time.Hour
+
+var passwordPostMax = flag.Int64("passwordpostmax", 1024, "largest password change or reset body")
+
+// blockedPasswords are ones known from breaches, lowercased. Nobody may
+// pick one, whatever its case.
+var blockedPasswords = map[string]bool{}
+
+// LoadPasswordBlocklist reads the passwords nobody may pick, one per line.
+// Blank lines and ones starting with # are skipped.
+func LoadPasswordBlocklist(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "password blocklist open failed")
+	}
+	defer f.Close()
+
+	blocked := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		blocked[strings.ToLower(line)] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return errors.Wrap(err, "password blocklist read failed")
+	}
+	blockedPasswords = blocked
+	return nil
+}
+
+// CheckPassword holds pass, a new password for userName, to the policy.
+// Passwords people already have aren't checked, so tightening it doesn't
+// lock anyone out.
+func CheckPassword(userName, pass string) *Error {
+	var err error
+	switch {
+	case utf8.RuneCountInString(pass) < *passwordMin:
+		err = errors.Errorf("password must be at least %d characters", *passwordMin)
+	case len(pass) > passwordMaxBytes:
+		err = errors.Errorf("password must be at most %d bytes", passwordMaxBytes)
+	case strings.EqualFold(pass, userName):
+		err = errors.New("password can't be the same as the username")
+	case blockedPasswords[strings.ToLower(pass)]:
+		err = errors.New("password is too common, pick another")
+	}
+	if err != nil {
+		return &Error{Code: http.StatusBadRequest, Message: err}
+	}
+	return nil
+}
+
+func HashPassword(pass string) (string, *Error) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte(pass), *bcryptCost)
+	if err != nil {
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "bcrypt failed"),
+		}
+		return "", e
+	}
+	return string(bcrypted), nil
+}
+
+// PasswordReset lets a user who has forgotten their password set a new
+// one, once. Admins issue them. Like invitations, only the hash of the code
+// is kept.
+type PasswordReset struct {
+	ID        string
+	User      string
+	CreatedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Admits reports whether the reset may set userName's password at now.
+func (reset *PasswordReset) Admits(userName string, now time.Time) bool {
+	return reset.User == userName && !now.After(reset.ExpiresAt)
+}
+
+// IssuedPasswordReset is what an admin gets back, to pass on to the user:
+// the only time the code itself is around.
+type IssuedPasswordReset struct {
+	PasswordReset
+	Code string
+	// Link is the page for setting a new password, with the code filled in.
+	Link string
+}
+
+// IssuePasswordReset makes and saves a reset for userName, from admin.
+func IssuePasswordReset(admin, userName string) (*IssuedPasswordReset, *Error) {
+	if _, e := UserByUsername(userName); e != nil {
+		return nil, e
+	}
+	code, err := randomString(16)
+	if err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Message: err}
+	}
+
+	now := time.Now()
+	issued := &IssuedPasswordReset{
+		PasswordReset: PasswordReset{
+			ID:        hashToken(code),
+			User:      userName,
+			CreatedBy: admin,
+			CreatedAt: now,
+			ExpiresAt: now.Add(passwordResetLifetime),
+		},
+		Code: code,
+		Link: fmt.Sprintf("/users/%s/password?%s", url.PathEscape(userName),
+			url.Values{"reset": {code}}.Encode()),
+	}
+	if err = env.Store.CreatePasswordReset(&issued.PasswordReset); err != nil {
+		return nil, StoreError(err)
+	}
+	return issued, nil
+}
+
+// PasswordChange sets a new password. It takes either the old one, from a
+// logged in user, or a reset code from an admin.
+type PasswordChange struct {
+	Old   string
+	Reset string
+	New   string
+}
+
+func (c *PasswordChange) Validate() (*PasswordChange, *Error) {
+	if len(c.Old) == 0 && len(c.Reset) == 0 {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("Old or Reset is required")}
+		return nil, e
+	} else if len(c.New) == 0 {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("New is required")}
+		return nil, e
+	}
+	return c, nil
+}
+
+func PasswordChangeFromForm(r *http.Request) (*PasswordChange, *Error) {
+	var err error
+	change := &PasswordChange{}
+
+	if err = r.ParseForm(); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "ParseForm failed"),
+		}
+		return nil, e
+	}
+
+	err = env.Form.Decode(change, r.PostForm)
+	if err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "Decode failed"),
+		}
+		return nil, e
+	}
+
+	return change.Validate()
+}
+
+func PasswordChangeFromJSON(r io.Reader) (*PasswordChange, *Error) {
+	change := &PasswordChange{}
+	if err := json.NewDecoder(r).Decode(change); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "json decoding failed"),
+		}
+		return nil, e
+	}
+	return change.Validate()
+}
+
+// Save sets userName's new password, and ends every session they have,
+// the one making the change included: whoever knew the old password
+// shouldn't stay logged in. Only userName may change their password with
+// the old one, and it counts towards login lockouts like logging in does.
+func (c *PasswordChange) Save(r *http.Request, userName string) *Error {
+	if e := CheckPassword(userName, c.New); e != nil {
+		return e
+	}
+
+	if c.Reset == "" {
+		switch JWTUser(r) {
+		case userName:
+		case "":
+			return &Error{Code: http.StatusUnauthorized, Message: errors.New("log in to change your password")}
+		default:
+			return &Error{Code: http.StatusForbidden, Message: errors.New("users can only change their own password")}
+		}
+		if e := (&User{Name: userName, Pass: c.Old}).Authenticate(r); e != nil {
+			return e
+		}
+	}
+
+	hash, e := HashPassword(c.New)
+	if e != nil {
+		return e
+	}
+	if c.Reset != "" {
+		err := env.Store.ResetPassword(hashToken(c.Reset), userName, hash, time.Now())
+		if errors.Cause(err) == ErrNoSuchReset {
+			return &Error{Code: http.StatusBadRequest, Message: errors.New("Reset is invalid, used or expired")}
+		} else if err != nil {
+			return StoreError(err)
+		}
+	} else {
+		user, e := UserByUsername(userName)
+		if e != nil {
+			return e
+		}
+		user.Pass = hash
+		if err := env.Store.UpdateUser(user); err != nil {
+			return StoreError(err)
+		}
+	}
+	return EndAllSessions(userName)
+}
+
+type PasswordModel struct {
+	Username string
+	// Reset is the code from an admin, if that's how it's being changed.
+	Reset string
+	// Min is the shortest password allowed.
+	Min int
+}
+
+var passwordTemplate *template.Template
+
+func init() {
+	passwordTemplate = parseTemplate("templates/password.html")
+}
+
+// PasswordGet shows the form for changing a password: the user's own when
+// they're logged in, or anyone's with a reset code.
+func PasswordGet(w http.ResponseWriter, r *http.Request) {
+	model := &PasswordModel{
+		Username: chi.URLParam(r, "username"),
+		Reset:    r.URL.Query().Get("reset"),
+		Min:      *passwordMin,
+	}
+	if model.Reset == "" && JWTUser(r) != model.Username {
+		w.Header().Set("Location", "/login")
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
+	if err := renderTemplate(w, r, passwordTemplate, model); err != nil {
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "executing password template"),
+		}
+		e.Write(w, r)
+		return
+	}
+}
+
+// PasswordPost changes a password, then has the user log in with it.
+func PasswordPost(w http.ResponseWriter, r *http.Request) {
+	inType := r.Context().Value("content-type").(string)
+
+	r.Body = http.MaxBytesReader(w, r.Body, *passwordPostMax)
+	defer r.Body.Close()
+
+	var change *PasswordChange
+	var e *Error
+	switch {
+	case inType == FormURL:
+		change, e = PasswordChangeFromForm(r)
+	case inType == JSON:
+		change, e = PasswordChangeFromJSON(r.Body)
+	default:
+		e = &Error{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: errors.New("supported types are form, json"),
+		}
+	}
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+
+	if e = change.Save(r, chi.URLParam(r, "username")); e != nil {
+		e.Write(w, r)
+		return
+	}
+	ClearSessionCookies(w)
+	Respond(w, r, http.StatusNoContent, nil, "/login")
+}
+
+func APIPasswordPut(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *passwordPostMax)
+	defer r.Body.Close()
+
+	change, e := PasswordChangeFromJSON(r.Body)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if e = change.Save(r, chi.URLParam(r, "username")); e != nil {
+		e.Write(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func APIPasswordResetsPost(w http.ResponseWriter, r *http.Request) {
+	issued, e := IssuePasswordReset(JWTUser(r), chi.URLParam(r, "username"))
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	WriteJSON(w, r, http.StatusCreated, issued)
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"reflect"
 	"regexp"
+	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
 	"github.com/pressly/chi"
 )
@@ -16,43 +18,124 @@ import (
 type Poll struct {
 	Name     string
 	Question string
-	Options  []*PollOption
+	Creator  string
+	// OpensAt and ClosesAt bound when votes are accepted, nil means no limit.
+	OpensAt   *time.Time `json:",omitempty"`
+	ClosesAt  *time.Time `json:",omitempty"`
+	CreatedAt *time.Time `json:",omitempty"`
+	// Method is one of the Method* constants, MaxPicks only applies to
+	// MethodMulti.
+	Method   string `json:",omitempty"`
+	MaxPicks int    `json:",omitempty"`
+	// Visibility is one of the Visibility* constants.
+	Visibility string `json:",omitempty"`
+	Options    []*PollOption
+	// Ballots maps voters to their choices. Like each option's Votes, it's
+	// only loaded when looking at a single poll.
+	Ballots map[string][]string `json:",omitempty"`
 }
 
 type PollOption struct {
 	Response string
-	Votes    map[string]bool
+	// Count is the number of ballots counting toward this response, which
+	// for ranked polls means first choices. Votes says whose ballots they are.
+	Count int
+	Votes map[string]bool
 }
 
-const (
-	pollPostMax int64 = 4096
+type PollModel struct {
+	LoggedIn bool
+	Username string
+	CanEdit  bool
+	Poll     *Poll
+}
+
+var pollPostMax = flag.Int64("pollpostmax", 4096, "largest poll, option or vote body")
+
+var (
+	ErrPollClosed  = errors.New("poll is closed")
+	ErrPollNotOpen = errors.New("poll isn't open yet")
+	// ErrMethodLocked and ErrAnonymityLocked turn away edits that would
+	// change how ballots already cast are counted or stored.
+	ErrMethodLocked    = errors.New("voting method can't change once votes are cast")
+	ErrAnonymityLocked = errors.New("anonymity can't change once votes are cast")
 )
 
 var (
+	pollTemplate            *template.Template
 	pollCreateTemplate      *template.Template
 	pollAddResponseTemplate *template.Template
 )
 
 func init() {
-	pollCreateTemplate = template.Must(template.ParseFiles("templates/poll-create.html"))
-	pollAddResponseTemplate = template.Must(template.ParseFiles("templates/poll-add-response.html"))
+	pollTemplate = parseTemplate("templates/poll.html")
+	pollCreateTemplate = parseTemplate("templates/poll-create.html")
+	pollAddResponseTemplate = parseTemplate("templates/poll-add-response.html")
 }
 
-func PollResponseGet(w http.ResponseWriter, r *http.Request) {
+func PollViewGet(w http.ResponseWriter, r *http.Request) {
 	pollName := chi.URLParam(r, "pollname")
-	poll, err := PollByName(pollName)
+	poll, err := env.Store.PollByName(pollName)
+	if err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+
+	model := &PollModel{Poll: poll, CanEdit: poll.CanEdit(r)}
+	model.Username = JWTUser(r)
+	if model.Username != "" {
+		model.LoggedIn = true
+	}
+	poll.Redact(model.LoggedIn)
+	if ResponseType(r) == JSON {
+		WriteJSON(w, r, http.StatusOK, poll)
+		return
+	}
+
+	err = renderTemplate(w, r, pollTemplate, model)
 	if err != nil {
-		e := &Error{Code: http.StatusInternalServerError, Message: err}
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "executing poll template"),
+		}
 		e.Write(w, r)
 		return
 	}
-	if poll == nil {
-		e := &Error{Code: http.StatusNotFound, Message: errors.New("no such poll")}
+}
+
+// CanEdit reports whether the user making the request may change the poll:
+// they made it, or they're a moderator.
+func (p *Poll) CanEdit(r *http.Request) bool {
+	user := JWTUser(r)
+	return user != "" && (user == p.Creator || HasRole(JWTRole(r), RoleModerator))
+}
+
+// PollForEdit loads the poll named in the URL, as long as the user making the
+// request is allowed to change it.
+func PollForEdit(r *http.Request) (*Poll, *Error) {
+	pollName := chi.URLParam(r, "pollname")
+	poll, err := env.Store.PollByName(pollName)
+	if err != nil {
+		return nil, StoreError(err)
+	}
+	if !poll.CanEdit(r) {
+		e := &Error{
+			Code:    http.StatusForbidden,
+			Message: errors.New("only the poll's creator or a moderator may change it"),
+		}
+		return nil, e
+	}
+	return poll, nil
+}
+
+func PollResponseGet(w http.ResponseWriter, r *http.Request) {
+	poll, e := PollForEdit(r)
+	if e != nil {
 		e.Write(w, r)
 		return
 	}
 
-	err = pollAddResponseTemplate.Execute(w, poll)
+	err := renderTemplate(w, r, pollAddResponseTemplate, poll)
 	if err != nil {
 		e := &Error{
 			Code:    http.StatusInternalServerError,
@@ -64,7 +147,7 @@ func PollResponseGet(w http.ResponseWriter, r *http.Request) {
 }
 
 func PollsCreateGet(w http.ResponseWriter, r *http.Request) {
-	err := pollCreateTemplate.Execute(w, nil)
+	err := renderTemplate(w, r, pollCreateTemplate, nil)
 	if err != nil {
 		e := &Error{
 			Code:    http.StatusInternalServerError,
@@ -75,89 +158,36 @@ func PollsCreateGet(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func PollByName(pollName string) (*Poll, error) {
-	var poll *Poll
-	err := env.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("polls"))
-		if b == nil {
-			return errors.New("no poll bucket")
-		}
-		// iterate over all keys in the bucket
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			if string(k) != pollName {
-				continue
-			}
-			poll = &Poll{}
-			err := json.Unmarshal(v, poll)
-			if err != nil {
-				return errors.Wrap(err, "poll unmarshal failed")
-			}
-		}
-		return nil
-	})
-	return poll, err
-}
-
-func AllPolls() (map[string]Poll, error) {
-	polls := map[string]Poll{}
-	err := env.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("polls"))
-		if b == nil {
-			return errors.New("no poll bucket")
-		}
-		// iterate over all keys in the bucket
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var poll Poll
-			err := json.Unmarshal(v, &poll)
-			if err != nil {
-				return errors.Wrap(err, "poll unmarshal failed")
-			}
-			polls[string(k)] = poll
-		}
-		return nil
-	})
-	return polls, err
-}
-
 func PollsGet(w http.ResponseWriter, r *http.Request) {
-	code := http.StatusInternalServerError
-	//inType := r.Context().Value("content-type").(string)
-	polls, err := AllPolls()
-	if err != nil {
-		e := &Error{Code: code, Message: err}
-		e.Write(w, r)
+	// browsers get the same listing as the index page
+	if ResponseType(r) != JSON {
+		Index(w, r)
 		return
 	}
 
-	// dump polls to client
-	// TODO: format with a template if request wasn't JSON
-	if err = json.NewEncoder(w).Encode(polls); err != nil {
-		e := &Error{Code: code, Message: errors.Wrap(err, "poll marshal failed")}
+	_, page, e := ListPage(r)
+	if e != nil {
 		e.Write(w, r)
 		return
 	}
 
-	return
+	WriteJSON(w, r, http.StatusOK, page)
 }
 
-func PollResultsGet(w http.ResponseWriter, r *http.Request) {}
-
 func PollsCreatePost(w http.ResponseWriter, r *http.Request) {
 	inType := r.Context().Value("content-type").(string)
 
 	// limit the amount of data we accept for a "poll create" request
-	r.Body = http.MaxBytesReader(w, r.Body, pollPostMax)
+	r.Body = http.MaxBytesReader(w, r.Body, *pollPostMax)
 	defer r.Body.Close()
 
-	var poll *Poll
+	poll := &Poll{}
 	var e *Error
 	switch {
 	case inType == FormURL:
-		poll, e = PollFromForm(r)
+		poll, e = PollFromForm(r, poll)
 	case inType == JSON:
-		poll, e = PollFromJSON(r.Body)
+		poll, e = PollFromJSON(r.Body, poll)
 	default:
 		e = &Error{
 			Code:    http.StatusUnsupportedMediaType,
@@ -169,13 +199,12 @@ func PollsCreatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if e = poll.Save(); e != nil {
+	if e = poll.Create(JWTUser(r)); e != nil {
 		e.Write(w, r)
 		return
 	}
 
-	w.Header().Set("Location", "/")
-	w.WriteHeader(http.StatusFound)
+	Respond(w, r, http.StatusCreated, poll, fmt.Sprintf("/polls/%s", poll.Name))
 }
 
 func (p *Poll) Validate() (*Poll, *Error) {
@@ -204,12 +233,100 @@ func (p *Poll) Validate() (*Poll, *Error) {
 		}
 	}
 
+	if !votingMethods[p.Method] {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.Errorf("unknown voting method %q", p.Method)}
+		return nil, e
+	}
+	if p.Method == MethodMulti && p.MaxPicks < 1 {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("MaxPicks is required for multi-select polls")}
+		return nil, e
+	} else if p.Method != MethodMulti {
+		p.MaxPicks = 0
+	}
+	if !visibilities[p.Visibility] {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.Errorf("unknown visibility %q", p.Visibility)}
+		return nil, e
+	}
+
+	// an empty form field leaves a zero time behind, which means "unset"
+	if p.OpensAt != nil && p.OpensAt.IsZero() {
+		p.OpensAt = nil
+	}
+	if p.ClosesAt != nil && p.ClosesAt.IsZero() {
+		p.ClosesAt = nil
+	}
+	if p.OpensAt != nil && p.ClosesAt != nil && !p.ClosesAt.After(*p.OpensAt) {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("ClosesAt must be after OpensAt")}
+		return nil, e
+	}
+
 	return p, nil
 }
 
-func PollFromForm(r *http.Request) (*Poll, *Error) {
+// FormTime converts form values into times, for use with schema.Decoder.
+// Both RFC 3339 and the format used by datetime-local inputs are accepted,
+// and an empty value becomes the zero time.
+func FormTime(value string) reflect.Value {
+	if value == "" {
+		return reflect.ValueOf(time.Time{})
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return reflect.ValueOf(t)
+		}
+	}
+	return reflect.Value{}
+}
+
+// CheckOpen returns ErrPollNotOpen or ErrPollClosed if the poll isn't
+// accepting changes at the given time.
+func (p *Poll) CheckOpen(now time.Time) error {
+	if p.OpensAt != nil && now.Before(*p.OpensAt) {
+		return ErrPollNotOpen
+	}
+	if p.ClosesAt != nil && !now.Before(*p.ClosesAt) {
+		return ErrPollClosed
+	}
+	return nil
+}
+
+// IsOpen and Status take a Poll rather than a *Poll so templates can call
+// them on the values in AllPolls' map.
+func (p Poll) IsOpen() bool {
+	return p.CheckOpen(time.Now()) == nil
+}
+
+// Status describes where the poll is in its lifecycle, like "open",
+// "closes in 2h" or "closed".
+func (p Poll) Status() string {
+	now := time.Now()
+	switch {
+	case p.OpensAt != nil && now.Before(*p.OpensAt):
+		return "opens in " + humanDuration(p.OpensAt.Sub(now))
+	case p.ClosesAt != nil && !now.Before(*p.ClosesAt):
+		return "closed"
+	case p.ClosesAt != nil:
+		return "closes in " + humanDuration(p.ClosesAt.Sub(now))
+	}
+	return "open"
+}
+
+// humanDuration rounds d down to its largest whole unit, like "2h" or "3d".
+func humanDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "under a minute"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dd", d/(24*time.Hour))
+}
+
+// PollFromForm decodes form values on top of poll, then validates the result.
+func PollFromForm(r *http.Request, poll *Poll) (*Poll, *Error) {
 	var err error
-	poll := &Poll{}
 
 	if err = r.ParseForm(); err != nil {
 		e := &Error{
@@ -231,8 +348,8 @@ func PollFromForm(r *http.Request) (*Poll, *Error) {
 	return poll.Validate()
 }
 
-func PollFromJSON(r io.Reader) (*Poll, *Error) {
-	poll := &Poll{}
+// PollFromJSON decodes JSON on top of poll, then validates the result.
+func PollFromJSON(r io.Reader, poll *Poll) (*Poll, *Error) {
 
 	if err := json.NewDecoder(r).Decode(poll); err != nil {
 		e := &Error{
@@ -245,40 +362,167 @@ func PollFromJSON(r io.Reader) (*Poll, *Error) {
 	return poll.Validate()
 }
 
+// Create saves a new poll belonging to creator, with no votes yet.
+func (p *Poll) Create(creator string) *Error {
+	now := time.Now()
+	p.Creator, p.CreatedAt = creator, &now
+	p.Ballots = nil
+	for _, option := range p.Options {
+		option.Count, option.Votes = 0, nil
+	}
+	return p.Save()
+}
+
 func (p *Poll) Save() *Error {
-	code := http.StatusInternalServerError
-	jsonBytes, err := json.Marshal(p)
-	if err != nil {
-		return &Error{
-			Code:    http.StatusInternalServerError,
-			Message: errors.Wrap(err, "poll marshal failed"),
-		}
+	if err := env.Store.CreatePoll(p); err != nil {
+		return StoreError(err)
 	}
+	return nil
+}
+
+// PollPut replaces a poll's question and options. Votes for options that are
+// kept stay put, the rest are dropped.
+func PollPut(w http.ResponseWriter, r *http.Request) {
+	PollUpdate(w, r, true)
+}
 
-	err = env.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("polls"))
-		if b == nil {
-			return errors.New("no poll bucket")
+// PollPatch changes only the fields present in the request.
+func PollPatch(w http.ResponseWriter, r *http.Request) {
+	PollUpdate(w, r, false)
+}
+
+// PollUpdate decodes the request on top of the poll, or on top of an empty
+// one when replace is set, and saves the result.
+func PollUpdate(w http.ResponseWriter, r *http.Request, replace bool) {
+	inType := r.Context().Value("content-type").(string)
+
+	// limit the amount of data we accept for a "poll update" request
+	r.Body = http.MaxBytesReader(w, r.Body, *pollPostMax)
+	defer r.Body.Close()
+
+	poll, e := PollForEdit(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+
+	poll, e = poll.Edit(replace, func(base *Poll) (*Poll, *Error) {
+		switch {
+		case inType == FormURL:
+			return PollFromForm(r, base)
+		case inType == JSON:
+			return PollFromJSON(r.Body, base)
 		}
-		err := b.Put([]byte(p.Name), jsonBytes)
-		if err != nil {
-			return errors.Wrap(err, "create failed")
+		e := &Error{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: errors.New("supported types are form, json"),
 		}
-		return nil
+		return nil, e
 	})
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
 
-	if err != nil {
-		return &Error{Code: code, Message: err}
+	Respond(w, r, http.StatusOK, poll.Redact(true), fmt.Sprintf("/polls/%s", poll.Name))
+}
+
+// CheckEdit returns an error if p can't replace old, which has had votes
+// cast when voted is set. Ballots cast one way can't be counted another,
+// and anonymous ballots aren't stored under voters' names. Stores call it
+// in the same transaction as votes are cast in.
+func (p *Poll) CheckEdit(old *Poll, voted bool) error {
+	if !voted {
+		return nil
+	}
+	if p.Method != old.Method || p.MaxPicks != old.MaxPicks {
+		return ErrMethodLocked
+	}
+	if p.Anonymous() != old.Anonymous() {
+		return ErrAnonymityLocked
 	}
 	return nil
 }
 
+// Edit saves changes to the poll and returns it as stored afterwards. The
+// changes are made by decode, on top of a copy of the poll, or on top of an
+// empty one when replace is set. Who created the poll, when, and the votes
+// cast so far are kept, and so are the options unless decode sets new ones.
+func (p *Poll) Edit(replace bool, decode func(base *Poll) (*Poll, *Error)) (*Poll, *Error) {
+	base := &Poll{Name: p.Name}
+	if !replace {
+		copied := *p
+		base = &copied
+	}
+	// decoding into these would change p's too
+	base.Options, base.Ballots = nil, nil
+
+	updated, e := decode(base)
+	if e != nil {
+		return nil, e
+	}
+	if updated.Name != p.Name {
+		e = &Error{Code: http.StatusBadRequest, Message: errors.New("polls can't be renamed")}
+		return nil, e
+	}
+	updated.Creator, updated.CreatedAt, updated.Ballots = p.Creator, p.CreatedAt, p.Ballots
+	if updated.Options == nil {
+		updated.Options = p.Options
+	}
+
+	// the store checks the method and anonymity against the ballots it has
+	// then, which may be more than p has
+	if err := env.Store.UpdatePoll(updated); err != nil {
+		return nil, StoreError(err)
+	}
+	env.Events.PollChanged(p.Name)
+	saved, err := env.Store.PollByName(p.Name)
+	if err != nil {
+		return nil, StoreError(err)
+	}
+	return saved, nil
+}
+
+func PollDelete(w http.ResponseWriter, r *http.Request) {
+	poll, e := PollForEdit(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if err := env.Store.DeletePoll(poll.Name); err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	env.Events.PollChanged(poll.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PollClosePost closes a poll right away.
+func PollClosePost(w http.ResponseWriter, r *http.Request) {
+	poll, e := PollForEdit(r)
+	if e != nil {
+		e.Write(w, r)
+		return
+	}
+	if poll.ClosesAt == nil || poll.ClosesAt.After(time.Now()) {
+		now := time.Now()
+		poll.ClosesAt = &now
+		if err := env.Store.UpdatePoll(poll); err != nil {
+			StoreError(err).Write(w, r)
+			return
+		}
+		env.Events.PollChanged(poll.Name)
+	}
+
+	Respond(w, r, http.StatusOK, poll.Redact(true), fmt.Sprintf("/polls/%s", poll.Name))
+}
+
 func PollResponsePost(w http.ResponseWriter, r *http.Request) {
 	inType := r.Context().Value("content-type").(string)
 	pollName := chi.URLParam(r, "pollname")
 
 	// limit the amount of data we accept for a "poll create" request
-	r.Body = http.MaxBytesReader(w, r.Body, pollPostMax)
+	r.Body = http.MaxBytesReader(w, r.Body, *pollPostMax)
 	defer r.Body.Close()
 
 	var option *PollOption
@@ -299,58 +543,57 @@ func PollResponsePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, e = PollForEdit(r); e != nil {
+		e.Write(w, r)
+		return
+	}
 	e = option.Add(pollName)
 	if e != nil {
 		e.Write(w, r)
 		return
 	}
 
-	w.Header().Set("Location", "/")
-	w.WriteHeader(http.StatusFound)
+	Respond(w, r, http.StatusCreated, option, fmt.Sprintf("/polls/%s", pollName))
 }
 
 func (o *PollOption) Add(pollName string) *Error {
-	code := http.StatusInternalServerError
-	err := env.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("polls"))
-		if b == nil {
-			code = http.StatusNotFound
-			return errors.New("no poll bucket")
-		}
-		val := b.Get([]byte(pollName))
-		if val == nil {
-			code = http.StatusNotFound
-			return errors.New("no such poll")
-		}
+	if err := env.Store.AddOption(pollName, o); err != nil {
+		return StoreError(err)
+	}
+	env.Events.PollChanged(pollName)
+	return nil
+}
 
-		poll := &Poll{}
-		if err := json.Unmarshal(val, poll); err != nil {
-			return errors.Wrap(err, "poll unmarshal failed")
+// SetOptions replaces the poll's options, carrying over the votes for any
+// response that's in both the old and the new list.
+func (p *Poll) SetOptions(options []*PollOption) {
+	old := map[string]*PollOption{}
+	for _, option := range p.Options {
+		old[option.Response] = option
+	}
+	p.Options = nil
+	seen := map[string]bool{}
+	for _, option := range options {
+		if seen[option.Response] {
+			continue
 		}
-
-		for _, option := range poll.Options {
-			if option.Response == o.Response {
-				return nil
-			}
+		seen[option.Response] = true
+		kept := &PollOption{Response: option.Response}
+		if prev, ok := old[option.Response]; ok {
+			kept.Count, kept.Votes = prev.Count, prev.Votes
 		}
-		poll.Options = append(poll.Options, &PollOption{Response: o.Response})
+		p.Options = append(p.Options, kept)
+	}
+}
 
-		jsonBytes, err := json.Marshal(poll)
-		if err != nil {
-			return errors.Wrap(err, "poll marshal failed")
-		}
-		err = b.Put([]byte(pollName), jsonBytes)
-		if err != nil {
-			return errors.Wrap(err, "vote failed")
+// AddOption appends a response to the poll, unless it's already there.
+func (p *Poll) AddOption(response string) {
+	for _, option := range p.Options {
+		if option.Response == response {
+			return
 		}
-
-		return nil
-	})
-
-	if err != nil {
-		return &Error{Code: code, Message: err}
 	}
-	return nil
+	p.Options = append(p.Options, &PollOption{Response: response})
 }
 
 func PollVotePost(w http.ResponseWriter, r *http.Request) {
@@ -358,16 +601,16 @@ func PollVotePost(w http.ResponseWriter, r *http.Request) {
 	pollName := chi.URLParam(r, "pollname")
 
 	// limit the amount of data we accept for a "poll create" request
-	r.Body = http.MaxBytesReader(w, r.Body, pollPostMax)
+	r.Body = http.MaxBytesReader(w, r.Body, *pollPostMax)
 	defer r.Body.Close()
 
-	var option *PollOption
+	var ballot *Ballot
 	var e *Error
 	switch {
 	case inType == FormURL:
-		option, e = PollOptionFromForm(r)
+		ballot, e = BallotFromForm(r)
 	case inType == JSON:
-		option, e = PollOptionFromJSON(r.Body)
+		ballot, e = BallotFromJSON(r.Body)
 	default:
 		e = &Error{
 			Code:    http.StatusUnsupportedMediaType,
@@ -379,14 +622,13 @@ func PollVotePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	e = option.Vote(pollName, JWTUser(r))
+	e = ballot.Cast(pollName, JWTUser(r))
 	if e != nil {
 		e.Write(w, r)
 		return
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("/polls/%s", pollName))
-	w.WriteHeader(http.StatusFound)
+	Respond(w, r, http.StatusOK, ballot, fmt.Sprintf("/polls/%s", pollName))
 }
 
 func (o *PollOption) Validate() (*PollOption, *Error) {
@@ -432,50 +674,3 @@ func PollOptionFromJSON(r io.Reader) (*PollOption, *Error) {
 	}
 	return option.Validate()
 }
-
-func (o *PollOption) Vote(pollName, userName string) *Error {
-	code := http.StatusInternalServerError
-	err := env.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("polls"))
-		if b == nil {
-			code = http.StatusNotFound
-			return errors.New("no poll bucket")
-		}
-		val := b.Get([]byte(pollName))
-		if val == nil {
-			code = http.StatusNotFound
-			return errors.New("no such poll")
-		}
-
-		poll := &Poll{}
-		if err := json.Unmarshal(val, poll); err != nil {
-			return errors.Wrap(err, "poll unmarshal failed")
-		}
-		for _, option := range poll.Options {
-			if o.Response == option.Response {
-				if option.Votes == nil {
-					option.Votes = map[string]bool{}
-				}
-				option.Votes[userName] = true
-			} else {
-				delete(option.Votes, userName)
-			}
-		}
-
-		jsonBytes, err := json.Marshal(poll)
-		if err != nil {
-			return errors.Wrap(err, "poll marshal failed")
-		}
-		err = b.Put([]byte(pollName), jsonBytes)
-		if err != nil {
-			return errors.Wrap(err, "vote failed")
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		return &Error{Code: code, Message: err}
-	}
-	return nil
-}
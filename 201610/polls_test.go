@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// testEditLocked checks that s refuses to change how a poll is voted on or
+// stored once it has votes.
+func testEditLocked(t *testing.T, s Store) {
+	poll := func() *Poll {
+		return &Poll{Name: "beer", Question: "Best?", Method: MethodSingle,
+			Options: []*PollOption{{Response: "ipa"}, {Response: "stout"}}}
+	}
+	if err := s.CreatePoll(poll()); err != nil {
+		t.Fatal(err)
+	}
+	ranked := poll()
+	ranked.Method = MethodRanked
+	if err := s.UpdatePoll(ranked); err != nil {
+		t.Fatalf("before votes: %v", err)
+	}
+	ranked.Method = MethodSingle
+	if err := s.UpdatePoll(ranked); err != nil {
+		t.Fatalf("back before votes: %v", err)
+	}
+	if err := s.Vote("beer", "alice", []string{"ipa"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ranked.Method = MethodRanked
+	err := s.UpdatePoll(ranked)
+	if errors.Cause(err) != ErrMethodLocked {
+		t.Errorf("method: got %v, want %v", err, ErrMethodLocked)
+	}
+	if e := StoreError(err); e.Code != http.StatusConflict {
+		t.Errorf("method: code %d, want %d", e.Code, http.StatusConflict)
+	}
+	anon := poll()
+	anon.Visibility = VisibilityAnonymous
+	if err = s.UpdatePoll(anon); errors.Cause(err) != ErrAnonymityLocked {
+		t.Errorf("anonymity: got %v, want %v", err, ErrAnonymityLocked)
+	}
+	question := poll()
+	question.Question = "Best beer?"
+	if err = s.UpdatePoll(question); err != nil {
+		t.Errorf("question: %v", err)
+	}
+
+	got, err := s.PollByName("beer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != MethodSingle || got.Anonymous() || got.Question != "Best beer?" {
+		t.Errorf("stored %s %q anonymous=%t", got.Method, got.Question, got.Anonymous())
+	}
+}
+
+func TestMemStoreEditLocked(t *testing.T) {
+	testEditLocked(t, NewMemStore())
+}
+
+func TestBoltStoreEditLocked(t *testing.T) {
+	s, err := BoltOpen(filepath.Join(t.TempDir(), "bolt.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testEditLocked(t, s)
+}
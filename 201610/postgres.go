@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// Build with -tags postgres to use -dbdriver postgres -dsn postgres://...
+import _ "github.com/lib/pq"
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+)
+
+// Failed logins are free up to -loginfailures. After that, each one locks
+// out the account name and the address it came from for twice as long as
+// the one before, starting at lockoutBase, up to -lockoutmax. Failures are
+// forgotten failureWindow after the first, and for an account name, as soon
+// as someone logs in as it.
+const (
+	lockoutBase   = time.Second
+	failureWindow = 24 * time.Hour
+)
+
+// How often MemLimitStore drops entries that have run out.
+const limitSweep = time.Minute
+
+// Rate is how many requests are allowed per window. On the command line
+// it's like "20/1m", or "20/m"; "0" allows everything, like the zero Rate.
+type Rate struct {
+	N      int
+	Window time.Duration
+}
+
+func (rt *Rate) String() string {
+	if rt.N == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", rt.N, rt.Window)
+}
+
+func (rt *Rate) Set(s string) error {
+	if s == "" || s == "0" {
+		*rt = Rate{}
+		return nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("rate %q should be like 20/1m", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return errors.Errorf("rate %q should start with a count", s)
+	}
+	per := parts[1]
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		// "20/m" is 20 a minute
+		per = "1" + per
+	}
+	window, err := time.ParseDuration(per)
+	if err != nil || window <= 0 {
+		return errors.Errorf("rate %q should end with a duration", s)
+	}
+	*rt = Rate{N: n, Window: window}
+	return nil
+}
+
+// rateFlag is flag.Duration, for Rates.
+func rateFlag(name string, value Rate, usage string) *Rate {
+	rt := &value
+	flag.Var(rt, name, usage)
+	return rt
+}
+
+// LimitStore remembers what rate limits and lockouts need to: how many
+// times a key has been hit lately, and until when it's locked out. The
+// in-memory one is only good for a single server; several behind a load
+// balancer would want one they all share.
+type LimitStore interface {
+	// Hit counts a hit on key. The count starts over a window after the
+	// first hit. It returns the count so far, and when it starts over.
+	Hit(key string, window time.Duration) (int, time.Time)
+	// Lock turns key away until until.
+	Lock(key string, until time.Time)
+	// LockedUntil is when key's lockout ends. It's in the past, or zero,
+	// when it isn't locked out.
+	LockedUntil(key string) time.Time
+	// Reset forgets key's hits and lockout.
+	Reset(key string)
+}
+
+type limitEntry struct {
+	count  int
+	reset  time.Time
+	locked time.Time
+}
+
+type MemLimitStore struct {
+	mu      sync.Mutex
+	entries map[string]*limitEntry
+	sweptAt time.Time
+}
+
+func NewMemLimitStore() *MemLimitStore {
+	return &MemLimitStore{entries: map[string]*limitEntry{}, sweptAt: time.Now()}
+}
+
+// sweep drops entries that have nothing left to remember. The caller holds
+// s.mu.
+func (s *MemLimitStore) sweep(now time.Time) {
+	if now.Sub(s.sweptAt) < limitSweep {
+		return
+	}
+	s.sweptAt = now
+	for key, entry := range s.entries {
+		if !now.Before(entry.reset) && !now.Before(entry.locked) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func (s *MemLimitStore) Hit(key string, window time.Duration) (int, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &limitEntry{}
+		s.entries[key] = entry
+	}
+	if !now.Before(entry.reset) {
+		entry.count, entry.reset = 0, now.Add(window)
+	}
+	entry.count++
+	return entry.count, entry.reset
+}
+
+func (s *MemLimitStore) Lock(key string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &limitEntry{}
+		s.entries[key] = entry
+	}
+	entry.locked = until
+}
+
+func (s *MemLimitStore) LockedUntil(key string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok {
+		return entry.locked
+	}
+	return time.Time{}
+}
+
+func (s *MemLimitStore) Reset(key string) {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+}
+
+// Proxies are the ones whose X-Forwarded-For headers are believed. On the
+// command line they're like "10.0.0.0/8,192.0.2.1,unix".
+type Proxies struct {
+	nets []*net.IPNet
+	// unix trusts connections to the unix socket, which have no address
+	unix bool
+}
+
+func (p *Proxies) String() string {
+	var all []string
+	for _, n := range p.nets {
+		all = append(all, n.String())
+	}
+	if p.unix {
+		all = append(all, "unix")
+	}
+	return strings.Join(all, ",")
+}
+
+func (p *Proxies) Set(s string) error {
+	*p = Proxies{}
+	for _, proxy := range strings.Split(s, ",") {
+		proxy = strings.TrimSpace(proxy)
+		switch {
+		case proxy == "":
+		case proxy == "unix":
+			p.unix = true
+		case strings.Contains(proxy, "/"):
+			_, n, err := net.ParseCIDR(proxy)
+			if err != nil {
+				return errors.Errorf("proxy %q should be an address or CIDR", proxy)
+			}
+			p.nets = append(p.nets, n)
+		default:
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return errors.Errorf("proxy %q should be an address or CIDR", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return nil
+}
+
+// Trusts reports whether ip is one of the proxies, a nil ip being the unix
+// socket.
+func (p *Proxies) Trusts(ip net.IP) bool {
+	if ip == nil {
+		return p.unix
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxiesFlag is flag.Var, for Proxies.
+func proxiesFlag(name, usage string) *Proxies {
+	p := &Proxies{}
+	flag.Var(p, name, usage)
+	return p
+}
+
+// ClientIP is the address a request came from, without the port. Requests
+// from trusted proxies came from the address they put in X-Forwarded-For,
+// read from the right, since the proxy nearest us added the last one, and
+// anything to the left of what a trusted proxy added may have been made
+// up. It's empty when there's no address to go on, like for requests over
+// the unix socket without a trusted proxy.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	var forwarded []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0 && trustedProxies.Trusts(ip); i-- {
+		if ip = net.ParseIP(strings.TrimSpace(forwarded[i])); ip == nil {
+			return ""
+		}
+	}
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// TooManyRequests is a 429 telling the client when to come back.
+func TooManyRequests(err error, until time.Time) *Error {
+	return &Error{Code: http.StatusTooManyRequests, Message: err, RetryAfter: time.Until(until)}
+}
+
+// Allow counts a request from key against rate, and turns it away once
+// there have been too many of what's named.
+func Allow(what string, rate *Rate, key string) *Error {
+	if rate.N == 0 {
+		return nil
+	}
+	count, reset := env.Limits.Hit(what+":"+key, rate.Window)
+	if count > rate.N {
+		return TooManyRequests(errors.Errorf("too many %s, try again later", what), reset)
+	}
+	return nil
+}
+
+// RateLimit is a middleware that allows rate of what's named per user, or
+// per address for anyone not logged in. It goes after the authenticator,
+// if there is one, to count users by name. Requests from no address we can
+// tell apart aren't limited, since they'd all share one limit.
+func RateLimit(what string, rate *Rate) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			var key string
+			if user := JWTUser(r); user != "" {
+				key = "user:" + user
+			} else if ip := ClientIP(r); ip != "" {
+				key = "ip:" + ip
+			}
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if e := Allow(what, rate, key); e != nil {
+				e.Write(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Authenticate is Verify for logins, which are limited per address and
+// locked out after too many failures. Lockouts apply to the account name
+// as well, so spreading guesses over many addresses doesn't help; the
+// price is that anyone can lock an account for a while. Without an address,
+// only the account name is limited.
+func (u *User) Authenticate(r *http.Request) *Error {
+	keys := loginKeys(u.Name, r)
+	if e := loginLocked(keys); e != nil {
+		return e
+	}
+	if ip := ClientIP(r); ip != "" {
+		if e := Allow("login attempts", loginRate, "ip:"+ip); e != nil {
+			return e
+		}
+	}
+
+	e := u.Verify()
+	switch {
+	case e == nil:
+		env.Limits.Reset(keys[0])
+	case e.Code == http.StatusUnauthorized || e.Code == http.StatusNotFound:
+		loginFailed(keys)
+	}
+	return e
+}
+
+// loginKeys are what failed logins are counted against: the account name
+// first, then the address, if there is one.
+func loginKeys(userName string, r *http.Request) []string {
+	keys := []string{"login:user:" + userName}
+	if ip := ClientIP(r); ip != "" {
+		keys = append(keys, "login:ip:"+ip)
+	}
+	return keys
+}
+
+// loginLocked turns the login away if any of keys is locked out.
+func loginLocked(keys []string) *Error {
+	for _, key := range keys {
+		if until := env.Limits.LockedUntil(key); until.After(time.Now()) {
+			return TooManyRequests(errors.New("too many failed logins, try again later"), until)
+		}
+	}
+	return nil
+}
+
+// loginFailed counts a failed login against each of keys, locking out the
+// ones that have had too many.
+func loginFailed(keys []string) {
+	for _, key := range keys {
+		n, _ := env.Limits.Hit(key, failureWindow)
+		over := n - *loginFailures
+		if over <= 0 {
+			continue
+		}
+		lockout := *lockoutMax
+		if over <= 32 && lockoutBase<<uint(over-1) < lockout {
+			lockout = lockoutBase << uint(over-1)
+		}
+		env.Limits.Lock(key, time.Now().Add(lockout))
+		env.Log.Info("login lockout", zap.String("key", key), zap.Int("failures", n),
+			zap.Duration("lockout", lockout))
+	}
+}
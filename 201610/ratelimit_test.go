@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// trustProxies sets -trustedproxies for the rest of a test.
+func trustProxies(t *testing.T, proxies string) {
+	saved := *trustedProxies
+	if err := trustedProxies.Set(proxies); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { *trustedProxies = saved })
+}
+
+func requestFrom(remoteAddr string, forwardedFor ...string) *http.Request {
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = remoteAddr
+	for _, f := range forwardedFor {
+		r.Header.Add("X-Forwarded-For", f)
+	}
+	return r
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		proxies      string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"", "[2001:db8::1]:1234", nil, "2001:db8::1"},
+		// nobody has to believe what clients say about themselves
+		{"", "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"10.0.0.0/8", "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"10.0.0.0/8", "10.1.2.3:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.0/8", "10.1.2.3:1234", nil, "10.1.2.3"},
+		// only what trusted proxies added counts
+		{"10.0.0.0/8", "10.1.2.3:1234", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.0/8", "10.1.2.3:1234", []string{"203.0.113.9", "198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.0/8", "10.1.2.3:1234", []string{"198.51.100.7, 10.4.5.6"}, "198.51.100.7"},
+		{"10.1.2.3", "10.1.2.3:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"10.1.2.3", "10.1.2.4:1234", []string{"198.51.100.7"}, "10.1.2.4"},
+		{"10.0.0.0/8", "10.1.2.3:1234", []string{"unknown"}, ""},
+		// the unix socket has no addresses
+		{"", "@", nil, ""},
+		{"", "", []string{"198.51.100.7"}, ""},
+		{"unix", "@", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"unix", "@", nil, ""},
+	} {
+		trustProxies(t, tt.proxies)
+		if got := ClientIP(requestFrom(tt.remoteAddr, tt.forwardedFor...)); got != tt.want {
+			t.Errorf("proxies %q, from %q, forwarded for %q: got %q, want %q",
+				tt.proxies, tt.remoteAddr, tt.forwardedFor, got, tt.want)
+		}
+	}
+}
+
+func TestProxiesSet(t *testing.T) {
+	var p Proxies
+	if err := p.Set("10.0.0.0/8, 192.0.2.1,2001:db8::/32,unix"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.String(), "10.0.0.0/8,192.0.2.1/32,2001:db8::/32,unix"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, bad := range []string{"10.0.0.0/33", "example.com", "10.0.0"} {
+		if err := p.Set(bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+// loginAs tries a login, returning the status it gets.
+func loginAs(r *http.Request, userName, pass string) int {
+	u := &User{Name: userName, Pass: pass}
+	if e := u.Authenticate(r); e != nil {
+		return e.Code
+	}
+	return http.StatusOK
+}
+
+func limitedLogins(t *testing.T) {
+	resetEnv(t)
+	savedCost, savedRate, savedFailures := *bcryptCost, *loginRate, *loginFailures
+	*bcryptCost, *loginRate, *loginFailures = bcrypt.MinCost, Rate{N: 3, Window: time.Minute}, 2
+	t.Cleanup(func() { *bcryptCost, *loginRate, *loginFailures = savedCost, savedRate, savedFailures })
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		hash, e := HashPassword("right")
+		if e != nil {
+			t.Fatal(e.Message)
+		}
+		if err := env.Store.CreateUser(&User{Name: name, Pass: hash}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A client behind the load balancer guessing passwords locks out itself,
+// not everyone else behind it.
+func TestLoginLimitsBehindProxy(t *testing.T) {
+	limitedLogins(t)
+	trustProxies(t, "10.0.0.0/8")
+
+	guesser := requestFrom("10.0.0.1:1000", "198.51.100.7")
+	for i, want := range []int{401, 401, 401, 429} {
+		if got := loginAs(guesser, "alice", "wrong"); got != want {
+			t.Errorf("guess %d: got %d, want %d", i+1, got, want)
+		}
+	}
+	if got := loginAs(guesser, "bob", "right"); got != http.StatusTooManyRequests {
+		t.Errorf("guesser as bob: got %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if got := loginAs(requestFrom("10.0.0.1:1001", "203.0.113.9"), "bob", "right"); got != http.StatusOK {
+		t.Errorf("someone else as bob: got %d, want %d", got, http.StatusOK)
+	}
+}
+
+// Over the unix socket with no proxy to say who's who, there's no address
+// to limit, so only account names are.
+func TestLoginLimitsWithoutAddress(t *testing.T) {
+	limitedLogins(t)
+
+	for i := 0; i < 5; i++ {
+		loginAs(requestFrom("@"), "alice", "wrong")
+	}
+	if got := loginAs(requestFrom("@"), "alice", "right"); got != http.StatusTooManyRequests {
+		t.Errorf("alice: got %d, want %d", got, http.StatusTooManyRequests)
+	}
+	for _, name := range []string{"bob", "carol"} {
+		if got := loginAs(requestFrom("@"), name, "right"); got != http.StatusOK {
+			t.Errorf("%s: got %d, want %d", name, got, http.StatusOK)
+		}
+	}
+}
+
+func TestRateLimitWithoutAddress(t *testing.T) {
+	resetEnv(t)
+	h := RateLimit("signups", &Rate{N: 1, Window: time.Minute})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"192.0.2.1:1234", http.StatusTooManyRequests},
+		{"@", http.StatusOK},
+		{"@", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, requestFrom(tt.remoteAddr))
+		if w.Code != tt.want {
+			t.Errorf("from %q: got %d, want %d", tt.remoteAddr, w.Code, tt.want)
+		}
+	}
+}
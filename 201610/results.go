@@ -0,0 +1,126 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+)
+
+// PollResults is a tally of the votes cast in a poll.
+type PollResults struct {
+	Name     string
+	Question string
+	Method   string `json:",omitempty"`
+	// Options has each response's vote count. For ranked polls that's first
+	// choices only, and Rounds has the full instant runoff count.
+	Options []*OptionResult
+	Rounds  []*Round `json:",omitempty"`
+	Voters  int
+	// Leader is the response with the most votes, or the instant runoff
+	// winner for ranked polls. It's empty if nobody voted.
+	Leader string
+	// Tie is set when more than one response has the leader's vote count.
+	Tie bool
+}
+
+type OptionResult struct {
+	Response string
+	Votes    int
+	// Percent is the share of all votes for single choice and ranked polls,
+	// and the share of voters who picked the response otherwise, so it can
+	// add up to more than 100.
+	Percent float64
+}
+
+type PollResultsModel struct {
+	LoggedIn bool
+	Username string
+	Results  *PollResults
+}
+
+var pollResultsTemplate *template.Template
+
+func init() {
+	pollResultsTemplate = parseTemplate("templates/poll-results.html")
+}
+
+// Results tallies the votes for each of the poll's options.
+func (p *Poll) Results() *PollResults {
+	res := &PollResults{Name: p.Name, Question: p.Question, Method: p.Method}
+	res.Voters = len(p.Ballots)
+	total := 0
+	for _, option := range p.Options {
+		res.Options = append(res.Options, &OptionResult{
+			Response: option.Response,
+			Votes:    option.Count,
+		})
+		total += option.Count
+	}
+	if p.Method == MethodMulti || p.Method == MethodApproval {
+		total = res.Voters
+	}
+
+	max := 0
+	for _, option := range res.Options {
+		if total > 0 {
+			option.Percent = float64(option.Votes) * 100 / float64(total)
+		}
+		switch {
+		case option.Votes == 0:
+		case option.Votes > max:
+			max = option.Votes
+			res.Leader = option.Response
+			res.Tie = false
+		case option.Votes == max:
+			res.Tie = true
+		}
+	}
+
+	if p.Method == MethodRanked {
+		var winners []string
+		res.Rounds, winners = p.InstantRunoff()
+		res.Leader, res.Tie = "", len(winners) > 1
+		if len(winners) > 0 {
+			res.Leader = winners[0]
+		}
+	}
+	return res
+}
+
+func PollResultsGet(w http.ResponseWriter, r *http.Request) {
+	pollName := chi.URLParam(r, "pollname")
+	poll, err := env.Store.PollByName(pollName)
+	if err != nil {
+		StoreError(err).Write(w, r)
+		return
+	}
+	if poll.ResultsHidden() {
+		e := &Error{Code: http.StatusForbidden, Message: ErrResultsHidden}
+		e.Write(w, r)
+		return
+	}
+	results := poll.Results()
+
+	if ResponseType(r) == JSON {
+		WriteJSON(w, r, http.StatusOK, results)
+		return
+	}
+
+	model := &PollResultsModel{Results: results}
+	model.Username = JWTUser(r)
+	if model.Username != "" {
+		model.LoggedIn = true
+	}
+
+	err = renderTemplate(w, r, pollResultsTemplate, model)
+	if err != nil {
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "executing poll results template"),
+		}
+		e.Write(w, r)
+		return
+	}
+}
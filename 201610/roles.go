@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// Roles, from least to most trusted. Each may do everything the ones before
+// it may. Moderators can change and delete anyone's polls; admins can also
+// manage users and invitations.
+const (
+	RoleUser      = ""
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+var ErrAccountDisabled = errors.New("account is disabled")
+
+func roleRank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasRole reports whether role may do everything want may.
+func HasRole(role, want string) bool {
+	return roleRank(role) >= roleRank(want)
+}
+
+// JWTRole returns the role in the request's token. It's "", same as a
+// plain user's, when there's no valid token.
+func JWTRole(r *http.Request) string {
+	ctx := r.Context()
+	if err, _ := ctx.Value("jwt.err").(error); err != nil {
+		return ""
+	}
+	token, _ := ctx.Value("jwt").(*jwt.Token)
+	return tokenClaim(token, "role")
+}
+
+// RequireRole is a middleware that goes after jwtauth.Authenticator or
+// BearerAuthenticator, and turns away users whose token doesn't carry role
+// or better. Tokens are trusted for this because taking a role away revokes
+// them.
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if !HasRole(JWTRole(r), role) {
+				e := &Error{Code: http.StatusForbidden, Message: errors.Errorf("only %ss may do that", role)}
+				e.Write(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
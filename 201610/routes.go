@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"net/http"
 	"time"
 
@@ -9,6 +10,8 @@ import (
 	"github.com/yargevad/chi/middleware"
 )
 
+var requestTimeout = flag.Duration("requesttimeout", 10*time.Second, "how long handlers get before the client is sent a 504")
+
 func buildRouter() http.Handler {
 	r := chi.NewRouter()
 
@@ -19,85 +22,173 @@ func buildRouter() http.Handler {
 	// counter.
 	r.Use(middleware.RequestID)
 
-	// Logger is a middleware that logs the start and end of each request, along
-	// with some useful data about what was requested, what the response status was,
-	// and how long it took to return. When standard output is a TTY, Logger will
-	// print in color, otherwise it will print in black and white.
-	//
-	// Logger prints a request ID if one is provided.
-	//
-	// ZapLogger is an instance of Logger customized to format errors using zap
-	r.Use(ZapLogger)
-
-	// ContentTypeChecks is a middleware that asserts Content-Type is set for POSTs
-	r.Use(ContentTypeChecks)
-
-	// Recoverer is a middleware that recovers from panics, logs the panic (and a
-	// backtrace), and returns a HTTP 500 (Internal Server Error) status if
-	// possible.
-	//
-	// Recoverer prints a request ID if one is provided.
-	//
-	// ZapRecoverer is an instance of Recoverer customized to format errors using zap
-	r.Use(ZapRecoverer)
-
-	// CloseNotify is a middleware that cancels ctx when the underlying
-	// connection has gone away. It can be used to cancel long operations
-	// on the server when the client disconnects before the response is ready.
-	r.Use(middleware.CloseNotify)
-
-	// Timeout is a middleware that cancels ctx after a given timeout and return
-	// a 504 Gateway Timeout error to the client.
-	//
-	// It's required that you select the ctx.Done() channel to check for the signal
-	// if the context has reached its deadline and return, otherwise the timeout
-	// signal will be just ignored.
-	r.Use(middleware.Timeout(10 * time.Second))
-
-	// This application lets users create polls and vote (best beer, best pizza)
-
-	r.Use(tokenAuth.Verifier)
-	// GETting / shows links to the polls
-	//   bonus: with totals cached once a second
-	r.Get("/", Index)
-
-	// GETting /login shows auth info form
-	r.Get("/login", LoginGet)
-	// Attempts login
-	r.Post("/login", LoginPost)
-
-	// Deletes a user's login cookie(s)
-	r.Get("/logout", LogoutGet)
-	// GETting /signup shows account info form
-	//   no email required, just hardcoded secret from slides
-	r.Get("/signup", SignupGet)
-	// Attempts account creation
-	r.Post("/signup", SignupPost)
-
-	r.Route("/polls", func(r chi.Router) {
-		// Shows paginated list of polls
-		r.Get("/", PollsGet)
-		// Shows poll results
-		r.Get("/:pollname/results", PollResultsGet)
-
-		// The handlers in this group reqire successful login first.
+	// Event streams stay open for as long as the client is watching, so
+	// they get a group of their own, without Timeout. StreamLogger logs them
+	// in place of ZapLogger, which can't be relied on to let them lift the
+	// server's write deadline.
+	r.Group(func(r chi.Router) {
+		r.Use(StreamLogger)
+		r.Use(SecurityHeaders)
+		r.Get("/polls/:pollname/events", PollEventsGet)
+	})
+
+	r.Group(func(r chi.Router) {
+		// Logger is a middleware that logs the start and end of each request, along
+		// with some useful data about what was requested, what the response status was,
+		// and how long it took to return. When standard output is a TTY, Logger will
+		// print in color, otherwise it will print in black and white.
+		//
+		// Logger prints a request ID if one is provided.
+		//
+		// ZapLogger is an instance of Logger customized to format errors using zap
+		r.Use(ZapLogger)
+
+		// Recoverer is a middleware that recovers from panics, logs the panic (and a
+		// backtrace), and returns a HTTP 500 (Internal Server Error) status if
+		// possible.
+		//
+		// Recoverer prints a request ID if one is provided.
+		//
+		// ZapRecoverer is an instance of Recoverer customized to format errors using zap
+		r.Use(ZapRecoverer)
+
+		// CloseNotify is a middleware that cancels ctx when the underlying
+		// connection has gone away. It can be used to cancel long operations
+		// on the server when the client disconnects before the response is ready.
+		r.Use(middleware.CloseNotify)
+
+		// SecurityHeaders sets the CSP, with a nonce for each request, and the
+		// other headers that limit what browsers let pages do
+		r.Use(SecurityHeaders)
+
+		// Timeout is a middleware that cancels ctx after a given timeout and return
+		// a 504 Gateway Timeout error to the client.
+		//
+		// It's required that you select the ctx.Done() channel to check for the signal
+		// if the context has reached its deadline and return, otherwise the timeout
+		// signal will be just ignored.
+		r.Use(middleware.Timeout(*requestTimeout))
+
+		// The JSON API has its own checks, and only takes tokens from the
+		// Authorization header.
+		r.Mount(apiPrefix, APIRouter())
+
+		// Liveness and readiness, for load balancers and orchestrators
+		r.Get("/healthz", HealthGet)
+		r.Get("/readyz", ReadyGet)
+
+		// Public keys for checking our tokens, for other services
+		r.Get("/.well-known/jwks.json", JWKSGet)
+
+		// Scripts and styles, which the CSP keeps out of pages
+		r.Get("/static/:file", StaticGet)
+
+		// This application lets users create polls and vote (best beer, best pizza)
 		r.Group(func(r chi.Router) {
-			r.Use(LogAuthErrors)
-			r.Use(jwtauth.Authenticator)
-
-			// Shows poll info form
-			r.Get("/create", PollsCreateGet)
-			// Attempts poll creation
-			r.Post("/create", PollsCreatePost)
-			r.Get("/:pollname/response", PollResponseGet)
-			// Adds a response to an existing poll
-			r.Post("/:pollname/response", PollResponsePost)
-			// Displays voting/status form
-			r.Get("/:pollname", PollViewGet)
-			// Submits vote
-			r.Post("/:pollname", PollVotePost)
+			// AcceptChecks is a middleware that picks HTML or JSON for the response,
+			// from the Accept header
+			r.Use(AcceptChecks)
+
+			// ContentTypeChecks is a middleware that asserts Content-Type is set for
+			// POSTs, PUTs and PATCHes
+			r.Use(ContentTypeChecks)
+
+			// CSRF is a middleware that hands browsers a token, and turns away
+			// form submissions that don't send it back
+			r.Use(CSRF)
+
+			r.Use(tokenAuth.Verifier)
+			// SessionChecks turns away revoked tokens, and swaps browsers'
+			// refresh token cookies for new tokens when theirs run out
+			r.Use(SessionChecks)
+			// GETting / shows links to the polls
+			//   bonus: with totals cached once a second
+			r.Get("/", Index)
+
+			// GETting /login shows auth info form
+			r.Get("/login", LoginGet)
+			// Attempts login
+			//   limited per address, with lockouts after too many failures
+			r.Post("/login", LoginPost)
+			// Asks for the code from an authenticator app, when the user
+			// has two-factor authentication on
+			r.Get("/login/mfa", LoginMFAGet)
+			r.Post("/login/mfa", LoginMFAPost)
+
+			// Revokes a user's token and deletes their login cookie(s)
+			r.Post("/logout", LogoutPost)
+			// Revokes every token a user has
+			r.With(LogAuthErrors, jwtauth.Authenticator).
+				Post("/logout/everywhere", LogoutEverywherePost)
+			// GETting /signup shows account info form
+			//   no email required, just an invitation from an admin
+			r.Get("/signup", SignupGet)
+			// Attempts account creation
+			r.With(RateLimit("signups", signupRate)).Post("/signup", SignupPost)
+			// Changes a password, given the old one or a reset code from an
+			// admin, and ends every session the user has
+			r.Get("/users/:username/password", PasswordGet)
+			r.Post("/users/:username/password", PasswordPost)
+			// Sets up two-factor authentication, or turns it off
+			r.Route("/users/:username/mfa", func(r chi.Router) {
+				r.Use(LogAuthErrors)
+				r.Use(jwtauth.Authenticator)
+
+				r.Get("/", MFAGet)
+				r.Post("/", MFAPost)
+				r.Post("/confirm", MFAConfirmPost)
+				r.Post("/delete", MFADeletePost)
+			})
+
+			// Admins see users, polls and invitations, and manage them
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(LogAuthErrors)
+				r.Use(jwtauth.Authenticator)
+				r.Use(RequireRole(RoleAdmin))
+
+				r.Get("/", AdminGet)
+				// Shows how often the poll summary cache was enough
+				r.Get("/cache", CacheStatsGet)
+				// Changes a user's role, or disables or enables them
+				r.Post("/users/:username", AdminUserPost)
+				// Issues a code the user can set a new password with
+				r.Post("/users/:username/reset", AdminPasswordResetPost)
+				r.Post("/polls/:pollname/delete", AdminPollDeletePost)
+				r.Post("/invitations", AdminInvitationsPost)
+				r.Post("/invitations/:id/delete", AdminInvitationDeletePost)
+			})
+
+			r.Route("/polls", func(r chi.Router) {
+				// Shows paginated list of polls
+				r.Get("/", PollsGet)
+				// Shows poll results
+				r.Get("/:pollname/results", PollResultsGet)
+
+				// The handlers in this group reqire successful login first.
+				r.Group(func(r chi.Router) {
+					r.Use(LogAuthErrors)
+					r.Use(jwtauth.Authenticator)
+
+					// Shows poll info form
+					r.Get("/create", PollsCreateGet)
+					// Attempts poll creation
+					r.With(RateLimit("new polls", pollRate)).Post("/create", PollsCreatePost)
+					r.Get("/:pollname/response", PollResponseGet)
+					// Adds a response to an existing poll
+					r.Post("/:pollname/response", PollResponsePost)
+					// Displays voting/status form
+					r.Get("/:pollname", PollViewGet)
+					// Submits vote
+					r.With(RateLimit("votes", voteRate)).Post("/:pollname", PollVotePost)
+					// Changes or removes a poll, for its creator only
+					r.Put("/:pollname", PollPut)
+					r.Patch("/:pollname", PollPatch)
+					r.Delete("/:pollname", PollDelete)
+					// Stops accepting votes
+					r.Post("/:pollname/close", PollClosePost)
+				})
+			})
 		})
 	})
-
 	return r
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+)
+
+var socket = flag.String("socket", "", "listen on this unix socket instead of -port")
+var tlsCert = flag.String("tlscert", "", "PEM certificate (chain) to serve https with; reloaded when it changes")
+var tlsKey = flag.String("tlskey", "", "PEM private key for -tlscert")
+var clientCA = flag.String("clientca", "", "PEM CA certificates that client certificates are checked against, for mutual TLS")
+var apiClientCert = flag.Bool("apiclientcert", false, "require a client certificate from -clientca for the JSON API")
+var redirectPort = flag.Int("redirectport", 0, "also listen for http here, redirecting to https, 0 for not at all")
+var readHeaderTimeout = flag.Duration("readheadertimeout", 5*time.Second, "how long clients get to send request headers")
+var readTimeout = flag.Duration("readtimeout", 30*time.Second, "how long clients get to send a whole request")
+var writeTimeout = flag.Duration("writetimeout", 30*time.Second, "how long a response may take to write; event streams are exempt")
+var idleTimeout = flag.Duration("idletimeout", 2*time.Minute, "how long idle keep-alive connections are kept")
+var maxHeaderBytes = flag.Int("maxheaderbytes", 64<<10, "largest request headers allowed")
+
+// How often certReloader looks at its files.
+const certCheck = 10 * time.Second
+
+// CheckServerFlags catches combinations that can't work.
+func CheckServerFlags() error {
+	switch {
+	case (*tlsCert == "") != (*tlsKey == ""):
+		return errors.New("-tlscert and -tlskey go together")
+	case *tlsCert == "" && (*clientCA != "" || *redirectPort != 0):
+		return errors.New("-clientca and -redirectport need -tlscert")
+	case *apiClientCert && *clientCA == "":
+		return errors.New("-apiclientcert needs -clientca")
+	}
+	return nil
+}
+
+// NewServer is an http.Server for handler, with the limits every listener
+// gets. Timeout in the router gives up on slow handlers; these give up on
+// slow clients, before they reach it.
+func NewServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	}
+}
+
+// certReloader serves a certificate from files, loading it again when
+// they change, so renewing it doesn't need a restart. The files are looked
+// at every certCheck, during a handshake. A bad new certificate is logged,
+// and the old one kept.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(time.Now()); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// modified is the later of the files' modification times.
+func (cr *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return latest, errors.Wrap(err, "tls stat failed")
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the certificate if the files have changed. The caller holds
+// cr.mu, or has the only reference.
+func (cr *certReloader) load(now time.Time) error {
+	cr.checkedAt = now
+	modTime, err := cr.modified()
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil && modTime.Equal(cr.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "tls certificate load failed")
+	}
+	if cr.cert != nil {
+		env.Log.Info("tls certificate reloaded", zap.String("file", cr.certFile))
+	}
+	cr.cert, cr.modTime = &cert, modTime
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if now := time.Now(); now.Sub(cr.checkedAt) >= certCheck {
+		if err := cr.load(now); err != nil {
+			env.Log.Error("tls certificate reload failed", zap.Error(err))
+		}
+	}
+	return cr.cert, nil
+}
+
+// TLSConfig is the config the flags ask for, or nil for plain http.
+func TLSConfig() (*tls.Config, error) {
+	if *tlsCert == "" {
+		return nil, nil
+	}
+	cr, err := newCertReloader(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+
+	if *clientCA != "" {
+		pem, err := ioutil.ReadFile(*clientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "client CA read failed")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates in %s", *clientCA)
+		}
+		// browsers don't have one, so only the API may insist
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// ClientCertName is the common name of the request's verified client
+// certificate, or "" if it hasn't one.
+func ClientCertName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// RequireClientCert is a middleware that turns away requests without a
+// verified client certificate, when -apiclientcert says to.
+func RequireClientCert(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if *apiClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			e := &Error{Code: http.StatusUnauthorized, Message: errors.New("a client certificate is required")}
+			e.Write(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// RedirectToHTTPS sends http requests to the same place over https.
+func RedirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if *port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(*port))
+	}
+	w.Header().Set("Connection", "close")
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// listen opens the listener the flags ask for. A unix socket left over
+// from before is removed first.
+func listen() (net.Listener, error) {
+	if *socket == "" {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+		return ln, errors.Wrap(err, "listen failed")
+	}
+	if fi, err := os.Stat(*socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(*socket); err != nil {
+			return nil, errors.Wrap(err, "stale socket remove failed")
+		}
+	}
+	ln, err := net.Listen("unix", *socket)
+	return ln, errors.Wrap(err, "listen failed")
+}
+
+// Serve listens where the flags say, and starts serving handler. The
+// servers are returned for Shutdown; if one fails, its error comes on errs.
+func Serve(handler http.Handler, errs chan<- error) ([]*http.Server, error) {
+	config, err := TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	srv := NewServer(handler)
+	servers := []*http.Server{srv}
+
+	if config == nil {
+		env.Log.Info("Listening on " + ln.Addr().String())
+		go serveUntilShutdown(errs, func() error { return srv.Serve(ln) })
+		return servers, nil
+	}
+	if *redirectPort != 0 {
+		redirects := NewServer(http.HandlerFunc(RedirectToHTTPS))
+		redirects.Addr = fmt.Sprintf(":%d", *redirectPort)
+		servers = append(servers, redirects)
+		env.Log.Info("Redirecting to https from " + redirects.Addr)
+		go serveUntilShutdown(errs, redirects.ListenAndServe)
+	}
+	srv.TLSConfig = config
+	env.Log.Info("Listening with tls on " + ln.Addr().String())
+	// the certificate comes from config; ServeTLS sets up HTTP/2 as well
+	go serveUntilShutdown(errs, func() error { return srv.ServeTLS(ln, "", "") })
+	return servers, nil
+}
+
+// serveUntilShutdown runs serve, passing on any error but the one
+// Shutdown causes.
+func serveUntilShutdown(errs chan<- error, serve func() error) {
+	if err := serve(); err != http.ErrServerClosed {
+		errs <- err
+	}
+}
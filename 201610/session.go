@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/goware/jwtauth"
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+)
+
+// Access tokens are short-lived, and checked against the revocation list on
+// every request. Refresh tokens get new ones, and are replaced each time
+// they're used.
+var accessLifetime = flag.Duration("accesslifetime", 15*time.Minute, "how long access tokens last")
+var refreshLifetime = flag.Duration("refreshlifetime", 30*24*time.Hour, "how long refresh tokens last")
+
+// A refresh token used again this soon after the first time is taken to be
+// the same client racing itself, not a stolen copy.
+const refreshReuseGrace = 10 * time.Second
+
+const refreshCookie = "refresh"
+
+var (
+	ErrTokenRevoked  = errors.New("jwtauth: token is revoked")
+	ErrRefreshReused = errors.New("refresh token was already used")
+	// ErrRefreshRaced is a refresh token used again within the grace
+	// period. Another request has the new tokens, so the client should keep
+	// the ones it's getting.
+	ErrRefreshRaced = errors.New("refresh token was just used")
+)
+
+// RefreshToken is the stored half of a refresh token. The client holds a
+// random string, and ID is its SHA-256, so a copy of the store isn't enough
+// to log in with.
+type RefreshToken struct {
+	ID   string
+	User string
+	// Session is shared by every refresh token a login goes through.
+	Session   string
+	ExpiresAt time.Time
+	UsedAt    *time.Time `json:",omitempty"`
+}
+
+// Session is what logging in gets you.
+type Session struct {
+	Name             string
+	Token            string
+	ExpiresAt        time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+
+	token *jwt.Token
+}
+
+// Refresh is what a client sends to get a new Session.
+type Refresh struct {
+	RefreshToken string
+}
+
+func (r *Refresh) Validate() (*Refresh, *Error) {
+	if r.RefreshToken == "" {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("RefreshToken is required")}
+		return nil, e
+	}
+	return r, nil
+}
+
+func RefreshFromJSON(r io.Reader) (*Refresh, *Error) {
+	refresh := &Refresh{}
+	if err := json.NewDecoder(r).Decode(refresh); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "json decoding failed"),
+		}
+		return nil, e
+	}
+	return refresh.Validate()
+}
+
+// randomString returns n random bytes, base64 encoded for URLs.
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "random read failed")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken is what refresh tokens and invitation codes are stored as.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSession logs userName in.
+func NewSession(userName string) (*Session, *Error) {
+	id, err := randomString(16)
+	if err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Message: err}
+	}
+	return issueSession(userName, id)
+}
+
+// issueSession makes a new access and refresh token pair for a session.
+// The user is looked up each time, so their role is current, and disabled
+// accounts can't keep their sessions going.
+func issueSession(userName, sessionID string) (*Session, *Error) {
+	user, e := UserByUsername(userName)
+	if e != nil {
+		return nil, e
+	}
+	if user.Disabled {
+		return nil, &Error{Code: http.StatusForbidden, Message: ErrAccountDisabled}
+	}
+
+	jti, err := randomString(16)
+	if err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Message: err}
+	}
+	refresh, err := randomString(32)
+	if err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Message: err}
+	}
+
+	now := time.Now()
+	s := &Session{
+		Name:             userName,
+		ExpiresAt:        now.Add(*accessLifetime),
+		RefreshToken:     refresh,
+		RefreshExpiresAt: now.Add(*refreshLifetime),
+	}
+	claims := setIssuedAt(jwtauth.Claims{"user": userName, "jti": jti, "sid": sessionID}.
+		SetExpiry(s.ExpiresAt), now)
+	if user.Role != RoleUser {
+		claims.Set("role", user.Role)
+	}
+	s.token, s.Token, err = tokenAuth.Encode(claims)
+	if err != nil {
+		e := &Error{
+			Code:    http.StatusInternalServerError,
+			Message: errors.Wrap(err, "jwt encoding failed"),
+		}
+		return nil, e
+	}
+	// only parsing sets this, but we've just signed it ourselves
+	s.token.Valid = true
+
+	err = env.Store.CreateRefreshToken(&RefreshToken{
+		ID:        hashToken(refresh),
+		User:      userName,
+		Session:   sessionID,
+		ExpiresAt: s.RefreshExpiresAt,
+	})
+	if err != nil {
+		return nil, StoreError(err)
+	}
+	return s, nil
+}
+
+// RefreshSession swaps a refresh token for a new Session. Each refresh
+// token works once. If one turns up again later, someone has a copy of it,
+// so the whole session is ended. Sooner than that, it's ErrRefreshRaced.
+func RefreshSession(refreshToken string) (*Session, *Error) {
+	now := time.Now()
+	t, err := env.Store.UseRefreshToken(hashToken(refreshToken), now)
+	if err != nil {
+		return nil, StoreError(err)
+	}
+	if t.UsedAt != nil {
+		if now.Sub(*t.UsedAt) <= refreshReuseGrace {
+			return nil, &Error{Code: http.StatusUnauthorized, Message: ErrRefreshRaced}
+		}
+		if err = env.Store.DeleteSession(t.Session); err != nil {
+			return nil, StoreError(err)
+		}
+		env.Log.Warn("refresh token reused, session ended",
+			zap.String("user", t.User), zap.String("session", t.Session))
+		return nil, &Error{Code: http.StatusUnauthorized, Message: ErrRefreshReused}
+	}
+	if now.After(t.ExpiresAt) {
+		return nil, &Error{Code: http.StatusUnauthorized, Message: jwtauth.ErrExpired}
+	}
+	return issueSession(t.User, t.Session)
+}
+
+// SetCookies hands the session to a browser.
+func (s *Session) SetCookies(w http.ResponseWriter) {
+	http.SetCookie(w, newCookie("jwt", s.Token, time.Time{}))
+	http.SetCookie(w, newCookie(refreshCookie, s.RefreshToken, s.RefreshExpiresAt))
+}
+
+// ClearSessionCookies has a browser forget its session.
+func ClearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{"jwt", refreshCookie} {
+		clearCookie(w, name)
+	}
+}
+
+func tokenClaim(token *jwt.Token, name string) string {
+	if token == nil {
+		return ""
+	}
+	claim, _ := token.Claims[name].(string)
+	return claim
+}
+
+// setIssuedAt is jwtauth's SetIssuedAt to the millisecond, which JWT
+// allows, so a token issued just after its user's tokens were revoked
+// isn't taken for one from before.
+func setIssuedAt(claims jwtauth.Claims, now time.Time) jwtauth.Claims {
+	claims["iat"] = float64(now.UnixMilli()) / 1000
+	return claims
+}
+
+// timeClaim reads a time claim, which is an int64 or float64 in tokens
+// we've just encoded and a float64 in ones we've decoded.
+func timeClaim(token *jwt.Token, name string) time.Time {
+	switch n := token.Claims[name].(type) {
+	case float64:
+		return time.UnixMilli(int64(math.Round(n * 1000)))
+	case int64:
+		return time.Unix(n, 0)
+	}
+	return time.Time{}
+}
+
+// CheckRevoked makes sure a token that's otherwise valid hasn't been
+// revoked, by itself or along with the rest of the user's.
+func CheckRevoked(token *jwt.Token) error {
+	jti := tokenClaim(token, "jti")
+	if jti == "" {
+		// from before tokens could be revoked
+		return jwtauth.ErrUnauthorized
+	}
+	revoked, err := env.Store.TokenRevoked(jti)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrTokenRevoked
+	}
+
+	revokedAt, err := env.Store.UserTokensRevokedAt(tokenClaim(token, "user"))
+	if err != nil {
+		return err
+	}
+	// iat only has milliseconds, so tokens from the millisecond of
+	// revocation go too
+	if !revokedAt.IsZero() && !timeClaim(token, "iat").After(revokedAt) {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// SessionChecks is a middleware that goes after tokenAuth.Verifier. It
+// turns revoked tokens away, and logs browsers back in with their refresh
+// token cookie when their access token is missing or has run out.
+func SessionChecks(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		err, _ := ctx.Value("jwt.err").(error)
+		if err == nil {
+			if err = CheckRevoked(ctx.Value("jwt").(*jwt.Token)); err != nil {
+				ctx = tokenAuth.SetContext(ctx, nil, err)
+			}
+		}
+
+		if err != nil && err != ErrTokenRevoked {
+			if cookie, cerr := r.Cookie(refreshCookie); cerr == nil {
+				session, e := RefreshSession(cookie.Value)
+				if e != nil {
+					// a request racing this one has set new cookies
+					if e.Message != ErrRefreshRaced {
+						ClearSessionCookies(w)
+					}
+				} else {
+					session.SetCookies(w)
+					ctx = tokenAuth.SetContext(ctx, session.token, nil)
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// EndSession revokes the request's access token, and the refresh tokens of
+// the session it belongs to. A browser's refresh token cookie is used to
+// find the session when the access token has already run out.
+func EndSession(r *http.Request) *Error {
+	ctx := r.Context()
+	token, _ := ctx.Value("jwt").(*jwt.Token)
+	if err, _ := ctx.Value("jwt.err").(error); err != nil {
+		token = nil
+	}
+
+	sessionID := tokenClaim(token, "sid")
+	if jti := tokenClaim(token, "jti"); jti != "" {
+		if err := env.Store.RevokeToken(jti, timeClaim(token, "exp")); err != nil {
+			return StoreError(err)
+		}
+	}
+	if sessionID == "" {
+		cookie, err := r.Cookie(refreshCookie)
+		if err != nil {
+			return nil
+		}
+		t, err := env.Store.UseRefreshToken(hashToken(cookie.Value), time.Now())
+		if errors.Cause(err) == ErrNoSuchToken {
+			return nil
+		} else if err != nil {
+			return StoreError(err)
+		}
+		sessionID = t.Session
+	}
+	if err := env.Store.DeleteSession(sessionID); err != nil {
+		return StoreError(err)
+	}
+	return nil
+}
+
+// EndAllSessions logs userName out everywhere.
+func EndAllSessions(userName string) *Error {
+	now := time.Now()
+	// access tokens issued up to now have expired by then
+	if err := env.Store.RevokeUserTokens(userName, now, now.Add(*accessLifetime)); err != nil {
+		return StoreError(err)
+	}
+	return nil
+}
+
+// CleanupTokens deletes expired refresh tokens and revocations every
+// interval, until stop is closed.
+func CleanupTokens(interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+		n, err := env.Store.DeleteExpiredTokens(time.Now())
+		if err != nil {
+			env.Log.Error("token cleanup failed", zap.Error(err))
+			continue
+		}
+		env.Log.Info("token cleanup", zap.Int("deleted", n))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func sessionUser(t *testing.T) *Session {
+	resetEnv(t)
+	if err := env.Store.CreateUser(&User{Name: "alice", Pass: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	s, e := NewSession("alice")
+	if e != nil {
+		t.Fatal(e.Message)
+	}
+	return s
+}
+
+// refreshCookies sends a browser's request with only a refresh token
+// cookie through SessionChecks, and returns the cookies it's sent back.
+func refreshCookies(refreshToken string) map[string]*http.Cookie {
+	h := tokenAuth.Verifier(SessionChecks(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: refreshCookie, Value: refreshToken})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	cookies := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	return cookies
+}
+
+func TestSessionChecksRefresh(t *testing.T) {
+	s := sessionUser(t)
+	cookies := refreshCookies(s.RefreshToken)
+	if c := cookies[refreshCookie]; c == nil || c.Value == "" || c.Value == s.RefreshToken {
+		t.Errorf("refresh cookie %v", c)
+	}
+	if c := cookies["jwt"]; c == nil || c.Value == "" {
+		t.Errorf("jwt cookie %v", c)
+	}
+}
+
+// Parallel requests that all find the access token expired send the same
+// refresh token. The one that loses mustn't clear the winner's cookies.
+func TestSessionChecksRefreshRaced(t *testing.T) {
+	s := sessionUser(t)
+	if _, e := RefreshSession(s.RefreshToken); e != nil {
+		t.Fatal(e.Message)
+	}
+	if cookies := refreshCookies(s.RefreshToken); len(cookies) != 0 {
+		t.Errorf("sent cookies %v", cookies)
+	}
+}
+
+func TestSessionChecksRefreshReused(t *testing.T) {
+	s := sessionUser(t)
+	if _, err := env.Store.UseRefreshToken(hashToken(s.RefreshToken), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	cookies := refreshCookies(s.RefreshToken)
+	for _, name := range []string{"jwt", refreshCookie} {
+		if c := cookies[name]; c == nil || c.MaxAge >= 0 {
+			t.Errorf("%s cookie %v, want it cleared", name, c)
+		}
+	}
+	// and the session is over
+	if _, e := RefreshSession(s.RefreshToken); e == nil || errors.Cause(e.Message) != ErrNoSuchToken {
+		t.Errorf("got %v, want %v", e, ErrNoSuchToken)
+	}
+}
+
+// A script that changes a password and logs straight back in gets a token
+// that works, even within the same second.
+func TestTokensAfterRevocation(t *testing.T) {
+	before := sessionUser(t)
+	if e := EndAllSessions("alice"); e != nil {
+		t.Fatal(e.Message)
+	}
+	// tokens from the millisecond of revocation are revoked too
+	time.Sleep(2 * time.Millisecond)
+	after, e := NewSession("alice")
+	if e != nil {
+		t.Fatal(e.Message)
+	}
+
+	if _, err := VerifyToken(before.Token); err != ErrTokenRevoked {
+		t.Errorf("token from before: got %v, want %v", err, ErrTokenRevoked)
+	}
+	if _, err := VerifyToken(after.Token); err != nil {
+		t.Errorf("token from after: %v", err)
+	}
+}
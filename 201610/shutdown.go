@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+var shutdownDelay = flag.Duration("shutdowndelay", 5*time.Second, "how long /readyz says not ready before the listeners close, so load balancers stop sending requests")
+var shutdownTimeout = flag.Duration("shutdowntimeout", 30*time.Second, "how long requests in flight get to finish when shutting down")
+
+// draining is set once shutdown starts.
+var draining int32
+
+// Health says whether the process is up, or ready for requests.
+type Health struct {
+	Status string
+}
+
+// HealthGet is for liveness checks: anything that can answer is alive.
+func HealthGet(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, r, http.StatusOK, &Health{Status: "ok"})
+}
+
+// ReadyGet is for load balancers. It says not ready once shutdown starts,
+// while requests are still being served, so they can be sent elsewhere.
+func ReadyGet(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&draining) != 0 {
+		WriteJSON(w, r, http.StatusServiceUnavailable, &Health{Status: "shutting down"})
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, &Health{Status: "ready"})
+}
+
+// Shutdown stops the servers without cutting off requests in flight.
+// Readiness goes first, and the servers keep serving for -shutdowndelay
+// while load balancers notice. Then the listeners close, and requests get
+// up to -shutdowntimeout to finish before their connections are closed.
+// Event streams would never finish on their own, so they're ended, and
+// clients reconnect to another server.
+func Shutdown(servers []*http.Server) {
+	atomic.StoreInt32(&draining, 1)
+	env.Log.Info("draining", zap.Duration("delay", *shutdownDelay))
+	time.Sleep(*shutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				env.Log.Warn("requests cut off", zap.Error(err))
+				srv.Close()
+			}
+		}(srv)
+	}
+	env.Events.Close()
+	wg.Wait()
+}
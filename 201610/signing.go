@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/goware/jwtauth"
+	"github.com/pkg/errors"
+	"github.com/yargevad/crypto/naclutil"
+)
+
+// Tokens are signed with ES256 by the newest of a set of keys, and name it
+// in their "kid" header. Older keys are kept to check tokens with until
+// everything they signed has expired, so rotating keys logs nobody out. The
+// public halves are served at /.well-known/jwks.json, for other services
+// to check our tokens without knowing any secret.
+const jwtAlg = "ES256"
+
+// How often a server looks at the key file for keys rotated in by someone
+// else. Tokens signed with a key it hasn't seen yet make it look right away,
+// but no more often than unknownKeyRecheck, so made-up key IDs can't keep
+// it reading.
+const (
+	keyRecheck        = 10 * time.Second
+	unknownKeyRecheck = time.Second
+)
+
+var ErrUnknownKey = errors.New("jwtauth: unknown signing key")
+
+// SigningKey is one of the keys tokens are signed with.
+type SigningKey struct {
+	ID        string
+	CreatedAt time.Time
+	// RetiredAt is when a newer key took over signing.
+	RetiredAt *time.Time `json:",omitempty"`
+	// PrivateKey is the SEC 1 ASN.1 DER form.
+	PrivateKey []byte
+
+	key *ecdsa.PrivateKey
+}
+
+func NewSigningKey(now time.Time) (*SigningKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "key generation failed")
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "key encoding failed")
+	}
+	k := &SigningKey{CreatedAt: now, PrivateKey: der, key: key}
+	k.ID = k.Thumbprint()
+	return k, nil
+}
+
+// JWK is a public key, as RFC 7517 has it.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+func (k *SigningKey) JWK() JWK {
+	size := (k.key.Curve.Params().BitSize + 7) / 8
+	x := k.key.X.FillBytes(make([]byte, size))
+	y := k.key.Y.FillBytes(make([]byte, size))
+	return JWK{
+		Kty: "EC",
+		Crv: k.key.Curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Y:   base64.RawURLEncoding.EncodeToString(y),
+		Kid: k.ID,
+		Use: "sig",
+		Alg: jwtAlg,
+	}
+}
+
+// Thumbprint is the RFC 7638 thumbprint of the public key, which we use as
+// its ID.
+func (k *SigningKey) Thumbprint() string {
+	jwk := k.JWK()
+	// the members it needs, in lexical order, without whitespace
+	canonical := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// keyFile is where the token signing keys are kept.
+func keyFile(path, name string) string {
+	return fmt.Sprintf("%s/%s-jwt.json", path, name)
+}
+
+// readKeys returns the keys in the file, newest first, and when it was last
+// written.
+func readKeys(file string) ([]*SigningKey, time.Time, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "key file stat failed")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "key file read failed")
+	}
+	var keys []*SigningKey
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "key file decoding failed")
+	}
+	if len(keys) == 0 {
+		return nil, time.Time{}, errors.Errorf("no keys in %s", file)
+	}
+	for _, k := range keys {
+		if k.key, err = x509.ParseECPrivateKey(k.PrivateKey); err != nil {
+			return nil, time.Time{}, errors.Wrapf(err, "key %s decoding failed", k.ID)
+		}
+	}
+	return keys, fi.ModTime(), nil
+}
+
+// writeKeys replaces the key file, so a server reading it never sees half
+// of one.
+func writeKeys(file string, keys []*SigningKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "key file encoding failed")
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "key file write failed")
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		return errors.Wrap(err, "key file rename failed")
+	}
+	return nil
+}
+
+// RotateKeys has a new key take over signing tokens. Keys that stopped
+// signing long enough ago that their tokens have all expired are dropped.
+// Running servers pick the change up by themselves.
+func RotateKeys(path, name string) (*SigningKey, error) {
+	if err := naclutil.CreateKeyStore(path); err != nil {
+		return nil, err
+	}
+	file := keyFile(path, name)
+	keys, _, err := readKeys(file)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	now := time.Now()
+	key, err := NewSigningKey(now)
+	if err != nil {
+		return nil, err
+	}
+	kept := []*SigningKey{key}
+	for i, k := range keys {
+		if i == 0 {
+			k.RetiredAt = &now
+		}
+		// servers may not notice for a little while, and sign with it until then
+		if k.RetiredAt == nil || k.RetiredAt.Add(*accessLifetime+keyRecheck).After(now) {
+			kept = append(kept, k)
+		}
+	}
+	if err = writeKeys(file, kept); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// TokenAuth signs and checks our tokens. It stands in for jwtauth.JwtAuth,
+// which only knows about keys that are a []byte, and keeps tokens in the
+// request context the same way.
+type TokenAuth struct {
+	file string
+
+	mu        sync.RWMutex
+	keys      []*SigningKey
+	modTime   time.Time
+	checkedAt time.Time
+	// unknownAt is when a token with a key we didn't have last made us look
+	unknownAt time.Time
+}
+
+// LoadTokenAuth reads the token signing keys, making the first one if there
+// are none yet.
+func LoadTokenAuth(path, name string) (*TokenAuth, error) {
+	file := keyFile(path, name)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if _, err = RotateKeys(path, name); err != nil {
+			return nil, err
+		}
+	}
+	keys, modTime, err := readKeys(file)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenAuth{file: file, keys: keys, modTime: modTime, checkedAt: time.Now()}, nil
+}
+
+// reload rereads the key file if it has changed since it was last read, and
+// hasn't been looked at too recently.
+func (ta *TokenAuth) reload() {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	if time.Since(ta.checkedAt) < keyRecheck {
+		return
+	}
+	ta.read()
+}
+
+// reloadUnknown is reload for a token signed with a key we don't have,
+// which needn't wait for keyRecheck.
+func (ta *TokenAuth) reloadUnknown() {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	if time.Since(ta.unknownAt) < unknownKeyRecheck {
+		return
+	}
+	ta.unknownAt = time.Now()
+	ta.read()
+}
+
+// read rereads the key file if it has changed. ta.mu must be held.
+func (ta *TokenAuth) read() {
+	ta.checkedAt = time.Now()
+	fi, err := os.Stat(ta.file)
+	if err != nil || fi.ModTime().Equal(ta.modTime) {
+		return
+	}
+	keys, modTime, err := readKeys(ta.file)
+	if err != nil {
+		// a bad file shouldn't stop us using the keys we have
+		env.Log.Error(err.Error())
+		return
+	}
+	ta.keys, ta.modTime = keys, modTime
+}
+
+// Keys returns the keys tokens may be signed with, newest first.
+func (ta *TokenAuth) Keys() []*SigningKey {
+	ta.mu.RLock()
+	defer ta.mu.RUnlock()
+	return ta.keys
+}
+
+func (ta *TokenAuth) key(id string) *SigningKey {
+	for _, k := range ta.Keys() {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+func (ta *TokenAuth) Encode(claims jwtauth.Claims) (t *jwt.Token, tokenString string, err error) {
+	ta.reload()
+	key := ta.Keys()[0]
+	t = jwt.New(jwt.GetSigningMethod(jwtAlg))
+	t.Header["kid"] = key.ID
+	t.Claims = claims
+	tokenString, err = t.SignedString(key.key)
+	t.Raw = tokenString
+	return
+}
+
+func (ta *TokenAuth) Decode(tokenString string) (*jwt.Token, error) {
+	parser := &jwt.Parser{ValidMethods: []string{jwtAlg}}
+	return parser.Parse(tokenString, ta.keyFunc)
+}
+
+func (ta *TokenAuth) keyFunc(t *jwt.Token) (interface{}, error) {
+	id, _ := t.Header["kid"].(string)
+	key := ta.key(id)
+	if key == nil {
+		// it may have been rotated in by another server
+		ta.reloadUnknown()
+		if key = ta.key(id); key == nil {
+			return nil, ErrUnknownKey
+		}
+	}
+	return &key.key.PublicKey, nil
+}
+
+// Verify checks that a token was signed by one of our keys, and hasn't
+// expired. Errors are the ones jwtauth uses. The token is returned even
+// when it fails, if it could be decoded. Tokens waiting on a second factor
+// aren't good for anything but sending it, so they fail.
+func (ta *TokenAuth) Verify(tokenString string) (*jwt.Token, error) {
+	token, err := ta.verify(tokenString)
+	if err == nil && token.Claims["mfa"] != nil {
+		return token, jwtauth.ErrUnauthorized
+	}
+	return token, err
+}
+
+// verify is Verify for tokens of any kind.
+func (ta *TokenAuth) verify(tokenString string) (*jwt.Token, error) {
+	if tokenString == "" {
+		return nil, jwtauth.ErrUnauthorized
+	}
+	token, err := ta.Decode(tokenString)
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors == jwt.ValidationErrorExpired {
+		return token, jwtauth.ErrExpired
+	} else if err != nil || token == nil || !token.Valid {
+		return token, jwtauth.ErrUnauthorized
+	}
+	return token, nil
+}
+
+// Verifier is a middleware like jwtauth's. It looks for a token in the
+// "jwt" query parameter, then an "Authorization: Bearer" header, then the
+// "jwt" cookie, and puts it in the request context along with anything
+// wrong with it.
+func (ta *TokenAuth) Verifier(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		tokenString := r.URL.Query().Get("jwt")
+		if tokenString == "" {
+			auth := r.Header.Get("Authorization")
+			if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+				tokenString = auth[7:]
+			}
+		}
+		if tokenString == "" {
+			if cookie, err := r.Cookie("jwt"); err == nil {
+				tokenString = cookie.Value
+			}
+		}
+
+		token, err := ta.Verify(tokenString)
+		ctx := ta.SetContext(r.Context(), token, err)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func (ta *TokenAuth) SetContext(ctx context.Context, t *jwt.Token, err error) context.Context {
+	ctx = context.WithValue(ctx, "jwt", t)
+	ctx = context.WithValue(ctx, "jwt.err", err)
+	return ctx
+}
+
+// JWKSGet serves the public keys our tokens are signed with, as an RFC 7517
+// JWK Set.
+func JWKSGet(w http.ResponseWriter, r *http.Request) {
+	keys := tokenAuth.Keys()
+	set := struct {
+		Keys []JWK `json:"keys"`
+	}{Keys: make([]JWK, len(keys))}
+	for i, k := range keys {
+		set.Keys[i] = k.JWK()
+	}
+	// new keys sign right away, so a "kid" that isn't here means fetch again
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	WriteJSON(w, r, http.StatusOK, set)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goware/jwtauth"
+)
+
+func signedBy(t *testing.T, ta *TokenAuth) string {
+	claims := jwtauth.Claims{"user": "alice"}.SetExpiry(time.Now().Add(time.Minute))
+	_, token, err := ta.Encode(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// After -rotatekeys, other servers take tokens signed with the new key
+// without waiting to look at the key file again.
+func TestTokenAuthUnknownKey(t *testing.T) {
+	dir := t.TempDir()
+	server, err := LoadTokenAuth(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotate := func() string {
+		if _, err := RotateKeys(dir, "test"); err != nil {
+			t.Fatal(err)
+		}
+		// the server that rotated, or one started since
+		signer, err := LoadTokenAuth(dir, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedBy(t, signer)
+	}
+
+	if _, err = server.Verify(rotate()); err != nil {
+		t.Errorf("new key: %v", err)
+	}
+
+	// made-up keys can't have it read the file every time
+	token := rotate()
+	if _, err = server.Verify(token); err != jwtauth.ErrUnauthorized {
+		t.Errorf("another new key straight away: got %v, want %v", err, jwtauth.ErrUnauthorized)
+	}
+	server.unknownAt = server.unknownAt.Add(-unknownKeyRecheck)
+	if _, err = server.Verify(token); err != nil {
+		t.Errorf("another new key later: %v", err)
+	}
+}
@@ -1,30 +1,39 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"flag"
 	"html/template"
 	"io"
 	"net/http"
+	"regexp"
+	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// Signup needs an invitation from an admin. Until there is an admin, the
+// -secret flag works instead, and makes whoever uses it the first one.
 type Signup struct {
 	User
-	Secret string
+	Invitation string
+	Secret     string
 }
 
-const (
-	signupPostMax int64 = 1024
-	bcryptCost    int   = 13
-)
+var signupPostMax = flag.Int64("signuppostmax", 1024, "largest signup form or JSON body")
+
+// Changing -bcryptcost re-hashes passwords as their users log in.
+var bcryptCost = flag.Int("bcryptcost", 13, "bcrypt cost for password hashes, 10 to 31")
 
 var signupTemplate *template.Template
 
+// Usernames go in URLs like /users/{username}, so they're kept to
+// characters that need no escaping there.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$`)
+
 func init() {
-	signupTemplate = template.Must(template.ParseFiles("templates/signup.html"))
+	signupTemplate = parseTemplate("templates/signup.html")
 }
 
 func SignupGet(w http.ResponseWriter, r *http.Request) {
@@ -35,7 +44,7 @@ func SignupGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := signupTemplate.Execute(w, nil)
+	err := renderTemplate(w, r, signupTemplate, r.URL.Query().Get("invitation"))
 	if err != nil {
 		e := &Error{
 			Code:    http.StatusInternalServerError,
@@ -50,7 +59,7 @@ func SignupPost(w http.ResponseWriter, r *http.Request) {
 	inType := r.Context().Value("content-type").(string)
 
 	// limit the amount of data we accept for a signup request
-	r.Body = http.MaxBytesReader(w, r.Body, signupPostMax)
+	r.Body = http.MaxBytesReader(w, r.Body, *signupPostMax)
 	defer r.Body.Close()
 
 	var signup *Signup
@@ -76,17 +85,22 @@ func SignupPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Location", "/")
-	w.WriteHeader(http.StatusFound)
+	Respond(w, r, http.StatusCreated, &User{Name: signup.Name}, "/")
 }
 
 func (s *Signup) Validate() (*Signup, *Error) {
 	if _, e := s.User.Validate(); e != nil {
 		return nil, e
-	} else if len(s.Secret) == 0 {
-		e := &Error{Code: http.StatusBadRequest, Message: errors.New("Secret is required")}
+	} else if !usernamePattern.MatchString(s.Name) {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("names must be 1 to 32 letters, digits, '.', '_' or '-', starting with a letter or digit")}
+		return nil, e
+	} else if e = CheckPassword(s.Name, s.Pass); e != nil {
 		return nil, e
-	} else if s.Secret != env.Secret {
+	} else if len(s.Invitation) == 0 && len(s.Secret) == 0 {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("Invitation is required")}
+		return nil, e
+	} else if len(s.Invitation) == 0 &&
+		(env.Secret == "" || subtle.ConstantTimeCompare([]byte(s.Secret), []byte(env.Secret)) != 1) {
 		e := &Error{Code: http.StatusBadRequest, Message: errors.New("Incorrect secret")}
 		return nil, e
 	}
@@ -133,45 +147,34 @@ func SignupFromJSON(r io.Reader) (*Signup, *Error) {
 
 func (s *Signup) Save() *Error {
 	var e *Error
-	code := http.StatusInternalServerError
+	var err error
 	u := s.User
-	// bcrypt password
-	bcrypted, err := bcrypt.GenerateFromPassword([]byte(u.Pass), bcryptCost)
-	if err != nil {
-		e = &Error{
-			Code:    http.StatusInternalServerError,
-			Message: errors.Wrap(err, "bcrypt failed"),
-		}
-		return e
-	}
-	u.Pass = string(bcrypted)
-	jsonBytes, err := json.Marshal(u)
-	if err != nil {
-		e = &Error{
-			Code:    http.StatusInternalServerError,
-			Message: errors.Wrap(err, "user marshal failed"),
-		}
+	if u.Pass, e = HashPassword(u.Pass); e != nil {
 		return e
 	}
 
-	err = env.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("users"))
-		if b == nil {
-			return errors.New("no users bucket")
-		}
-		if val := b.Get([]byte(u.Name)); val != nil {
-			code = http.StatusConflict
-			return errors.New("user exists")
+	if s.Invitation != "" {
+		u.Role = ""
+		err = env.Store.CreateInvitedUser(&u, hashToken(s.Invitation), time.Now())
+	} else {
+		u.Role = RoleAdmin
+		err = env.Store.CreateFirstAdmin(&u)
+	}
+	switch errors.Cause(err) {
+	case nil:
+		return nil
+	case ErrNoSuchInvitation:
+		e = &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.New("Invitation is invalid, used or expired"),
 		}
-		err := b.Put([]byte(u.Name), jsonBytes)
-		if err != nil {
-			return errors.Wrap(err, "create failed")
+	case ErrAdminExists:
+		e = &Error{
+			Code:    http.StatusForbidden,
+			Message: errors.New("the secret only signs up the first admin, ask an admin for an invitation"),
 		}
-		return nil
-	})
-
-	if err != nil {
-		return &Error{Code: code, Message: err}
+	default:
+		e = StoreError(err)
 	}
-	return nil
+	return e
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSignupUsernames(t *testing.T) {
+	env.Secret = "s"
+	defer func() { env.Secret = "" }()
+
+	for _, tt := range []struct {
+		name string
+		ok   bool
+	}{
+		{"alice", true},
+		{"Alice.B-C_9", true},
+		{"9lives", true},
+		{strings.Repeat("a", 32), true},
+		{strings.Repeat("a", 33), false},
+		{"a/b", false},
+		{"a?b", false},
+		{"a#b", false},
+		{"a b", false},
+		{"a%2Fb", false},
+		{"a\x00b", false},
+		{"a\nb", false},
+		{".hidden", false},
+		{"-flag", false},
+		{"zoë", false},
+	} {
+		s := &Signup{User: User{Name: tt.name, Pass: "correct horse"}, Secret: "s"}
+		_, e := s.Validate()
+		if tt.ok && e != nil {
+			t.Errorf("%q: %v", tt.name, e.Message)
+		} else if !tt.ok && (e == nil || e.Code != http.StatusBadRequest) {
+			t.Errorf("%q: got %v, want a 400", tt.name, e)
+		}
+	}
+}
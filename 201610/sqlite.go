@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// Build with -tags sqlite to use -dbdriver sqlite3 -dsn file.db
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,161 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestSQLCreateFirstAdmin(t *testing.T) {
+	s, err := SQLOpen("sqlite3", filepath.Join(t.TempDir(), "dengo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err = s.CreateFirstAdmin(&User{Name: "alice", Pass: "x"}); err != nil {
+		t.Fatalf("first admin: %v", err)
+	}
+	if err = s.CreateFirstAdmin(&User{Name: "alice", Pass: "x"}); errors.Cause(err) != ErrUserExists {
+		t.Errorf("same name again: got %v, want %v", err, ErrUserExists)
+	}
+	if err = s.CreateFirstAdmin(&User{Name: "bob", Pass: "x"}); errors.Cause(err) != ErrAdminExists {
+		t.Errorf("second admin: got %v, want %v", err, ErrAdminExists)
+	}
+	u, err := s.UserByName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Role != RoleAdmin {
+		t.Errorf("role = %q, want %q", u.Role, RoleAdmin)
+	}
+	if _, err = s.UserByName("bob"); errors.Cause(err) != ErrNoSuchUser {
+		t.Errorf("bob: got %v, want %v", err, ErrNoSuchUser)
+	}
+}
+
+// unmigrate forgets the migration starting with prefix, and the ones after
+// it, so they run again next time the database is opened.
+func unmigrate(t *testing.T, s *SQLStore, prefix string) {
+	for i, m := range sqlMigrations {
+		if strings.HasPrefix(m, prefix) {
+			if _, err := s.DB.Exec(`DELETE FROM schema_migrations WHERE version > ?`, i); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+	t.Fatalf("no migration %q", prefix)
+}
+
+func TestSQLFirstAdminBackfill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dengo.db")
+	s, err := SQLOpen("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an admin from before first_admin existed
+	if _, err = s.DB.Exec(`DELETE FROM first_admin`); err != nil {
+		t.Fatal(err)
+	}
+	unmigrate(t, s, "INSERT INTO first_admin")
+	if err = s.CreateUser(&User{Name: "alice", Pass: "x", Role: RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if s, err = SQLOpen("sqlite3", path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.CreateFirstAdmin(&User{Name: "bob", Pass: "x"}); errors.Cause(err) != ErrAdminExists {
+		t.Errorf("got %v, want %v", err, ErrAdminExists)
+	}
+}
+
+func TestSQLRevokedAtMilliseconds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dengo.db")
+	s, err := SQLOpen("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err = s.RevokeUserTokens("alice", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	at, err := s.UserTokensRevokedAt("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.Equal(now.Truncate(time.Millisecond)) {
+		t.Errorf("revoked at %v, want %v", at, now)
+	}
+
+	// revocations from when they were kept in seconds
+	unmigrate(t, s, "UPDATE revoked_users")
+	if _, err = s.DB.Exec(`UPDATE revoked_users SET revoked_at = ?`, now.Unix()); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if s, err = SQLOpen("sqlite3", path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if at, err = s.UserTokensRevokedAt("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !at.Equal(now.Truncate(time.Second)) {
+		t.Errorf("revoked at %v, want %v", at, now.Truncate(time.Second))
+	}
+}
+
+// Signups racing for one name: one gets it, the rest are told it's taken.
+func TestSQLCreateUserRace(t *testing.T) {
+	s, err := SQLOpen("sqlite3", filepath.Join(t.TempDir(), "dengo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() { errs <- s.CreateUser(&User{Name: "alice", Pass: "x"}) }()
+	}
+	created := 0
+	for i := 0; i < 8; i++ {
+		switch err := <-errs; errors.Cause(err) {
+		case nil:
+			created++
+		case ErrUserExists:
+		default:
+			t.Errorf("got %v, want nil or %v", err, ErrUserExists)
+		}
+	}
+	if created != 1 {
+		t.Errorf("created %d times", created)
+	}
+}
+
+func TestSQLEditLocked(t *testing.T) {
+	s, err := SQLOpen("sqlite3", filepath.Join(t.TempDir(), "dengo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testEditLocked(t, s)
+}
+
+func TestSQLUseMFA(t *testing.T) {
+	s, err := SQLOpen("sqlite3", filepath.Join(t.TempDir(), "dengo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testUseMFA(t, s)
+}
@@ -0,0 +1,1116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SQLStore keeps users and polls in a relational database via database/sql.
+// Queries are written for SQLite and rebound for Postgres when needed.
+type SQLStore struct {
+	DB      *sql.DB
+	Driver  string
+	Timeout time.Duration
+}
+
+// sqlMigrations are applied in order, each in its own transaction. Append
+// new ones to the end, never edit one that has shipped.
+var sqlMigrations = []string{
+	`CREATE TABLE users (
+		name TEXT PRIMARY KEY,
+		pass TEXT NOT NULL
+	)`,
+	`CREATE TABLE polls (
+		name     TEXT PRIMARY KEY,
+		question TEXT NOT NULL
+	)`,
+	`CREATE TABLE options (
+		poll     TEXT NOT NULL REFERENCES polls (name),
+		position INTEGER NOT NULL,
+		response TEXT NOT NULL,
+		PRIMARY KEY (poll, response)
+	)`,
+	`CREATE TABLE votes (
+		poll     TEXT NOT NULL REFERENCES polls (name),
+		username TEXT NOT NULL,
+		response TEXT NOT NULL,
+		PRIMARY KEY (poll, username)
+	)`,
+	`ALTER TABLE polls ADD COLUMN creator TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE polls ADD COLUMN opens_at BIGINT`,
+	`ALTER TABLE polls ADD COLUMN closes_at BIGINT`,
+	`CREATE TABLE ballots (
+		poll     TEXT NOT NULL REFERENCES polls (name),
+		username TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		response TEXT NOT NULL,
+		PRIMARY KEY (poll, username, position)
+	)`,
+	`INSERT INTO ballots (poll, username, position, response)
+		SELECT poll, username, 0, response FROM votes`,
+	`DROP TABLE votes`,
+	`ALTER TABLE polls ADD COLUMN method TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE polls ADD COLUMN max_picks INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE polls ADD COLUMN visibility TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE polls ADD COLUMN created_at BIGINT`,
+	`CREATE TABLE refresh_tokens (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		session    TEXT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		used_at    BIGINT
+	)`,
+	`CREATE INDEX refresh_tokens_session ON refresh_tokens (session)`,
+	`CREATE INDEX refresh_tokens_username ON refresh_tokens (username)`,
+	`CREATE TABLE revoked_tokens (
+		id         TEXT PRIMARY KEY,
+		expires_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE revoked_users (
+		username   TEXT PRIMARY KEY,
+		revoked_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE invitations (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+	`ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE password_resets (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE mfa (
+		username       TEXT PRIMARY KEY,
+		secret         TEXT NOT NULL,
+		enabled        BOOLEAN NOT NULL,
+		recovery_codes TEXT NOT NULL,
+		last_step      BIGINT NOT NULL
+	)`,
+	// One row at most, so only one signup can ever claim the first admin.
+	`CREATE TABLE first_admin (
+		id       INTEGER PRIMARY KEY CHECK (id = 1),
+		username TEXT NOT NULL
+	)`,
+	`INSERT INTO first_admin (id, username)
+		SELECT 1, MIN(name) FROM users WHERE role = 'admin' HAVING COUNT(*) > 0`,
+	// Tokens are issued to the millisecond, so revocations are kept to it.
+	`UPDATE revoked_users SET revoked_at = revoked_at * 1000`,
+}
+
+// pollColumns are the columns of the polls table, name first. pollFields and
+// pollValues must list the matching Poll fields in the same order.
+var pollColumns = []string{"name", "question", "creator", "opens_at", "closes_at",
+	"method", "max_picks", "visibility", "created_at"}
+
+func pollFields(p *Poll) []interface{} {
+	return []interface{}{&p.Name, &p.Question, &p.Creator,
+		sqlTime{&p.OpensAt}, sqlTime{&p.ClosesAt}, &p.Method, &p.MaxPicks, &p.Visibility,
+		sqlTime{&p.CreatedAt}}
+}
+
+func pollValues(p *Poll) []interface{} {
+	return []interface{}{p.Name, p.Question, p.Creator,
+		sqlTime{&p.OpensAt}, sqlTime{&p.ClosesAt}, p.Method, p.MaxPicks, p.Visibility,
+		sqlTime{&p.CreatedAt}}
+}
+
+// sqlTime stores an optional time as unix seconds, or NULL when it's unset.
+type sqlTime struct {
+	t **time.Time
+}
+
+func (s sqlTime) Scan(src interface{}) error {
+	var n sql.NullInt64
+	if err := n.Scan(src); err != nil {
+		return err
+	}
+	*s.t = nil
+	if n.Valid {
+		t := time.Unix(n.Int64, 0)
+		*s.t = &t
+	}
+	return nil
+}
+
+func (s sqlTime) Value() (driver.Value, error) {
+	if *s.t == nil {
+		return nil, nil
+	}
+	return (*s.t).Unix(), nil
+}
+
+func SQLOpen(driver, dsn string) (*SQLStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "sql open failed")
+	}
+	s := &SQLStore{DB: db, Driver: driver, Timeout: 5 * time.Second}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "sql ping failed")
+	}
+	if err = s.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.DB.Close()
+}
+
+// context bounds how long any single store operation may take.
+func (s *SQLStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.Timeout)
+}
+
+// rebind converts ? placeholders to $1, $2... for drivers that need them.
+func (s *SQLStore) rebind(query string) string {
+	if s.Driver != "postgres" {
+		return query
+	}
+	var buf []byte
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '?' {
+			buf = append(buf, query[i])
+			continue
+		}
+		n++
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(n), 10)
+	}
+	return string(buf)
+}
+
+// Migrate brings the schema up to date.
+func (s *SQLStore) Migrate() error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "migrations table creation failed")
+	}
+
+	var current int
+	err = s.DB.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return errors.Wrap(err, "schema version lookup failed")
+	}
+
+	for i := current; i < len(sqlMigrations); i++ {
+		err = s.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, sqlMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, s.rebind(
+				`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+				i+1, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "migration %d failed", i+1)
+		}
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, committing if it returns nil.
+func (s *SQLStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin failed")
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "commit failed")
+}
+
+func (s *SQLStore) UserByName(name string) (*User, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	user := &User{}
+	err := s.DB.QueryRowContext(ctx, s.rebind(
+		`SELECT name, pass, role, disabled FROM users WHERE name = ?`), name).
+		Scan(&user.Name, &user.Pass, &user.Role, &user.Disabled)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchUser
+	} else if err != nil {
+		return nil, errors.Wrap(err, "user select failed")
+	}
+	return user, nil
+}
+
+func (s *SQLStore) CreateUser(u *User) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.createUser(ctx, tx, u)
+	})
+}
+
+// createUser inserts u unless the name is taken. Checking first would let
+// two signups for one name both pass the check, and the second insert fail
+// on the primary key, so the insert is what checks.
+func (s *SQLStore) createUser(ctx context.Context, tx *sql.Tx, u *User) error {
+	res, err := tx.ExecContext(ctx, s.rebind(
+		`INSERT INTO users (name, pass, role, disabled) VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`),
+		u.Name, u.Pass, u.Role, u.Disabled)
+	if err != nil {
+		return errors.Wrap(err, "create failed")
+	}
+	created, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "create failed")
+	}
+	if created == 0 {
+		return ErrUserExists
+	}
+	return nil
+}
+
+func (s *SQLStore) UpdateUser(u *User) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	res, err := s.DB.ExecContext(ctx, s.rebind(
+		`UPDATE users SET pass = ?, role = ?, disabled = ? WHERE name = ?`),
+		u.Pass, u.Role, u.Disabled, u.Name)
+	if err != nil {
+		return errors.Wrap(err, "user update failed")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "user update failed")
+	}
+	if n == 0 {
+		return ErrNoSuchUser
+	}
+	return nil
+}
+
+func (s *SQLStore) AllUsers() ([]*User, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT name, pass, role, disabled FROM users`)
+	if err != nil {
+		return nil, errors.Wrap(err, "user select failed")
+	}
+	defer rows.Close()
+	var users []*User
+	for rows.Next() {
+		user := &User{}
+		if err = rows.Scan(&user.Name, &user.Pass, &user.Role, &user.Disabled); err != nil {
+			return nil, errors.Wrap(err, "user scan failed")
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "user select failed")
+	}
+	return users, nil
+}
+
+func (s *SQLStore) CreateFirstAdmin(u *User) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRowContext(ctx, s.rebind(
+			`SELECT COUNT(*) FROM users WHERE name = ?`), u.Name).Scan(&n)
+		if err != nil {
+			return errors.Wrap(err, "user select failed")
+		}
+		if n > 0 {
+			return ErrUserExists
+		}
+		// Under read committed, two signups could both see no admin and
+		// insert one each. Only one can claim the first_admin row: the
+		// other waits for it to commit, then inserts nothing.
+		res, err := tx.ExecContext(ctx, s.rebind(
+			`INSERT INTO first_admin (id, username) VALUES (1, ?) ON CONFLICT DO NOTHING`),
+			u.Name)
+		if err != nil {
+			return errors.Wrap(err, "first admin claim failed")
+		}
+		claimed, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "first admin claim failed")
+		}
+		if claimed == 0 {
+			return ErrAdminExists
+		}
+		admin := *u
+		admin.Role = RoleAdmin
+		return s.createUser(ctx, tx, &admin)
+	})
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// loadPolls assembles polls, their options and ballots. With an empty name,
+// every poll is loaded.
+func (s *SQLStore) loadPolls(ctx context.Context, q queryer, name string) (map[string]*Poll, error) {
+	var pollWhere, where string
+	var args []interface{}
+	if name != "" {
+		pollWhere, where = " WHERE name = ?", " WHERE poll = ?"
+		args = []interface{}{name}
+	}
+
+	polls := map[string]*Poll{}
+	rows, err := q.QueryContext(ctx, s.rebind(
+		`SELECT `+strings.Join(pollColumns, ", ")+` FROM polls`+pollWhere), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "poll select failed")
+	}
+	for rows.Next() {
+		poll := &Poll{}
+		if err = rows.Scan(pollFields(poll)...); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "poll scan failed")
+		}
+		polls[poll.Name] = poll
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "poll select failed")
+	}
+
+	rows, err = q.QueryContext(ctx, s.rebind(
+		`SELECT poll, response FROM options`+where+` ORDER BY poll, position`), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "option select failed")
+	}
+	for rows.Next() {
+		var pollName, response string
+		if err = rows.Scan(&pollName, &response); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "option scan failed")
+		}
+		if poll, ok := polls[pollName]; ok {
+			poll.Options = append(poll.Options, &PollOption{Response: response})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "option select failed")
+	}
+
+	rows, err = q.QueryContext(ctx, s.rebind(
+		`SELECT poll, username, response FROM ballots`+where+
+			` ORDER BY poll, username, position`), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "ballot select failed")
+	}
+	defer rows.Close()
+	ballots := map[string]map[string][]string{}
+	for rows.Next() {
+		var pollName, userName, response string
+		if err = rows.Scan(&pollName, &userName, &response); err != nil {
+			return nil, errors.Wrap(err, "ballot scan failed")
+		}
+		if ballots[pollName] == nil {
+			ballots[pollName] = map[string][]string{}
+		}
+		ballots[pollName][userName] = append(ballots[pollName][userName], response)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "ballot select failed")
+	}
+	for pollName, byUser := range ballots {
+		poll, ok := polls[pollName]
+		if !ok {
+			continue
+		}
+		for userName, choices := range byUser {
+			poll.Vote(userName, choices)
+		}
+	}
+	return polls, nil
+}
+
+func (s *SQLStore) PollByName(name string) (*Poll, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	polls, err := s.loadPolls(ctx, s.DB, name)
+	if err != nil {
+		return nil, err
+	}
+	poll, ok := polls[name]
+	if !ok {
+		return nil, ErrNoSuchPoll
+	}
+	return poll, nil
+}
+
+func (s *SQLStore) AllPolls() (map[string]Poll, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	loaded, err := s.loadPolls(ctx, s.DB, "")
+	if err != nil {
+		return nil, err
+	}
+	polls := map[string]Poll{}
+	for name, poll := range loaded {
+		polls[name] = *poll
+	}
+	return polls, nil
+}
+
+func (s *SQLStore) ListPolls(q *PollQuery) (*PollPage, error) {
+	polls, err := s.AllPolls()
+	if err != nil {
+		return nil, err
+	}
+	return q.Page(polls), nil
+}
+
+func (s *SQLStore) CreatePoll(p *Poll) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		err := s.pollExists(ctx, tx, p.Name)
+		if err == nil {
+			return ErrPollExists
+		} else if err != ErrNoSuchPoll {
+			return err
+		}
+
+		placeholders := strings.Repeat(", ?", len(pollColumns))[2:]
+		_, err = tx.ExecContext(ctx, s.rebind(
+			`INSERT INTO polls (`+strings.Join(pollColumns, ", ")+`)
+			VALUES (`+placeholders+`)`), pollValues(p)...)
+		if err != nil {
+			return errors.Wrap(err, "create failed")
+		}
+		for i, option := range p.Options {
+			_, err = tx.ExecContext(ctx, s.rebind(
+				`INSERT INTO options (poll, position, response) VALUES (?, ?, ?)`),
+				p.Name, i, option.Response)
+			if err != nil {
+				return errors.Wrap(err, "option create failed")
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) UpdatePoll(p *Poll) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.lockPoll(ctx, tx, p.Name); err != nil {
+			return err
+		}
+		old, err := s.pollRow(ctx, tx, p.Name)
+		if err != nil {
+			return err
+		}
+		var ballots int
+		err = tx.QueryRowContext(ctx, s.rebind(
+			`SELECT COUNT(*) FROM ballots WHERE poll = ?`), p.Name).Scan(&ballots)
+		if err != nil {
+			return errors.Wrap(err, "ballot count failed")
+		}
+		if err = p.CheckEdit(old, ballots > 0); err != nil {
+			return err
+		}
+
+		// name is first, and is what we're matching on
+		values := pollValues(p)
+		values = append(values[1:], p.Name)
+		_, err = tx.ExecContext(ctx, s.rebind(
+			`UPDATE polls SET `+strings.Join(pollColumns[1:], " = ?, ")+` = ?
+			WHERE name = ?`), values...)
+		if err != nil {
+			return errors.Wrap(err, "poll update failed")
+		}
+
+		// forget choices of dropped responses, then renumber what's left
+		var kept Poll
+		kept.SetOptions(p.Options)
+		for _, table := range []string{"ballots", "options"} {
+			query := `DELETE FROM ` + table + ` WHERE poll = ?`
+			args := []interface{}{p.Name}
+			if len(kept.Options) > 0 {
+				query += ` AND response NOT IN (` +
+					strings.Repeat(", ?", len(kept.Options))[2:] + `)`
+				for _, option := range kept.Options {
+					args = append(args, option.Response)
+				}
+			}
+			if _, err = tx.ExecContext(ctx, s.rebind(query), args...); err != nil {
+				return errors.Wrap(err, "option delete failed")
+			}
+		}
+		for i, option := range kept.Options {
+			res, err := tx.ExecContext(ctx, s.rebind(
+				`UPDATE options SET position = ? WHERE poll = ? AND response = ?`),
+				i, p.Name, option.Response)
+			if err != nil {
+				return errors.Wrap(err, "option update failed")
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				continue
+			}
+			_, err = tx.ExecContext(ctx, s.rebind(
+				`INSERT INTO options (poll, position, response) VALUES (?, ?, ?)`),
+				p.Name, i, option.Response)
+			if err != nil {
+				return errors.Wrap(err, "option create failed")
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) DeletePoll(name string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.pollExists(ctx, tx, name); err != nil {
+			return err
+		}
+		for _, table := range []string{"ballots", "options"} {
+			_, err := tx.ExecContext(ctx, s.rebind(
+				`DELETE FROM `+table+` WHERE poll = ?`), name)
+			if err != nil {
+				return errors.Wrap(err, "poll delete failed")
+			}
+		}
+		_, err := tx.ExecContext(ctx, s.rebind(
+			`DELETE FROM polls WHERE name = ?`), name)
+		return errors.Wrap(err, "poll delete failed")
+	})
+}
+
+// pollExists returns ErrNoSuchPoll if there's no poll by that name.
+func (s *SQLStore) pollExists(ctx context.Context, tx *sql.Tx, name string) error {
+	_, err := s.pollRow(ctx, tx, name)
+	return err
+}
+
+// lockPoll holds the poll's row until the transaction ends, so votes and
+// edits of one poll take turns: Postgres locks the row for the update, and
+// SQLite lets only one transaction write at a time.
+func (s *SQLStore) lockPoll(ctx context.Context, tx *sql.Tx, name string) error {
+	res, err := tx.ExecContext(ctx, s.rebind(
+		`UPDATE polls SET name = name WHERE name = ?`), name)
+	if err != nil {
+		return errors.Wrap(err, "poll lock failed")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "poll lock failed")
+	}
+	if n == 0 {
+		return ErrNoSuchPoll
+	}
+	return nil
+}
+
+// pollRow reads a poll without its options or ballots.
+func (s *SQLStore) pollRow(ctx context.Context, tx *sql.Tx, name string) (*Poll, error) {
+	poll := &Poll{}
+	err := tx.QueryRowContext(ctx, s.rebind(
+		`SELECT `+strings.Join(pollColumns, ", ")+` FROM polls WHERE name = ?`), name).
+		Scan(pollFields(poll)...)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchPoll
+	} else if err != nil {
+		return nil, errors.Wrap(err, "poll select failed")
+	}
+	return poll, nil
+}
+
+func (s *SQLStore) AddOption(pollName string, o *PollOption) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		poll, err := s.pollRow(ctx, tx, pollName)
+		if err != nil {
+			return err
+		}
+		if err = poll.CheckOpen(time.Now()); err != nil {
+			return err
+		}
+		var n, exists int
+		err = tx.QueryRowContext(ctx, s.rebind(
+			`SELECT COUNT(*), COALESCE(SUM(CASE WHEN response = ? THEN 1 ELSE 0 END), 0)
+			FROM options WHERE poll = ?`), o.Response, pollName).Scan(&n, &exists)
+		if err != nil {
+			return errors.Wrap(err, "option select failed")
+		}
+		if exists > 0 {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(
+			`INSERT INTO options (poll, position, response) VALUES (?, ?, ?)`),
+			pollName, n, o.Response)
+		return errors.Wrap(err, "option create failed")
+	})
+}
+
+func (s *SQLStore) Vote(pollName, userName string, choices []string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		// so the poll can't be edited between reading and voting
+		if err := s.lockPoll(ctx, tx, pollName); err != nil {
+			return err
+		}
+		polls, err := s.loadPolls(ctx, tx, pollName)
+		if err != nil {
+			return err
+		}
+		poll, ok := polls[pollName]
+		if !ok {
+			return ErrNoSuchPoll
+		}
+		if err = poll.CheckOpen(time.Now()); err != nil {
+			return err
+		}
+		if err = poll.CheckBallot(choices); err != nil {
+			return err
+		}
+		userName = poll.VoterKey(userName)
+		_, err = tx.ExecContext(ctx, s.rebind(
+			`DELETE FROM ballots WHERE poll = ? AND username = ?`), pollName, userName)
+		if err != nil {
+			return errors.Wrap(err, "vote clear failed")
+		}
+		for i, response := range choices {
+			_, err = tx.ExecContext(ctx, s.rebind(
+				`INSERT INTO ballots (poll, username, position, response) VALUES (?, ?, ?, ?)`),
+				pollName, userName, i, response)
+			if err != nil {
+				return errors.Wrap(err, "vote failed")
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) CreateRefreshToken(t *RefreshToken) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, s.rebind(
+		`INSERT INTO refresh_tokens (id, username, session, expires_at, used_at)
+		VALUES (?, ?, ?, ?, ?)`),
+		t.ID, t.User, t.Session, t.ExpiresAt.Unix(), sqlTime{&t.UsedAt})
+	return errors.Wrap(err, "refresh token create failed")
+}
+
+func (s *SQLStore) UseRefreshToken(id string, now time.Time) (*RefreshToken, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	t := &RefreshToken{}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		// only one use can find used_at unset
+		res, err := tx.ExecContext(ctx, s.rebind(
+			`UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL`),
+			now.Unix(), id)
+		if err != nil {
+			return errors.Wrap(err, "refresh token update failed")
+		}
+		first, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "refresh token update failed")
+		}
+
+		var expiresAt int64
+		err = tx.QueryRowContext(ctx, s.rebind(
+			`SELECT id, username, session, expires_at, used_at FROM refresh_tokens WHERE id = ?`), id).
+			Scan(&t.ID, &t.User, &t.Session, &expiresAt, sqlTime{&t.UsedAt})
+		if err == sql.ErrNoRows {
+			return ErrNoSuchToken
+		} else if err != nil {
+			return errors.Wrap(err, "refresh token select failed")
+		}
+		t.ExpiresAt = time.Unix(expiresAt, 0)
+		if first == 1 {
+			t.UsedAt = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *SQLStore) DeleteSession(session string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, s.rebind(
+		`DELETE FROM refresh_tokens WHERE session = ?`), session)
+	return errors.Wrap(err, "session delete failed")
+}
+
+func (s *SQLStore) RevokeToken(id string, expiresAt time.Time) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.rebind(
+			`DELETE FROM revoked_tokens WHERE id = ?`), id)
+		if err != nil {
+			return errors.Wrap(err, "token revoke failed")
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(
+			`INSERT INTO revoked_tokens (id, expires_at) VALUES (?, ?)`), id, expiresAt.Unix())
+		return errors.Wrap(err, "token revoke failed")
+	})
+}
+
+func (s *SQLStore) TokenRevoked(id string) (bool, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	var n int
+	err := s.DB.QueryRowContext(ctx, s.rebind(
+		`SELECT COUNT(*) FROM revoked_tokens WHERE id = ?`), id).Scan(&n)
+	if err != nil {
+		return false, errors.Wrap(err, "revocation select failed")
+	}
+	return n > 0, nil
+}
+
+func (s *SQLStore) RevokeUserTokens(userName string, now, expiresAt time.Time) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{"refresh_tokens", "revoked_users"} {
+			_, err := tx.ExecContext(ctx, s.rebind(
+				`DELETE FROM `+table+` WHERE username = ?`), userName)
+			if err != nil {
+				return errors.Wrap(err, "user revoke failed")
+			}
+		}
+		_, err := tx.ExecContext(ctx, s.rebind(
+			`INSERT INTO revoked_users (username, revoked_at, expires_at) VALUES (?, ?, ?)`),
+			userName, now.UnixMilli(), expiresAt.Unix())
+		return errors.Wrap(err, "user revoke failed")
+	})
+}
+
+func (s *SQLStore) UserTokensRevokedAt(userName string) (time.Time, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	var at int64
+	err := s.DB.QueryRowContext(ctx, s.rebind(
+		`SELECT revoked_at FROM revoked_users WHERE username = ?`), userName).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, errors.Wrap(err, "revocation select failed")
+	}
+	return time.UnixMilli(at), nil
+}
+
+func (s *SQLStore) DeleteExpiredTokens(now time.Time) (int, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	var deleted int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{"refresh_tokens", "revoked_tokens", "revoked_users", "password_resets"} {
+			res, err := tx.ExecContext(ctx, s.rebind(
+				`DELETE FROM `+table+` WHERE expires_at < ?`), now.Unix())
+			if err != nil {
+				return errors.Wrap(err, "expired token delete failed")
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return errors.Wrap(err, "expired token delete failed")
+			}
+			deleted += n
+		}
+		return nil
+	})
+	return int(deleted), err
+}
+
+func (s *SQLStore) CreateInvitation(inv *Invitation) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, s.rebind(
+		`INSERT INTO invitations (id, username, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`),
+		inv.ID, inv.User, inv.CreatedBy, inv.CreatedAt.Unix(), inv.ExpiresAt.Unix())
+	return errors.Wrap(err, "invitation create failed")
+}
+
+func (s *SQLStore) Invitations() ([]*Invitation, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, username, created_by, created_at, expires_at FROM invitations`)
+	if err != nil {
+		return nil, errors.Wrap(err, "invitation select failed")
+	}
+	defer rows.Close()
+	var invitations []*Invitation
+	for rows.Next() {
+		inv := &Invitation{}
+		var createdAt, expiresAt int64
+		err = rows.Scan(&inv.ID, &inv.User, &inv.CreatedBy, &createdAt, &expiresAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "invitation scan failed")
+		}
+		inv.CreatedAt, inv.ExpiresAt = time.Unix(createdAt, 0), time.Unix(expiresAt, 0)
+		invitations = append(invitations, inv)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "invitation select failed")
+	}
+	return invitations, nil
+}
+
+func (s *SQLStore) DeleteInvitation(id string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	res, err := s.DB.ExecContext(ctx, s.rebind(`DELETE FROM invitations WHERE id = ?`), id)
+	if err != nil {
+		return errors.Wrap(err, "invitation delete failed")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "invitation delete failed")
+	}
+	if n == 0 {
+		return ErrNoSuchInvitation
+	}
+	return nil
+}
+
+func (s *SQLStore) CreateInvitedUser(u *User, invitationID string, now time.Time) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		// only one signup gets to delete it
+		res, err := tx.ExecContext(ctx, s.rebind(
+			`DELETE FROM invitations WHERE id = ? AND expires_at >= ?
+			AND (username = '' OR username = ?)`),
+			invitationID, now.Unix(), u.Name)
+		if err != nil {
+			return errors.Wrap(err, "invitation delete failed")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "invitation delete failed")
+		}
+		if n == 0 {
+			return ErrNoSuchInvitation
+		}
+		return s.createUser(ctx, tx, u)
+	})
+}
+
+func (s *SQLStore) CreatePasswordReset(reset *PasswordReset) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, s.rebind(
+		`INSERT INTO password_resets (id, username, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`),
+		reset.ID, reset.User, reset.CreatedBy, reset.CreatedAt.Unix(), reset.ExpiresAt.Unix())
+	return errors.Wrap(err, "password reset create failed")
+}
+
+func (s *SQLStore) ResetPassword(resetID, userName, pass string, now time.Time) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		// only one reset gets to delete it
+		res, err := tx.ExecContext(ctx, s.rebind(
+			`DELETE FROM password_resets WHERE id = ? AND username = ? AND expires_at >= ?`),
+			resetID, userName, now.Unix())
+		if err != nil {
+			return errors.Wrap(err, "password reset delete failed")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "password reset delete failed")
+		}
+		if n == 0 {
+			return ErrNoSuchReset
+		}
+
+		res, err = tx.ExecContext(ctx, s.rebind(`UPDATE users SET pass = ? WHERE name = ?`),
+			pass, userName)
+		if err != nil {
+			return errors.Wrap(err, "user update failed")
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return errors.Wrap(err, "user update failed")
+		}
+		if n == 0 {
+			return ErrNoSuchUser
+		}
+
+		_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM password_resets WHERE username = ?`),
+			userName)
+		return errors.Wrap(err, "password reset delete failed")
+	})
+}
+
+func (s *SQLStore) MFAByUser(userName string) (*MFA, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.mfaRow(ctx, s.DB, userName)
+}
+
+func (s *SQLStore) mfaRow(ctx context.Context, q queryer, userName string) (*MFA, error) {
+	m := &MFA{User: userName}
+	var codes string
+	err := q.QueryRowContext(ctx, s.rebind(
+		`SELECT secret, enabled, recovery_codes, last_step FROM mfa WHERE username = ?`), userName).
+		Scan(&m.Secret, &m.Enabled, &codes, &m.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchMFA
+	} else if err != nil {
+		return nil, errors.Wrap(err, "mfa select failed")
+	}
+	m.RecoveryCodes = strings.Fields(codes)
+	return m, nil
+}
+
+func (s *SQLStore) SaveMFA(m *MFA) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM mfa WHERE username = ?`), m.User)
+		if err != nil {
+			return errors.Wrap(err, "mfa save failed")
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(
+			`INSERT INTO mfa (username, secret, enabled, recovery_codes, last_step)
+			VALUES (?, ?, ?, ?, ?)`),
+			m.User, m.Secret, m.Enabled, strings.Join(m.RecoveryCodes, " "), m.LastStep)
+		return errors.Wrap(err, "mfa save failed")
+	})
+}
+
+func (s *SQLStore) DeleteMFA(userName string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	res, err := s.DB.ExecContext(ctx, s.rebind(`DELETE FROM mfa WHERE username = ?`), userName)
+	if err != nil {
+		return errors.Wrap(err, "mfa delete failed")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "mfa delete failed")
+	}
+	if n == 0 {
+		return ErrNoSuchMFA
+	}
+	return nil
+}
+
+func (s *SQLStore) UseMFA(userName, code, tokenID string, now, expiresAt time.Time) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		// only one login gets to revoke it
+		res, err := tx.ExecContext(ctx, s.rebind(
+			`INSERT INTO revoked_tokens (id, expires_at) VALUES (?, ?) ON CONFLICT DO NOTHING`),
+			tokenID, expiresAt.Unix())
+		if err != nil {
+			return errors.Wrap(err, "token revoke failed")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "token revoke failed")
+		}
+		if n == 0 {
+			return ErrTokenRevoked
+		}
+
+		m, err := s.mfaRow(ctx, tx, userName)
+		if errors.Cause(err) == ErrNoSuchMFA {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !m.Enabled {
+			return nil
+		}
+		codes, lastStep := strings.Join(m.RecoveryCodes, " "), m.LastStep
+		if !m.Use(code, now) {
+			return ErrWrongCode
+		}
+		// a login with another token may have used a code since it was read
+		res, err = tx.ExecContext(ctx, s.rebind(
+			`UPDATE mfa SET recovery_codes = ?, last_step = ?
+			WHERE username = ? AND recovery_codes = ? AND last_step = ?`),
+			strings.Join(m.RecoveryCodes, " "), m.LastStep, userName, codes, lastStep)
+		if err != nil {
+			return errors.Wrap(err, "mfa update failed")
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return errors.Wrap(err, "mfa update failed")
+		}
+		if n == 0 {
+			return ErrWrongCode
+		}
+		return nil
+	})
+}
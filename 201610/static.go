@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/chi"
+)
+
+// Pages can't have scripts or styles of their own under our CSP, so
+// they're served from here, built into the binary.
+type asset struct {
+	ContentType string
+	Body        string
+}
+
+var assets = map[string]asset{
+	"dengo.css": {ContentType: "text/css; charset=utf-8", Body: dengoCSS},
+	"poll.js":   {ContentType: "application/javascript; charset=utf-8", Body: pollJS},
+}
+
+const dengoCSS = `form.inline {
+  display: inline;
+}
+
+/* vote buttons look like the links they used to be */
+button.link {
+  background: none;
+  border: none;
+  padding: 0;
+  color: #00e;
+  text-decoration: underline;
+  cursor: pointer;
+  font: inherit;
+}
+`
+
+// pollJS keeps the counts on a poll's page up to date as votes come in.
+// The poll's name is in its script tag's data-poll.
+const pollJS = `(function() {
+  var poll = document.currentScript.getAttribute("data-poll");
+  if (!window.EventSource || !poll) {
+    return;
+  }
+  var events = new EventSource("/polls/" + encodeURIComponent(poll) + "/events");
+  events.addEventListener("tally", function(e) {
+    var tally = JSON.parse(e.data);
+    var counts = {};
+    var spans = document.querySelectorAll("span.count");
+    for (var i = 0; i < spans.length; i++) {
+      counts[spans[i].getAttribute("data-response")] = spans[i];
+    }
+    for (var i = 0; i < tally.Options.length; i++) {
+      var option = tally.Options[i];
+      if (!(option.Response in counts)) {
+        // a new response, or results that were hidden till now
+        location.reload();
+        return;
+      }
+      counts[option.Response].textContent = option.Votes;
+    }
+  });
+  events.addEventListener("deleted", function() {
+    events.close();
+    location.href = "/";
+  });
+})();
+`
+
+// StaticGet serves an asset. They only change with the binary, so
+// browsers may keep them for a while.
+func StaticGet(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "file")
+	a, ok := assets[name]
+	if !ok {
+		e := &Error{Code: http.StatusNotFound, Message: errors.Errorf("no such file: %s", name)}
+		e.Write(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(a.Body)))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write([]byte(a.Body))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Store is where users and polls live. Handlers only talk to storage through
+// env.Store, so backends can be swapped without touching them.
+type Store interface {
+	UserStore
+	PollStore
+	TokenStore
+	InvitationStore
+	PasswordResetStore
+	MFAStore
+	Close() error
+}
+
+type UserStore interface {
+	// UserByName returns ErrNoSuchUser when there's no user by that name.
+	UserByName(name string) (*User, error)
+	// CreateUser returns ErrUserExists when the name is already taken.
+	CreateUser(u *User) error
+	// CreateFirstAdmin creates u as an admin, unless there's an admin
+	// already, when it returns ErrAdminExists.
+	CreateFirstAdmin(u *User) error
+	// UpdateUser saves a user that already exists, or returns ErrNoSuchUser.
+	UpdateUser(u *User) error
+	AllUsers() ([]*User, error)
+}
+
+type PollStore interface {
+	// PollByName returns ErrNoSuchPoll when there's no poll by that name.
+	PollByName(name string) (*Poll, error)
+	AllPolls() (map[string]Poll, error)
+	// ListPolls returns one page of polls, without their ballots.
+	ListPolls(q *PollQuery) (*PollPage, error)
+	// CreatePoll returns ErrPollExists when the name is already taken.
+	CreatePoll(p *Poll) error
+	// UpdatePoll saves everything about a poll but its votes. Votes for
+	// options that are kept are left alone, the rest are dropped.
+	UpdatePoll(p *Poll) error
+	DeletePoll(name string) error
+	// AddOption appends an option to a poll, unless it's already there.
+	// Like Vote, it fails with ErrPollClosed or ErrPollNotOpen as needed.
+	AddOption(pollName string, o *PollOption) error
+	// Vote records userName's ballot, replacing any earlier one. Choices
+	// are checked with Poll.CheckBallot.
+	Vote(pollName, userName string, choices []string) error
+}
+
+// TokenStore keeps what's needed to end sessions before their tokens expire:
+// refresh tokens, and which access tokens have been revoked.
+type TokenStore interface {
+	CreateRefreshToken(t *RefreshToken) error
+	// UseRefreshToken marks a refresh token used, and returns it as it was
+	// before, so a second use comes back with UsedAt set. It returns
+	// ErrNoSuchToken when there's no token with that ID.
+	UseRefreshToken(id string, now time.Time) (*RefreshToken, error)
+	// DeleteSession deletes every refresh token a login has gone through.
+	DeleteSession(session string) error
+	// RevokeToken puts an access token's ID on the revocation list, where it
+	// stays until expiresAt.
+	RevokeToken(id string, expiresAt time.Time) error
+	TokenRevoked(id string) (bool, error)
+	// RevokeUserTokens deletes the user's refresh tokens, and revokes every
+	// access token issued to them up to now. The revocation is kept until
+	// expiresAt.
+	RevokeUserTokens(userName string, now, expiresAt time.Time) error
+	// UserTokensRevokedAt returns when the user's tokens were last revoked,
+	// or the zero time.
+	UserTokensRevokedAt(userName string) (time.Time, error)
+	// DeleteExpiredTokens deletes refresh tokens, revocations and password
+	// resets that have expired, and returns how many there were.
+	DeleteExpiredTokens(now time.Time) (int, error)
+}
+
+// InvitationStore keeps the invitations that let people sign up.
+type InvitationStore interface {
+	CreateInvitation(inv *Invitation) error
+	Invitations() ([]*Invitation, error)
+	// DeleteInvitation returns ErrNoSuchInvitation when there's no
+	// invitation with that ID.
+	DeleteInvitation(id string) error
+	// CreateInvitedUser creates u and uses up the invitation, all or
+	// nothing. It returns ErrNoSuchInvitation when there's no invitation
+	// with that ID, it has expired by now, or it's for someone else.
+	CreateInvitedUser(u *User, invitationID string, now time.Time) error
+}
+
+// PasswordResetStore keeps the codes admins hand out to users who have
+// forgotten their password.
+type PasswordResetStore interface {
+	CreatePasswordReset(reset *PasswordReset) error
+	// ResetPassword sets userName's password hash to pass, and uses up
+	// every reset they have, all or nothing. It returns ErrNoSuchReset when
+	// there's no reset with that ID for userName, or it has expired by now.
+	ResetPassword(resetID, userName, pass string, now time.Time) error
+}
+
+// MFAStore keeps users' two-factor authentication settings.
+type MFAStore interface {
+	// MFAByUser returns ErrNoSuchMFA when the user hasn't set it up.
+	MFAByUser(userName string) (*MFA, error)
+	// SaveMFA creates or replaces the user's settings.
+	SaveMFA(m *MFA) error
+	// DeleteMFA returns ErrNoSuchMFA when there's nothing to delete.
+	DeleteMFA(userName string) error
+	// UseMFA uses up code for userName, and revokes the pending login token
+	// tokenID until expiresAt, all or nothing. It returns ErrTokenRevoked
+	// when the token has been used already, and ErrWrongCode when code is
+	// no good at now. If two-factor authentication has been turned off
+	// since, only the token is revoked.
+	UseMFA(userName, code, tokenID string, now, expiresAt time.Time) error
+}
+
+// userRevocation is how stores that keep JSON record RevokeUserTokens.
+type userRevocation struct {
+	At        time.Time
+	ExpiresAt time.Time
+}
+
+var (
+	ErrNoSuchUser  = errors.New("no such user")
+	ErrUserExists  = errors.New("user exists")
+	ErrNoSuchPoll  = errors.New("no such poll")
+	ErrPollExists  = errors.New("poll exists")
+	ErrNoSuchToken = errors.New("no such token")
+	ErrAdminExists = errors.New("there's an admin already")
+
+	ErrNoSuchInvitation = errors.New("no such invitation")
+	ErrNoSuchReset      = errors.New("no such password reset")
+	ErrNoSuchMFA        = errors.New("two-factor authentication isn't set up")
+)
+
+// StoreError converts an error returned by a Store into an *Error with an
+// appropriate status code.
+func StoreError(err error) *Error {
+	code := http.StatusInternalServerError
+	switch errors.Cause(err) {
+	case ErrNoSuchUser, ErrNoSuchPoll, ErrNoSuchInvitation, ErrNoSuchMFA:
+		code = http.StatusNotFound
+	case ErrNoSuchToken:
+		code = http.StatusUnauthorized
+	case ErrBadBallot:
+		code = http.StatusBadRequest
+	case ErrAdminExists:
+		code = http.StatusForbidden
+	case ErrUserExists, ErrPollExists, ErrPollClosed, ErrPollNotOpen, ErrMethodLocked, ErrAnonymityLocked:
+		code = http.StatusConflict
+	}
+	return &Error{Code: code, Message: err}
+}
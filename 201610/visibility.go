@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Poll visibility settings. An empty Visibility means VisibilityPublic.
+const (
+	// VisibilityPublic polls show logged in users who voted for what.
+	VisibilityPublic = "public"
+	// VisibilityAnonymous polls only ever show counts. Ballots are stored
+	// under a key derived from the voter's name rather than the name itself.
+	VisibilityAnonymous = "anonymous"
+	// VisibilityHidden polls show nothing about votes until they close, and
+	// are public from then on.
+	VisibilityHidden = "hidden"
+)
+
+var visibilities = map[string]bool{
+	"":                  true,
+	VisibilityPublic:    true,
+	VisibilityAnonymous: true,
+	VisibilityHidden:    true,
+}
+
+var ErrResultsHidden = errors.New("results are hidden until the poll closes")
+
+// Anonymous, ResultsHidden and ShowsVoters take a Poll so templates can call
+// them on AllPolls' values, same as IsOpen.
+
+func (p Poll) Anonymous() bool {
+	return p.Visibility == VisibilityAnonymous
+}
+
+// ResultsHidden reports whether the poll's counts are still secret.
+func (p Poll) ResultsHidden() bool {
+	return p.Visibility == VisibilityHidden && p.CheckOpen(time.Now()) != ErrPollClosed
+}
+
+// ShowsVoters reports whether who voted for what may be shown at all.
+func (p Poll) ShowsVoters() bool {
+	return !p.Anonymous() && !p.ResultsHidden()
+}
+
+// VoterKey is what userName's ballot is stored under. For anonymous polls
+// it's an HMAC of the poll and user names under the server's private key:
+// the same every time, so nobody gets to vote twice, but no use for finding
+// out how someone voted without that key.
+func (p *Poll) VoterKey(userName string) string {
+	if !p.Anonymous() {
+		return userName
+	}
+	mac := hmac.New(sha256.New, privKey)
+	mac.Write([]byte(p.Name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userName))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Redact strips out whatever the viewer isn't allowed to see before a poll
+// is shown: voters for anonymous polls, or when the viewer isn't logged in,
+// and counts too while results are hidden.
+func (p *Poll) Redact(loggedIn bool) *Poll {
+	if loggedIn && p.ShowsVoters() {
+		return p
+	}
+	hidden := p.ResultsHidden()
+	p.Ballots = nil
+	for _, option := range p.Options {
+		option.Votes = nil
+		if hidden {
+			option.Count = 0
+		}
+	}
+	return p
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Voting methods. An empty Method means MethodSingle, which is how every
+// poll worked before there was a choice.
+const (
+	// MethodSingle ballots pick exactly one response.
+	MethodSingle = "single"
+	// MethodMulti ballots pick between one and MaxPicks responses.
+	MethodMulti = "multi"
+	// MethodApproval ballots pick any number of responses.
+	MethodApproval = "approval"
+	// MethodRanked ballots rank responses in order of preference, and are
+	// tallied by instant runoff.
+	MethodRanked = "ranked"
+)
+
+var votingMethods = map[string]bool{
+	"":             true,
+	MethodSingle:   true,
+	MethodMulti:    true,
+	MethodApproval: true,
+	MethodRanked:   true,
+}
+
+var ErrBadBallot = errors.New("invalid ballot")
+
+// Ballot is one user's vote. Choices are in order of preference for ranked
+// polls, and order doesn't matter otherwise. Response is accepted as a
+// shorthand for a single choice.
+type Ballot struct {
+	Response string `json:",omitempty"`
+	Choices  []string
+}
+
+// Normalize folds Response into Choices and drops empty choices, which is
+// what unused rank selects in a form turn into.
+func (b *Ballot) Normalize() *Ballot {
+	var choices []string
+	if b.Response != "" {
+		choices = append(choices, b.Response)
+	}
+	for _, choice := range b.Choices {
+		if choice != "" {
+			choices = append(choices, choice)
+		}
+	}
+	b.Response, b.Choices = "", choices
+	return b
+}
+
+func (b *Ballot) Validate() (*Ballot, *Error) {
+	if len(b.Normalize().Choices) == 0 {
+		e := &Error{Code: http.StatusBadRequest, Message: errors.New("Response is required")}
+		return nil, e
+	}
+	return b, nil
+}
+
+func BallotFromForm(r *http.Request) (*Ballot, *Error) {
+	var err error
+	ballot := &Ballot{}
+
+	if err = r.ParseForm(); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "ParseForm failed"),
+		}
+		return nil, e
+	}
+
+	err = env.Form.Decode(ballot, r.PostForm)
+	if err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "Decode failed"),
+		}
+		return nil, e
+	}
+
+	return ballot.Validate()
+}
+
+func BallotFromJSON(r io.Reader) (*Ballot, *Error) {
+	ballot := &Ballot{}
+	if err := json.NewDecoder(r).Decode(ballot); err != nil {
+		e := &Error{
+			Code:    http.StatusBadRequest,
+			Message: errors.Wrap(err, "json decoding failed"),
+		}
+		return nil, e
+	}
+	return ballot.Validate()
+}
+
+func (b *Ballot) Cast(pollName, userName string) *Error {
+	if err := env.Store.Vote(pollName, userName, b.Choices); err != nil {
+		return StoreError(err)
+	}
+	env.Events.PollChanged(pollName)
+	return nil
+}
+
+// CheckBallot makes sure choices make sense for the poll's voting method.
+// Errors it returns have ErrBadBallot as their cause.
+func (p *Poll) CheckBallot(choices []string) error {
+	responses := map[string]bool{}
+	for _, option := range p.Options {
+		responses[option.Response] = true
+	}
+	seen := map[string]bool{}
+	for _, choice := range choices {
+		if !responses[choice] {
+			return errors.Wrapf(ErrBadBallot, "no such response %q", choice)
+		}
+		if seen[choice] {
+			return errors.Wrapf(ErrBadBallot, "%q picked more than once", choice)
+		}
+		seen[choice] = true
+	}
+
+	switch {
+	case len(choices) == 0:
+		return errors.Wrap(ErrBadBallot, "no responses picked")
+	case p.Method == "" || p.Method == MethodSingle:
+		if len(choices) > 1 {
+			return errors.Wrap(ErrBadBallot, "only one response may be picked")
+		}
+	case p.Method == MethodMulti:
+		if len(choices) > p.MaxPicks {
+			return errors.Wrapf(ErrBadBallot, "at most %d responses may be picked", p.MaxPicks)
+		}
+	}
+	return nil
+}
+
+// VotingMethod is the poll's Method with the default spelled out. Like
+// IsOpen, it takes a Poll so templates can call it on AllPolls' values.
+func (p Poll) VotingMethod() string {
+	if p.Method == "" {
+		return MethodSingle
+	}
+	return p.Method
+}
+
+// counted returns the responses a ballot counts toward in each option's Count
+// and Votes: the first choice for ranked polls, and every choice otherwise.
+func (p *Poll) counted(choices []string) []string {
+	if p.Method == MethodRanked && len(choices) > 1 {
+		return choices[:1]
+	}
+	return choices
+}
+
+func (p *Poll) option(response string) *PollOption {
+	for _, option := range p.Options {
+		if option.Response == response {
+			return option
+		}
+	}
+	return nil
+}
+
+// Vote replaces userName's ballot with choices, keeping each option's Count
+// and Votes in step. Empty choices just withdraw the user's vote.
+func (p *Poll) Vote(userName string, choices []string) {
+	for _, response := range p.counted(p.Ballots[userName]) {
+		if option := p.option(response); option != nil && option.Votes[userName] {
+			delete(option.Votes, userName)
+			option.Count--
+		}
+	}
+	delete(p.Ballots, userName)
+	if len(choices) == 0 {
+		return
+	}
+
+	if p.Ballots == nil {
+		p.Ballots = map[string][]string{}
+	}
+	p.Ballots[userName] = choices
+	for _, response := range p.counted(choices) {
+		option := p.option(response)
+		if option == nil {
+			continue
+		}
+		if option.Votes == nil {
+			option.Votes = map[string]bool{}
+		}
+		option.Votes[userName] = true
+		option.Count++
+	}
+}
+
+// Recount drops choices for responses the poll no longer has, then rebuilds
+// every option's Count and Votes from the ballots.
+func (p *Poll) Recount() {
+	ballots := p.Ballots
+	p.Ballots = nil
+	for _, option := range p.Options {
+		option.Count, option.Votes = 0, nil
+	}
+	for userName, choices := range ballots {
+		var kept []string
+		for _, choice := range choices {
+			if p.option(choice) != nil {
+				kept = append(kept, choice)
+			}
+		}
+		p.Vote(userName, kept)
+	}
+}
+
+// Round is one round of an instant runoff count.
+type Round struct {
+	// Number counts rounds from 1.
+	Number  int
+	Options []*OptionResult
+	// Eliminated lists the response dropped at the end of the round, if one
+	// was.
+	Eliminated []string
+	// Exhausted is the number of ballots with no remaining choices.
+	Exhausted int
+}
+
+// InstantRunoff counts ranked ballots round by round. Each round, every
+// ballot counts toward its highest ranked remaining response. A response with
+// a majority of those votes wins, otherwise one last place response is
+// eliminated and the ballots are counted again; see lastPlace for ties. The
+// winners returned have more than one entry only when every remaining
+// response ends up with the same votes.
+func (p *Poll) InstantRunoff() (rounds []*Round, winners []string) {
+	remaining := map[string]bool{}
+	for _, option := range p.Options {
+		remaining[option.Response] = true
+	}
+
+	for len(remaining) > 0 {
+		round := &Round{Number: len(rounds) + 1}
+		counts := map[string]int{}
+		for _, choices := range p.Ballots {
+			counted := false
+			for _, choice := range choices {
+				if remaining[choice] {
+					counts[choice]++
+					counted = true
+					break
+				}
+			}
+			if !counted {
+				round.Exhausted++
+			}
+		}
+
+		total, max, min := 0, 0, -1
+		for _, option := range p.Options {
+			if !remaining[option.Response] {
+				continue
+			}
+			n := counts[option.Response]
+			round.Options = append(round.Options, &OptionResult{Response: option.Response, Votes: n})
+			total += n
+			if n > max {
+				max = n
+			}
+			if min < 0 || n < min {
+				min = n
+			}
+		}
+		for _, option := range round.Options {
+			if total > 0 {
+				option.Percent = float64(option.Votes) * 100 / float64(total)
+			}
+		}
+		rounds = append(rounds, round)
+
+		// a majority wins, and so does whoever's left when everyone ties
+		if (total > 0 && max*2 > total) || min == max {
+			for _, option := range round.Options {
+				if option.Votes == max {
+					winners = append(winners, option.Response)
+				}
+			}
+			if total == 0 {
+				winners = nil
+			}
+			return rounds, winners
+		}
+		var tied []string
+		for _, option := range round.Options {
+			if option.Votes == min {
+				tied = append(tied, option.Response)
+			}
+		}
+		loser := lastPlace(rounds[:len(rounds)-1], tied)
+		round.Eliminated = []string{loser}
+		delete(remaining, loser)
+	}
+	return rounds, winners
+}
+
+// lastPlace picks which of the responses tied for last, in option order, is
+// eliminated. Earlier rounds decide, latest first: whoever had fewer votes in
+// the latest round that tells them apart goes. If none does, the response
+// listed last goes.
+func lastPlace(earlier []*Round, tied []string) string {
+	for i := len(earlier) - 1; i >= 0 && len(tied) > 1; i-- {
+		votes := map[string]int{}
+		for _, option := range earlier[i].Options {
+			votes[option.Response] = option.Votes
+		}
+		min := -1
+		for _, response := range tied {
+			if min < 0 || votes[response] < min {
+				min = votes[response]
+			}
+		}
+		var fewest []string
+		for _, response := range tied {
+			if votes[response] == min {
+				fewest = append(fewest, response)
+			}
+		}
+		tied = fewest
+	}
+	return tied[len(tied)-1]
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// rankedPoll is a ranked poll with the responses given, in order, and a
+// ballot for each entry in ballots.
+func rankedPoll(responses []string, ballots [][]string) *Poll {
+	p := &Poll{Name: "p", Method: MethodRanked, Ballots: map[string][]string{}}
+	for _, response := range responses {
+		p.Options = append(p.Options, &PollOption{Response: response})
+	}
+	for i, choices := range ballots {
+		p.Ballots["voter"+strconv.Itoa(i)] = choices
+	}
+	return p
+}
+
+// repeat is n copies of a ballot.
+func repeat(n int, choices ...string) [][]string {
+	ballots := make([][]string, n)
+	for i := range ballots {
+		ballots[i] = choices
+	}
+	return ballots
+}
+
+func ballots(groups ...[][]string) [][]string {
+	var all [][]string
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
+func TestInstantRunoff(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		responses  []string
+		ballots    [][]string
+		winners    []string
+		eliminated [][]string
+		exhausted  []int
+	}{{
+		name:       "majority in round 1",
+		responses:  []string{"a", "b", "c"},
+		ballots:    ballots(repeat(3, "a", "b"), repeat(1, "b"), repeat(1, "c")),
+		winners:    []string{"a"},
+		eliminated: [][]string{nil},
+		exhausted:  []int{0},
+	}, {
+		name:       "exhausted ballots end in a tie",
+		responses:  []string{"a", "b", "c"},
+		ballots:    ballots(repeat(2, "a"), repeat(2, "b"), repeat(1, "c")),
+		winners:    []string{"a", "b"},
+		eliminated: [][]string{{"c"}, nil},
+		exhausted:  []int{0, 1},
+	}, {
+		// eliminating c and d together would hand it to b instead
+		name:      "one eliminated at a time",
+		responses: []string{"a", "b", "c", "d"},
+		ballots: ballots(repeat(4, "a"), repeat(3, "b", "c"),
+			repeat(2, "c", "b"), repeat(2, "d", "c")),
+		winners:    []string{"c"},
+		eliminated: [][]string{{"d"}, {"b"}, nil},
+		exhausted:  []int{0, 0, 0},
+	}, {
+		// c and b tie in round 2, and round 1 says c goes, though b is
+		// listed later
+		name:      "earlier rounds break ties",
+		responses: []string{"a", "c", "b", "d"},
+		ballots: ballots(repeat(5, "a"), repeat(2, "c", "b"),
+			repeat(3, "b", "a"), repeat(1, "d", "c", "b")),
+		winners:    []string{"b"},
+		eliminated: [][]string{{"d"}, {"c"}, nil},
+		exhausted:  []int{0, 0, 0},
+	}, {
+		name:       "option order breaks ties otherwise",
+		responses:  []string{"a", "b", "c", "d"},
+		ballots:    ballots(repeat(3, "a"), repeat(2, "b"), repeat(1, "c", "b"), repeat(1, "d", "b")),
+		winners:    []string{"b"},
+		eliminated: [][]string{{"d"}, {"c"}, nil},
+		exhausted:  []int{0, 0, 0},
+	}, {
+		name:       "everyone tied",
+		responses:  []string{"a", "b"},
+		ballots:    ballots(repeat(1, "a"), repeat(1, "b")),
+		winners:    []string{"a", "b"},
+		eliminated: [][]string{nil},
+		exhausted:  []int{0},
+	}, {
+		name:       "no ballots",
+		responses:  []string{"a", "b"},
+		winners:    nil,
+		eliminated: [][]string{nil},
+		exhausted:  []int{0},
+	}, {
+		// a majority of the ballots still counting is enough
+		name:       "majority after ballots exhaust",
+		responses:  []string{"a", "b", "c"},
+		ballots:    ballots(repeat(2, "a"), repeat(1, "b"), repeat(1, "c")),
+		winners:    []string{"a"},
+		eliminated: [][]string{{"c"}, nil},
+		exhausted:  []int{0, 1},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			rounds, winners := rankedPoll(tt.responses, tt.ballots).InstantRunoff()
+			if !reflect.DeepEqual(winners, tt.winners) {
+				t.Errorf("winners = %v, want %v", winners, tt.winners)
+			}
+			var eliminated [][]string
+			var exhausted []int
+			for i, round := range rounds {
+				if round.Number != i+1 {
+					t.Errorf("round %d numbered %d", i+1, round.Number)
+				}
+				eliminated = append(eliminated, round.Eliminated)
+				exhausted = append(exhausted, round.Exhausted)
+			}
+			if !reflect.DeepEqual(eliminated, tt.eliminated) {
+				t.Errorf("eliminated = %v, want %v", eliminated, tt.eliminated)
+			}
+			if !reflect.DeepEqual(exhausted, tt.exhausted) {
+				t.Errorf("exhausted = %v, want %v", exhausted, tt.exhausted)
+			}
+		})
+	}
+}
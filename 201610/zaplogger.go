@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/uber-go/zap"
 	"github.com/yargevad/chi/middleware"
 )
@@ -21,8 +22,8 @@ func ZapLogger(next http.Handler) http.Handler {
 type ZapLogFormatter struct{}
 
 func (z *ZapLogFormatter) FormatLog(r *http.Request, code, nbytes int, elapsed time.Duration, err error) {
-	var f10 [10]zap.Field
-	var fields []zap.Field = f10[:0]
+	var f11 [11]zap.Field
+	var fields []zap.Field = f11[:0]
 
 	reqID := middleware.GetReqID(r.Context())
 	if reqID != "" {
@@ -38,6 +39,9 @@ func (z *ZapLogFormatter) FormatLog(r *http.Request, code, nbytes int, elapsed t
 
 	if r.TLS != nil {
 		fields = append(fields, zap.Bool("tls", true))
+		if name := ClientCertName(r); name != "" {
+			fields = append(fields, zap.String("client", name))
+		}
 	} else {
 		fields = append(fields, zap.Bool("tls", false))
 	}
@@ -57,3 +61,61 @@ func (z *ZapLogFormatter) FormatLog(r *http.Request, code, nbytes int, elapsed t
 		env.Log.Warn("error", fields...)
 	}
 }
+
+// StreamLogger takes the place of ZapLogger and ZapRecoverer for event
+// streams. Their ResponseWriter has to unwrap, so a stream can reach the
+// connection to lift its write deadline, flush, or hijack it; this one
+// does. Streams are logged when they end.
+func StreamLogger(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		sw := &streamWriter{ResponseWriter: w}
+		start := time.Now()
+		defer func() {
+			var err error
+			if rvr := recover(); rvr != nil {
+				err = errors.Errorf("panic: %v", rvr)
+				sw.code = http.StatusInternalServerError
+			}
+			code := sw.code
+			if code == 0 {
+				// hijacked for a WebSocket, or nothing written
+				code = http.StatusSwitchingProtocols
+				if !isWebSocket(r) {
+					code = http.StatusOK
+				}
+			}
+			zapLogFormatter.FormatLog(r, code, sw.nbytes, time.Since(start), err)
+		}()
+		next.ServeHTTP(sw, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// streamWriter notes the status and size of a response for StreamLogger.
+type streamWriter struct {
+	http.ResponseWriter
+	code   int
+	nbytes int
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.nbytes += n
+	return n, err
+}
+
+// Unwrap is for http.ResponseController.
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}